@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/api"
@@ -54,6 +55,44 @@ func main() {
 	if !ok {
 		log.Fatal("unable to load DB_PW")
 	}
+	teamDeleteGrace := 7 * 24 * time.Hour
+	if grace, ok := os.LookupEnv("SQM_SER_TEAM_DELETE_GRACE"); ok {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			log.Fatal("unable to parse SQM_SER_TEAM_DELETE_GRACE: ", err)
+		}
+		teamDeleteGrace = d
+	}
+	erasureGrace := 30 * 24 * time.Hour
+	if grace, ok := os.LookupEnv("SQM_SER_ERASURE_GRACE"); ok {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			log.Fatal("unable to parse SQM_SER_ERASURE_GRACE: ", err)
+		}
+		erasureGrace = d
+	}
+	loginRetention := 90 * 24 * time.Hour
+	if retention, ok := os.LookupEnv("SQM_SER_LOGIN_RETENTION"); ok {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatal("unable to parse SQM_SER_LOGIN_RETENTION: ", err)
+		}
+		loginRetention = d
+	}
+	policyReload := 5 * time.Second
+	if reload, ok := os.LookupEnv("SQM_SER_POLICY_RELOAD"); ok {
+		d, err := time.ParseDuration(reload)
+		if err != nil {
+			log.Fatal("unable to parse SQM_SER_POLICY_RELOAD: ", err)
+		}
+		policyReload = d
+	}
+	var trustedProxies []string
+	if proxies, ok := os.LookupEnv("SQM_SER_TRUSTED_PROXIES"); ok && proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	signingSeed, _ := os.LookupEnv("SQM_SER_SIGNING_SEED")
+	vaultKey, _ := os.LookupEnv("SQM_SER_VAULT_KEY")
 	ssl := "disable"
 	dbConnStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s", dbUser, dbPW, dbHost, dbPort, dbName, ssl)
 	log.Info("db conn str is ", dbConnStr)
@@ -72,6 +111,13 @@ func main() {
 	cfg.DB.ConnStr = dbConnStr
 	cfg.DB.MaxIdelTime = 5
 	cfg.DB.MaxOpenConns = 3
+	cfg.TeamDeleteGrace = teamDeleteGrace
+	cfg.ErasureGrace = erasureGrace
+	cfg.LoginRetention = loginRetention
+	cfg.SigningSeed = signingSeed
+	cfg.VaultKey = vaultKey
+	cfg.PolicyReload = policyReload
+	cfg.TrustedProxies = trustedProxies
 
 	db, err := db.New(cfg)
 	if err != nil {
@@ -82,6 +128,27 @@ func main() {
 		log.Fatal(err)
 	}
 	app.Migrations.DoMigrations("up")
+	if ok, err := app.RunCommand(os.Args[1:], os.Stdout); ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	go func() {
+		for {
+			app.PurgeDeletedTeams()
+			app.EraseUsers()
+			app.PurgeLoginHistory()
+			app.PurgeImportJobs()
+			time.Sleep(time.Hour)
+		}
+	}()
+	go func() {
+		for {
+			app.ReloadPolicy()
+			time.Sleep(cfg.PolicyReload)
+		}
+	}()
 	address := ":" + addr
 	log.Info("listening on address: ", address)
 	service := &http.Server{
@@ -55,6 +55,9 @@ func (app *Application) registerUserHandeler(c *gin.Context) {
 			v.AddError("email", "a user with this email already exists")
 			app.failedValidationResponse(c, v.Errors)
 			return
+		case strings.Contains(err.Error(), "quota exceeded"):
+			app.quotaExceededResponse(c, err)
+			return
 		default:
 			app.badRequest(c, err)
 			return
@@ -65,32 +68,60 @@ func (app *Application) registerUserHandeler(c *gin.Context) {
 
 }
 
+// deleteUserHandeler deactivates the user with the email. The account is suspended rather
+// than removed, so its history is kept and an admin can reactivate it.
 func (app *Application) deleteUserHandeler(c *gin.Context) {
 	var input struct {
-		Email    string `json:"email"`
+		Email  string `json:"email"`
+		Reason string `json:"reason"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
 		app.badRequest(c, err)
 		return
 	}
+	if input.Reason == "" {
+		input.Reason = "account deleted"
+	}
 
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
+	data.ValidateSuspension(v, input.Reason, nil)
 	if !v.Valid() {
 		app.failedValidationResponse(c, v.Errors)
 		return
 	}
 
 	user, err := app.Models.UserAccount.GetByEmail(input.Email)
-
 	if err != nil {
-		app.badRequest(c, err)
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
 		return
 	}
 
-	err = app.Models.UserAccount.Delete(user)
+	actor := app.contextGetUser(c)
+	if actor.ID == user.ID {
+		v.AddError("email", "you can not delete your own account")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err = app.Models.UserAccount.Suspend(user.ID, actor.ID, input.Reason, nil)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
 
+	user, err = app.Models.UserAccount.Get(user.ID)
 	if err != nil {
 		app.badRequest(c, err)
 		return
@@ -104,7 +135,7 @@ func (app *Application) getUserHandeler(c *gin.Context) {
 	authorizationHeader := c.Request.Header.Get("Authorization")
 
 	if authorizationHeader == "" {
-		c.JSON(http.StatusOK, gin.H{"user": data.AnonUser})
+		c.JSON(http.StatusOK, gin.H{"user": data.NewAnonUser()})
 		return
 	}
 
@@ -146,32 +177,123 @@ func (app *Application) createAuthenticationTokenHandeler(c *gin.Context) {
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		TeamID   int64  `json:"team_id"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
 		app.badRequest(c, err)
+		return
 	}
 
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlaintext(v, input.Password)
+	v.Check(input.TeamID >= 0, "team_id", "must not be negative")
 
 	if !v.Valid() {
 		app.failedValidationResponse(c, v.Errors)
 		return
 	}
 
+	// an email matching no user is not recorded, it may be anyone's address
 	user, err := app.Models.UserAccount.GetByEmail(input.Email)
 	if err != nil {
 		app.invalidCredentialsResponse(c)
 		return
 	}
 
-	token, err := app.Models.Token.New(user.ID, 24*time.Hour, data.ScopeLogin)
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.recordLogin(c, user.ID, input.Email, data.LoginFailed, nil)
+		app.badRequest(c, err)
+		return
+	}
+	if !match {
+		app.recordLogin(c, user.ID, input.Email, data.LoginInvalidCredentials, nil)
+		app.invalidCredentialsResponse(c)
+		return
+	}
+
+	if user.IsSuspended() {
+		app.recordLogin(c, user.ID, input.Email, data.LoginSuspended, nil)
+		app.accountSuspendedResponse(c)
+		return
+	}
+
+	// a token asked for a team is only accepted by the server registered for that team,
+	// without a team it is only accepted by this service
+	audience := ""
+	if input.TeamID != 0 {
+		server, err := app.Models.Server.GetForMember(input.TeamID, user.ID)
+		if err != nil {
+			switch {
+			case strings.Contains(err.Error(), "no record"):
+				v.AddError("team_id", "must be a team of yours with a registered server")
+				app.failedValidationResponse(c, v.Errors)
+			default:
+				app.badRequest(c, err)
+			}
+			return
+		}
+		audience = server.ServerURL
+	}
+
+	token, err := app.Models.Token.NewForAudience(user.ID, 24*time.Hour, data.ScopeLogin, audience)
 	if err != nil {
 		app.badRequest(c, err)
 		return
 	}
+	app.recordLogin(c, user.ID, input.Email, data.LoginSucceeded, token)
+
+	claims, err := app.Models.Attribute.Claims(user.ID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"authentication_token": token, "claims": claims})
+}
+
+func (app *Application) createPersonalAccessTokenHandeler(c *gin.Context) {
+	var input struct {
+		TTLHours int `json:"ttl_hours"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	if input.TTLHours == 0 {
+		input.TTLHours = 30 * 24
+	}
+
+	v := validator.New()
+	v.Check(input.TTLHours > 0, "ttl_hours", "must be greater than zero")
+	v.Check(input.TTLHours <= 365*24, "ttl_hours", "must not be more than a year")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+
+	token, err := app.Models.Token.New(user.ID, time.Duration(input.TTLHours)*time.Hour, data.ScopeRO)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "account suspended"):
+			app.accountSuspendedResponse(c)
+		case strings.Contains(err.Error(), "quota exceeded"):
+			app.quotaExceededResponse(c, err)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
 
-	c.JSON(http.StatusCreated, gin.H{"authentication_token": token})
+	c.JSON(http.StatusCreated, gin.H{"personal_access_token": token})
 }
\ No newline at end of file
@@ -2,9 +2,16 @@ package api
 
 import (
 	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/migrations"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/signer"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/vault"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
 )
 // Application represents our Application model
 type Application struct {
@@ -12,6 +19,9 @@ type Application struct {
 	Models     data.Models
 	Middleware Middleware
 	Migrations migrations.Migrations
+	Signer     *signer.Signer
+	Vault      *vault.Vault
+	Notifier   Notifier
 }
 // Config represents our Application configuration
 type Config struct {
@@ -21,7 +31,22 @@ type Config struct {
 	BuildVersion string
 	APIVerion    string
 	GinMode      string
-	DB           struct {
+	// TeamDeleteGrace is how long a deleted team can be restored before it is purged
+	TeamDeleteGrace time.Duration
+	// ErasureGrace is how long an erasure request can be cancelled before the user is erased
+	ErasureGrace time.Duration
+	// LoginRetention is how long authentication attempts are kept in the login history
+	LoginRetention time.Duration
+	// SigningSeed is the base64 ed25519 seed used to sign service credentials
+	SigningSeed string
+	// VaultKey is the base64 AES-256 key used to encrypt team secrets
+	VaultKey string
+	// PolicyReload is how often the casbin policy is checked for changes made by other replicas
+	PolicyReload time.Duration
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies whose
+	// X-Forwarded-For is believed, with none the client IP is always the remote address
+	TrustedProxies []string
+	DB             struct {
 		ConnStr      string
 		MaxOpenConns int
 		MaxIdleConns int
@@ -30,12 +55,106 @@ type Config struct {
 }
 // NewApplication creates a new Application
 func NewApplication(db *sql.DB, cfg *Config) (*Application, error) {
+	s, err := signer.New(cfg.SigningSeed)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SigningSeed == "" {
+		log.Info("no signing seed configured, credential signatures will not verify after a restart")
+	}
+
+	var vt *vault.Vault
+	if cfg.VaultKey != "" {
+		vt, err = vault.New(cfg.VaultKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("no vault key configured, team secrets are disabled")
+	}
+
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+
 	app := Application{
 		Config:     cfg,
 		Models:     data.NewModels(db),
 		Middleware: NewMiddleware("/", db),
 		Migrations: migrations.Migrations{DB: db},
+		Signer:     s,
+		Vault:      vt,
+		Notifier:   logNotifier{},
 	}
 
 	return &app, nil
 }
+
+// parseTrustedProxies parses proxy addresses and CIDR ranges, a bare address is a range of one
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// PurgeDeletedTeams permanently removes teams whose delete grace period has passed
+func (app *Application) PurgeDeletedTeams() {
+	n, err := app.Models.Team.Purge(app.Config.TeamDeleteGrace)
+	if err != nil {
+		log.Error("unable to purge deleted teams: ", err)
+		return
+	}
+	log.Debug("purged deleted teams ", n)
+}
+
+// EraseUsers pseudonymizes users whose erasure grace period has passed
+func (app *Application) EraseUsers() {
+	n, err := app.Models.UserAccount.Erase(app.Config.ErasureGrace)
+	if err != nil {
+		log.Error("unable to erase users: ", err)
+		return
+	}
+	log.Debug("erased users ", n)
+}
+
+// PurgeLoginHistory deletes the authentication attempts older than the login retention
+func (app *Application) PurgeLoginHistory() {
+	n, err := app.Models.Login.Purge(app.Config.LoginRetention)
+	if err != nil {
+		log.Error("unable to purge login history: ", err)
+		return
+	}
+	log.Debug("purged login events ", n)
+}
+
+// PurgeImportJobs deletes the results of imports run in the background once they are older
+// than importJobRetention
+func (app *Application) PurgeImportJobs() {
+	n, err := app.Models.UserAccount.PurgeImportJobs(importJobRetention)
+	if err != nil {
+		log.Error("unable to purge import jobs: ", err)
+		return
+	}
+	log.Debug("purged import jobs ", n)
+}
+
+// ReloadPolicy picks up casbin policy changes made by other replicas
+func (app *Application) ReloadPolicy() {
+	err := app.Models.Permission.Refresh()
+	if err != nil {
+		log.Error("unable to reload policy: ", err)
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+func (app *Application) listAttributeDefinitionsHandeler(c *gin.Context) {
+	kind := c.Param("kind")
+
+	v := validator.New()
+	if data.ValidateAttributeKind(v, kind); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	defs, err := app.Models.Attribute.List(kind)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"attributes": defs})
+}
+
+// defineAttributeHandeler creates or replaces the definition of a user or team attribute
+func (app *Application) defineAttributeHandeler(c *gin.Context) {
+	var input struct {
+		Type        string   `json:"type"`
+		Required    bool     `json:"required"`
+		Values      []string `json:"values"`
+		Description string   `json:"description"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	def := &data.AttributeDefinition{
+		Kind:        c.Param("kind"),
+		Name:        c.Param("name"),
+		Type:        input.Type,
+		Required:    input.Required,
+		Values:      input.Values,
+		Description: input.Description,
+	}
+
+	v := validator.New()
+	if data.ValidateAttributeDefinition(v, def); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if err := app.Models.Attribute.Define(def); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "invalid stored values"):
+			v.AddError("name", strings.TrimPrefix(err.Error(), "invalid stored values: "))
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"attribute": def})
+}
+
+func (app *Application) deleteAttributeHandeler(c *gin.Context) {
+	err := app.Models.Attribute.Delete(c.Param("kind"), c.Param("name"))
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "attribute deleted"})
+}
+
+// readAttributes reads the attributes of a request body and checks them against the
+// definitions of their kind
+func (app *Application) readAttributes(c *gin.Context, kind string) (data.Attributes, bool) {
+	var input struct {
+		Attributes data.Attributes `json:"attributes"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return nil, false
+	}
+	if input.Attributes == nil {
+		input.Attributes = data.Attributes{}
+	}
+
+	defs, err := app.Models.Attribute.List(kind)
+	if err != nil {
+		app.badRequest(c, err)
+		return nil, false
+	}
+
+	v := validator.New()
+	if data.ValidateAttributes(v, defs, input.Attributes); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, false
+	}
+	return input.Attributes, true
+}
+
+func (app *Application) getUserAttributesHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	claims, err := app.Models.Attribute.Claims(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "claims": claims})
+}
+
+// setUserAttributesHandeler replaces every attribute of a user
+func (app *Application) setUserAttributesHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	attrs, ok := app.readAttributes(c, data.AttributeUser)
+	if !ok {
+		return
+	}
+
+	err = app.Models.Attribute.SetForUser(id, attrs)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "attributes": attrs})
+}
+
+func (app *Application) getTeamAttributesHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	team, err := app.Models.Team.Get(id)
+	if err != nil || team.DeletedAt != nil {
+		switch {
+		case err == nil, strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team_id": id, "attributes": team.Meta.Attributes})
+}
+
+// setTeamAttributesHandeler replaces every attribute of a team
+func (app *Application) setTeamAttributesHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	attrs, ok := app.readAttributes(c, data.AttributeTeam)
+	if !ok {
+		return
+	}
+
+	err = app.Models.Attribute.SetForTeam(id, attrs)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team_id": id, "attributes": attrs})
+}
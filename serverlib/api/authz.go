@@ -0,0 +1,211 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAuthzChecks bounds the number of checks in a single batch request
+const maxAuthzChecks = 100
+
+// authzCheck asks whether a subject, given as a UserAccount ID or a token, may take an action
+// on an object. IP, MFA and Time are the attributes of the caller's request that policy
+// conditions are evaluated against, the scope and MFA flag of a token subject come from the
+// token itself.
+type authzCheck struct {
+	UserID int64      `json:"user_id"`
+	Token  string     `json:"token"`
+	Object string     `json:"object"`
+	Action string     `json:"action"`
+	IP     string     `json:"ip"`
+	MFA    bool       `json:"mfa"`
+	Time   *time.Time `json:"time"`
+}
+
+// authzDecision is the answer to an authzCheck, Error is set when the subject could not be
+// resolved and the check is denied
+type authzDecision struct {
+	*data.Decision
+	Error string `json:"error,omitempty"`
+}
+
+func validateAuthzCheck(v *validator.Validator, check *authzCheck) {
+	v.Check(check.UserID != 0 || check.Token != "", "subject", "one of user_id or token must be provided")
+	v.Check(check.UserID == 0 || check.Token == "", "subject", "only one of user_id or token may be provided")
+	if check.Token != "" {
+		data.ValidateTokenPlaintext(v, check.Token)
+	}
+	v.Check(check.Object != "", "object", "must be provided")
+	v.Check(check.Action != "", "action", "must be provided")
+}
+
+// decide resolves the subject of a check and makes the same decision as Middleware.Authorize
+func (app *Application) decide(check *authzCheck) (*authzDecision, error) {
+	env := &permission.Env{Time: time.Now(), IP: check.IP, MFA: check.MFA}
+	if check.Time != nil {
+		env.Time = *check.Time
+	}
+
+	userID := check.UserID
+	if check.Token != "" {
+		user, err := app.Models.UserAccount.GetForToken(data.ScopeForToken(check.Token), check.Token)
+		if err != nil {
+			if strings.Contains(err.Error(), "no record") {
+				return app.deniedDecision(check, "invalid or expired token"), nil
+			}
+			return nil, err
+		}
+		userID = user.ID
+		env.Scope = user.Token.Scope
+		env.MFA = user.Token.MFA
+	}
+
+	decision, err := app.Models.Permission.Decide(userID, check.Object, check.Action, env)
+	if err != nil {
+		if strings.Contains(err.Error(), "no record") {
+			return app.deniedDecision(check, "user does not exist"), nil
+		}
+		return nil, err
+	}
+	return &authzDecision{Decision: decision}, nil
+}
+
+func (app *Application) deniedDecision(check *authzCheck, reason string) *authzDecision {
+	return &authzDecision{
+		Decision: &data.Decision{Object: check.Object, Action: check.Action, Rule: []string{}},
+		Error:    reason,
+	}
+}
+
+func (app *Application) authzCheckHandeler(c *gin.Context) {
+	var input authzCheck
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if validateAuthzCheck(v, &input); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	decision, err := app.decide(&input)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"decision": decision})
+}
+
+func (app *Application) authzBatchCheckHandeler(c *gin.Context) {
+	var input struct {
+		Checks []*authzCheck `json:"checks"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Checks) > 0, "checks", "must be provided")
+	v.Check(len(input.Checks) <= maxAuthzChecks, "checks", "must not contain more than 100 checks")
+	for _, check := range input.Checks {
+		validateAuthzCheck(v, check)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	decisions := make([]*authzDecision, 0, len(input.Checks))
+	for _, check := range input.Checks {
+		decision, err := app.decide(check)
+		if err != nil {
+			app.badRequest(c, err)
+			return
+		}
+		decisions = append(decisions, decision)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"decisions": decisions})
+}
+
+func (app *Application) authzExplainHandeler(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Query("user_id"), 10, 64)
+	code := c.Query("code")
+
+	v := validator.New()
+	v.Check(err == nil && userID > 0, "user_id", "must be a user id")
+	v.Check(code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	env := &permission.Env{Time: time.Now(), IP: c.Query("ip"), Scope: c.Query("scope"), MFA: c.Query("mfa") == "true"}
+
+	explanation, err := app.Models.Permission.Explain(userID, code, env)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"explanation": explanation})
+}
+
+func (app *Application) authzDryRunHandeler(c *gin.Context) {
+	var input struct {
+		UserIDs []int64             `json:"user_ids"`
+		Codes   []string            `json:"codes"`
+		Changes []permission.Change `json:"changes"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.UserIDs) > 0, "user_ids", "must be provided")
+	v.Check(len(input.UserIDs) <= maxAuthzChecks, "user_ids", "must not contain more than 100 users")
+	v.Check(len(input.Codes) > 0, "codes", "must be provided")
+	v.Check(len(input.Codes) <= maxAuthzChecks, "codes", "must not contain more than 100 codes")
+	v.Check(len(input.Changes) > 0, "changes", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	results, err := app.Models.Permission.DryRun(input.UserIDs, input.Codes, input.Changes, &permission.Env{Time: time.Now()})
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "invalid rule"):
+			v.AddError("changes", err.Error())
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "no record"):
+			v.AddError("user_ids", "every user must exist")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
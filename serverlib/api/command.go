@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"gopkg.in/yaml.v2"
+)
+
+// CommandUsage describes the admin commands accepted by RunCommand
+const CommandUsage = `usage:
+  explain <email> <code>   show how the permission code is decided for a user
+  dry-run <file.json>      test a policy change, {"emails": [], "codes": [], "changes": []}
+  export [json|yaml]       write the roles, policies, teams and role assignments
+  import [--prune] [--dry-run] <file>
+                           sync the database with a json or yaml policy document`
+
+// ErrCommandUsage is returned by RunCommand when a command has the wrong arguments
+var ErrCommandUsage = errors.New(CommandUsage)
+
+// RunCommand runs an admin command and writes its result to w, as json unless the command
+// asks for yaml. It returns false when args do not name a command, so the server should start.
+func (app *Application) RunCommand(args []string, w io.Writer) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	var out interface{}
+	var err error
+	switch args[0] {
+	case "explain":
+		if len(args) != 3 {
+			return true, ErrCommandUsage
+		}
+		out, err = app.explainCommand(args[1], args[2])
+	case "dry-run":
+		if len(args) != 2 {
+			return true, ErrCommandUsage
+		}
+		out, err = app.dryRunCommand(args[1])
+	case "export":
+		if len(args) > 2 {
+			return true, ErrCommandUsage
+		}
+		out, err = app.Models.Policy.Export()
+		if err == nil && len(args) == 2 && args[1] == "yaml" {
+			return true, yaml.NewEncoder(w).Encode(out)
+		}
+	case "import":
+		out, err = app.importCommand(args[1:])
+	case "help":
+		return true, ErrCommandUsage
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return true, enc.Encode(out)
+}
+
+func (app *Application) importCommand(args []string) (interface{}, error) {
+	var prune, dryRun bool
+	var path string
+	for _, arg := range args {
+		switch arg {
+		case "--prune":
+			prune = true
+		case "--dry-run":
+			dryRun = true
+		default:
+			if path != "" || strings.HasPrefix(arg, "-") {
+				return nil, ErrCommandUsage
+			}
+			path = arg
+		}
+	}
+	if path == "" {
+		return nil, ErrCommandUsage
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// json is a subset of yaml, so either form of the document can be read
+	var doc data.PolicyDocument
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+	if data.ValidatePolicyDocument(v, &doc); !v.Valid() {
+		return nil, fmt.Errorf("invalid document: %v", v.Errors)
+	}
+
+	changes, err := app.Models.Policy.Import(&doc, prune, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"changes": changes, "applied": !dryRun}, nil
+}
+
+func (app *Application) explainCommand(email string, code string) (interface{}, error) {
+	user, err := app.Models.UserAccount.GetByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", email, err)
+	}
+	return app.Models.Permission.Explain(user.ID, code, &permission.Env{Time: time.Now()})
+}
+
+func (app *Application) dryRunCommand(path string) (interface{}, error) {
+	var input struct {
+		Emails  []string            `json:"emails"`
+		Codes   []string            `json:"codes"`
+		Changes []permission.Change `json:"changes"`
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &input); err != nil {
+		return nil, err
+	}
+	userIDs := []int64{}
+	for _, email := range input.Emails {
+		user, err := app.Models.UserAccount.GetByEmail(email)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", email, err)
+		}
+		userIDs = append(userIDs, user.ID)
+	}
+	return app.Models.Permission.DryRun(userIDs, input.Codes, input.Changes, &permission.Env{Time: time.Now()})
+}
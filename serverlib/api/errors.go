@@ -1,6 +1,7 @@
 package api
 
 import (
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
 	"github.com/gin-gonic/gin"
 	"net/http"
 )
@@ -20,3 +21,39 @@ func (app *Application) invalidCredentialsResponse(c *gin.Context) {
 func (app *Application) invalidAuthenticationTokenResponse(c *gin.Context) {
 	c.JSON(http.StatusUnauthorized, gin.H{"errors": "invalid or missing authentication token"})
 }
+
+func (app *Application) notFoundResponse(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{"errors": "the requested resource could not be found"})
+}
+
+func (app *Application) notPermittedResponse(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"errors": "your user account doesn't have the necessary permissions to access this resource"})
+}
+
+func (app *Application) accountSuspendedResponse(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"errors": "your user account has been suspended"})
+}
+
+func (app *Application) editConflictResponse(c *gin.Context) {
+	c.JSON(http.StatusConflict, gin.H{"errors": "unable to update the record due to an edit conflict, please try again"})
+}
+
+func (app *Application) teamHasMembersResponse(c *gin.Context, users []*data.UserAccount) {
+	c.JSON(http.StatusConflict, gin.H{"errors": "team has members without another team, reassign them first", "users": users})
+}
+
+func (app *Application) teamIsSCIMDefaultResponse(c *gin.Context) {
+	c.JSON(http.StatusConflict, gin.H{"errors": "team is the default team of a scim client, give the client another default team first"})
+}
+
+func (app *Application) quotaExceededResponse(c *gin.Context, err error) {
+	c.JSON(http.StatusConflict, gin.H{"errors": err.Error()})
+}
+
+func (app *Application) vaultNotConfiguredResponse(c *gin.Context) {
+	c.JSON(http.StatusServiceUnavailable, gin.H{"errors": "the secret vault has not been configured"})
+}
+
+func (app *Application) impersonationNotPermittedResponse(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"errors": "this action is not permitted while impersonating a user"})
+}
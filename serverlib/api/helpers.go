@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// readIDParam returns the :id url parameter
+func (app *Application) readIDParam(c *gin.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id parameter")
+	}
+	return id, nil
+}
+
+// contextGetUser returns the UserAccount set by Middleware.Authenticate, or an anonymous user
+// when authentication has not run
+func (app *Application) contextGetUser(c *gin.Context) *data.UserAccount {
+	user, ok := c.Value(string(userContextKey)).(*data.UserAccount)
+	if !ok {
+		return data.NewAnonUser()
+	}
+	return user
+}
+
+// requestEnv returns the attributes of the request that policy conditions are evaluated
+// against. Routes under /teams/:id act on the team in the url, which owns the object.
+func requestEnv(c *gin.Context, user *data.UserAccount) *permission.Env {
+	env := &permission.Env{Time: time.Now(), IP: c.ClientIP()}
+	if user.Token != nil {
+		env.Scope = user.Token.Scope
+		env.MFA = user.Token.MFA
+	}
+	if strings.Contains(c.FullPath(), "/teams/:id") {
+		if id, err := strconv.ParseInt(c.Param("id"), 10, 64); err == nil {
+			env.OwnerTeamID = id
+		}
+	}
+	return env
+}
+
+// readInt returns an integer query parameter, or def when it is missing
+func (app *Application) readInt(c *gin.Context, key string, def int, v *validator.Validator) int {
+	s := c.Query(key)
+	if s == "" {
+		return def
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return def
+	}
+	return i
+}
+
+// readBool returns a boolean query parameter, or nil when it is missing
+func (app *Application) readBool(c *gin.Context, key string, v *validator.Validator) *bool {
+	s := c.Query(key)
+	if s == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+	return &b
+}
+
+// readTime returns an RFC 3339 time query parameter, or nil when it is missing
+func (app *Application) readTime(c *gin.Context, key string, v *validator.Validator) *time.Time {
+	s := c.Query(key)
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 time")
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// impersonateUserHandeler issues an admin a short-lived token acting as another user. The
+// token carries the admin as its actor and every request made with it is logged.
+func (app *Application) impersonateUserHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Reason     string `json:"reason"`
+		TTLMinutes int    `json:"ttl_minutes"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	if input.TTLMinutes == 0 {
+		input.TTLMinutes = 15
+	}
+	ttl := time.Duration(input.TTLMinutes) * time.Minute
+
+	v := validator.New()
+	if data.ValidateImpersonation(v, input.Reason, ttl); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	actor := app.contextGetUser(c)
+	start := &data.ImpersonationEvent{
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Status: http.StatusCreated,
+		IP:     c.ClientIP(),
+		Reason: input.Reason,
+	}
+	token, err := app.Models.Impersonation.Start(actor.ID, id, ttl, start)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		case strings.Contains(err.Error(), "account suspended"):
+			v.AddError("id", "suspended users can not be impersonated")
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "invalid impersonation"):
+			v.AddError("id", strings.TrimPrefix(err.Error(), "invalid impersonation: "))
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"impersonation_token": token})
+}
+
+// getImpersonationHistoryHandeler lists the impersonations a user took part in, as the
+// admin acting or as the user impersonated
+func (app *Application) getImpersonationHistoryHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	events, err := app.Models.Impersonation.History(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"impersonations": events})
+}
+
+// denyImpersonation stops a request made with an impersonation token from reaching a
+// sensitive route, such as changing the user's credentials
+func (app *Application) denyImpersonation(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.Token != nil && user.Token.ActorID != 0 {
+		app.impersonationNotPermittedResponse(c)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
@@ -9,12 +9,17 @@ import (
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
 	"github.com/gin-gonic/gin"
 )
 
 type contextKey string
 const userContextKey = contextKey("user")
 
+// invalidTokenContextKey is set when a request's token was rejected and it is evaluated as
+// the anon role
+const invalidTokenContextKey = contextKey("invalid_token")
+
 // Middleware is the interface used to control permissioning for the app
 type Middleware interface {
 	// Authenticate determines if a user is allowed visibility on an object
@@ -30,8 +35,7 @@ type middleware struct {
 }
 
 func NewMiddleware(central string, db *sql.DB) *middleware {
-	pmanager := permission.PermissionManager{}
-	permissions := data.PermissionModel{Manager: pmanager, DB: db}
+	permissions := data.PermissionModel{Manager: permission.New(db), DB: db}
 	return &middleware{SQLMngrCentral: central, DB: db, Permissions: &permissions}
 }
 
@@ -39,41 +43,41 @@ func (mi *middleware) Authenticate(c *gin.Context) {
 	authorizationHeader := c.Request.Header.Get("Authorization")
 
 	if authorizationHeader == "" {
-		mi.contextSetUser(c, data.AnonUser)
+		mi.contextSetUser(c, data.NewAnonUser())
 		c.Next()
 		return
 	}
 
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		mi.invalidAuthenticationTokenResponse(c)
-		c.Abort()
+		mi.authenticateAsAnon(c)
 		return
 	}
 
 	token := headerParts[1]
 	if token == "" {
-		mi.invalidAuthenticationTokenResponse(c)
-		c.Abort()
+		mi.authenticateAsAnon(c)
 		return
 	}
 
 	v := validator.New()
 
 	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-		mi.invalidAuthenticationTokenResponse(c)
-		c.Abort()
+		mi.authenticateAsAnon(c)
 		return
 	}
 
+	// personal access tokens, sql-manager servers and scim clients authenticate with the
+	// credentials issued to them, the prefix of a token tells its scope
+	scope := data.ScopeForToken(token)
+
 	userMod := data.UserAccountModel{DB: mi.DB}
-	user, err := userMod.GetForToken(data.ScopeLogin, token)
+	user, err := userMod.GetForToken(scope, token)
 
 	if err != nil {
 		switch {
 		case strings.Contains(err.Error(), "no records"):
-			mi.invalidAuthenticationTokenResponse(c)
-			c.Abort()
+			mi.authenticateAsAnon(c)
 			return
 		default:
 			mi.badRequest(c, err)
@@ -81,24 +85,81 @@ func (mi *middleware) Authenticate(c *gin.Context) {
 			return
 		}
 	}
+	// login tokens issued for a sql-manager server are only accepted by that server, which
+	// checks them through introspection
+	if scope == data.ScopeLogin && user.Token.Audience != "" {
+		mi.authenticateAsAnon(c)
+		return
+	}
+	if user.IsSuspended() {
+		mi.accountSuspendedResponse(c)
+		c.Abort()
+		return
+	}
+	// an impersonation token only works while its actor may still impersonate, GetForToken
+	// has already rejected it if the actor was suspended or deleted
+	if user.Token.ActorID != 0 {
+		allowed, err := mi.Permissions.Can(user.Token.ActorID, "/users", "impersonate")
+		if err != nil {
+			mi.badRequest(c, err)
+			c.Abort()
+			return
+		}
+		if !allowed {
+			mi.authenticateAsAnon(c)
+			return
+		}
+	}
 	fmt.Println("=== here ===")
 	mi.contextSetUser(c, user)
 	c.Next()
+
+	if user.Token.ActorID != 0 {
+		mi.logImpersonation(c, user)
+	}
+}
+
+// authenticateAsAnon evaluates a request whose token was rejected as the anon role, routes
+// granted to anon still serve it and every other route answers that the token is invalid
+func (mi *middleware) authenticateAsAnon(c *gin.Context) {
+	c.Set(string(invalidTokenContextKey), true)
+	mi.contextSetUser(c, data.NewAnonUser())
+	c.Next()
+}
+
+// logImpersonation records a request made with an impersonation token against both the
+// admin acting and the user impersonated
+func (mi *middleware) logImpersonation(c *gin.Context, user *data.UserAccount) {
+	event := &data.ImpersonationEvent{
+		ActorID:       user.Token.ActorID,
+		UserAccountID: user.ID,
+		Method:        c.Request.Method,
+		Path:          c.Request.URL.Path,
+		Status:        c.Writer.Status(),
+		IP:            c.ClientIP(),
+	}
+	if err := (data.ImpersonationModel{DB: mi.DB}).Log(event); err != nil {
+		log.Error("unable to log impersonated request: ", err)
+	}
 }
 
 // Authorize determines if current subject has been authorized to take an action on an object.
 func (mi *middleware) Authorize(code string) gin.HandlerFunc {
+	obj, act := permission.SplitCode(code)
 	return func(c *gin.Context) {
 		user := mi.contextGetUser(c)
-		perm, err := mi.Permissions.GetForUser(user.ID)
+		decision, err := mi.Permissions.Decide(user.ID, obj, act, requestEnv(c, user))
 		if err != nil {
 			mi.badRequest(c, err)
 			c.Abort()
 			return
 		}
-		fmt.Println(perm, perm.Include(code))
-		if !perm.Include(code) {
-			mi.notPermittedResponse(c, code)
+		if !decision.Allow {
+			if c.GetBool(string(invalidTokenContextKey)) {
+				mi.invalidAuthenticationTokenResponse(c)
+			} else {
+				mi.notPermittedResponse(c, code)
+			}
 			c.Abort()
 			return
 		}
@@ -114,6 +175,10 @@ func (app *middleware) notPermittedResponse(c *gin.Context, code string) {
 	c.JSON(http.StatusUnauthorized, gin.H{"error": "code " + code + " not permitted"})
 }
 
+func (app *middleware) accountSuspendedResponse(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"errors": "your user account has been suspended"})
+}
+
 func (app *middleware) badRequest(c *gin.Context, err error) {
 	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 }
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
+)
+
+// Notifier delivers messages to users, such as email change confirmations and security
+// notices
+type Notifier interface {
+	Notify(to string, subject string, body string) error
+}
+
+// logNotifier writes notifications to the log, it is used until a mail transport is configured
+type logNotifier struct{}
+
+func (logNotifier) Notify(to string, subject string, body string) error {
+	log.Info("notification to ", to, ": ", subject)
+	log.Debug(body)
+	return nil
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin checks the current user is an admin of obj, writing the response when not
+func (app *Application) requireAdmin(c *gin.Context, obj string) bool {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.notPermittedResponse(c)
+		return false
+	}
+	decision, err := app.Models.Permission.Decide(user.ID, obj, permission.Admin, requestEnv(c, user))
+	if err != nil {
+		app.badRequest(c, err)
+		return false
+	}
+	if !decision.Allow {
+		app.notPermittedResponse(c)
+		return false
+	}
+	return true
+}
+
+func (app *Application) createOrganizationHandeler(c *gin.Context) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	org := &data.Organization{Name: input.Name}
+
+	v := validator.New()
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err := app.Models.Organization.Add(org)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate"):
+			v.AddError("name", "an organization with this name already exists")
+			app.failedValidationResponse(c, v.Errors)
+			return
+		default:
+			app.badRequest(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"organization": org})
+}
+
+func (app *Application) addOrganizationAdminHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	org, err := app.Models.Organization.Get(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	if !app.requireAdmin(c, permission.OrgSubject(org.ID)) {
+		return
+	}
+
+	user, err := app.Models.UserAccount.GetByEmail(input.Email)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	err = app.Models.Organization.AddAdmin(org.ID, user.ID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"organization": org, "admin": user})
+}
+
+func (app *Application) moveTeamHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		OrganizationID int64 `json:"organization_id"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	org, err := app.Models.Organization.Get(input.OrganizationID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			v := validator.New()
+			v.AddError("organization_id", "organization does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	// the caller must administer both the team being moved and the organization receiving it
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+	if !app.requireAdmin(c, permission.OrgSubject(org.ID)) {
+		return
+	}
+
+	err = app.Models.Organization.MoveTeam(id, org.ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team": gin.H{"id": id, "organization_id": org.ID}})
+}
+
+// getOrganizationTreeHandeler returns the organizations the user belongs to or administers,
+// those who can manage every organization see the full tree
+func (app *Application) getOrganizationTreeHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	all := false
+	if !user.IsAnon() {
+		decision, err := app.Models.Permission.Decide(user.ID, "/orgs", "write", requestEnv(c, user))
+		if err != nil {
+			app.badRequest(c, err)
+			return
+		}
+		all = decision.Allow
+	}
+
+	tree, err := app.Models.Organization.Tree(user.ID, all)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tree": tree})
+}
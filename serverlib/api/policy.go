@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// policyErrorResponse writes the response for an error from importing a policy document
+func (app *Application) policyErrorResponse(c *gin.Context, err error) {
+	switch {
+	case strings.Contains(err.Error(), "invalid rule"):
+		v := validator.New()
+		v.AddError("roles", err.Error())
+		app.failedValidationResponse(c, v.Errors)
+	case strings.Contains(err.Error(), "no record"):
+		v := validator.New()
+		v.AddError("document", err.Error())
+		app.failedValidationResponse(c, v.Errors)
+	case strings.Contains(err.Error(), "quota exceeded"), strings.Contains(err.Error(), "conflict"):
+		c.JSON(http.StatusConflict, gin.H{"errors": err.Error()})
+	default:
+		app.badRequest(c, err)
+	}
+}
+
+// exportPolicyHandeler writes the policy document as json, or as yaml with ?format=yaml
+func (app *Application) exportPolicyHandeler(c *gin.Context) {
+	doc, err := app.Models.Policy.Export()
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	if c.Query("format") == "yaml" {
+		c.YAML(http.StatusOK, doc)
+		return
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// importPolicyHandeler syncs the database with a json or yaml policy document. ?dry_run=true
+// only returns the diff, ?prune=true removes what is missing from the document.
+func (app *Application) importPolicyHandeler(c *gin.Context) {
+	var doc data.PolicyDocument
+
+	var err error
+	if strings.Contains(c.ContentType(), "yaml") {
+		err = c.ShouldBindYAML(&doc)
+	} else {
+		err = c.ShouldBindJSON(&doc)
+	}
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePolicyDocument(v, &doc); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	dryRun := c.Query("dry_run") == "true"
+	changes, err := app.Models.Policy.Import(&doc, c.Query("prune") == "true", dryRun)
+	if err != nil {
+		app.policyErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"changes": changes, "applied": !dryRun})
+}
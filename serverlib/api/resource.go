@@ -0,0 +1,207 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+func (app *Application) registerResourceHandeler(c *gin.Context) {
+	var input struct {
+		Kind        string `json:"kind"`
+		Name        string `json:"name"`
+		TeamID      int64  `json:"team_id"`
+		Description string `json:"description"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	resource := &data.Resource{Kind: input.Kind, Name: input.Name, TeamID: input.TeamID, Description: input.Description}
+
+	v := validator.New()
+	if data.ValidateResource(v, resource); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(resource.TeamID)) {
+		return
+	}
+
+	err := app.Models.Resource.Add(resource)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate"):
+			v.AddError("name", "a resource with this name already exists")
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "no record"):
+			v.AddError("team_id", "team does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"resource": resource})
+}
+
+func (app *Application) listResourcesHandeler(c *gin.Context) {
+	resources, err := app.Models.Resource.List(c.Query("kind"))
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"resources": resources})
+}
+
+func (app *Application) getResourceHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	resource, err := app.Models.Resource.Get(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	grants, err := app.Models.Resource.Grants(resource)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"resource": resource, "grants": grants})
+}
+
+func (app *Application) deleteResourceHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	resource, err := app.Models.Resource.Get(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(resource.TeamID)) {
+		return
+	}
+
+	err = app.Models.Resource.Delete(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "resource successfully deleted"})
+}
+
+// readResourceGrant binds a ResourceGrant and checks the current user may manage it, a grant
+// on a single resource is managed by its team's admins and a pattern by global admins
+func (app *Application) readResourceGrant(c *gin.Context) (*data.ResourceGrant, bool) {
+	var input struct {
+		UserID    int64  `json:"user_id"`
+		TeamID    int64  `json:"team_id"`
+		Object    string `json:"object"`
+		Action    string `json:"action"`
+		Condition string `json:"condition"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return nil, false
+	}
+
+	grant := &data.ResourceGrant{Object: input.Object, Action: input.Action, Condition: input.Condition}
+
+	v := validator.New()
+	v.Check(input.UserID != 0 || input.TeamID != 0, "subject", "one of user_id or team_id must be provided")
+	v.Check(input.UserID == 0 || input.TeamID == 0, "subject", "only one of user_id or team_id may be provided")
+	if data.ValidateResourceGrant(v, grant); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, false
+	}
+
+	if input.UserID != 0 {
+		grant.Subject = permission.UserSubject(input.UserID)
+	} else {
+		grant.Subject = permission.TeamSubject(input.TeamID)
+	}
+
+	if strings.HasSuffix(grant.Object, "*") {
+		return grant, app.requireAdmin(c, "*")
+	}
+
+	resource, err := app.Models.Resource.GetByPath(grant.Object)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			v.AddError("object", "no resource is registered at this path")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return nil, false
+	}
+	return grant, app.requireAdmin(c, permission.TeamSubject(resource.TeamID))
+}
+
+func (app *Application) grantResourceHandeler(c *gin.Context) {
+	grant, ok := app.readResourceGrant(c)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Resource.Grant(grant)
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"grant": grant})
+}
+
+func (app *Application) revokeResourceHandeler(c *gin.Context) {
+	grant, ok := app.readResourceGrant(c)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Resource.Revoke(grant)
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "grant successfully revoked"})
+}
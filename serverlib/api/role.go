@@ -0,0 +1,308 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// ruleErrorResponse writes the response for an error from granting, revoking or assigning a role
+func (app *Application) ruleErrorResponse(c *gin.Context, err error) {
+	switch {
+	case strings.Contains(err.Error(), "invalid rule"):
+		v := validator.New()
+		v.AddError("rule", err.Error())
+		app.failedValidationResponse(c, v.Errors)
+	case strings.Contains(err.Error(), "no record"):
+		app.notFoundResponse(c)
+	default:
+		app.badRequest(c, err)
+	}
+}
+
+func (app *Application) listRolesHandeler(c *gin.Context) {
+	roles, err := app.Models.Role.List()
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func (app *Application) getRoleHandeler(c *gin.Context) {
+	role, err := app.Models.Role.Get(c.Param("name"))
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
+
+func (app *Application) createRoleHandeler(c *gin.Context) {
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	role := &data.Role{Name: input.Name, Description: input.Description}
+
+	v := validator.New()
+	if data.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err := app.Models.Role.Add(role)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate"):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"role": role})
+}
+
+func (app *Application) deleteRoleHandeler(c *gin.Context) {
+	err := app.Models.Role.Delete(c.Param("name"))
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		case strings.Contains(err.Error(), "conflict"):
+			c.JSON(http.StatusConflict, gin.H{"errors": err.Error()})
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "role successfully deleted"})
+}
+
+// readPolicyInput binds and validates the object, action and condition of a grant or revoke
+func (app *Application) readPolicyInput(c *gin.Context) (string, string, string, bool) {
+	var input struct {
+		Object    string `json:"object"`
+		Action    string `json:"action"`
+		Condition string `json:"condition"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return "", "", "", false
+	}
+
+	v := validator.New()
+	v.Check(input.Object != "", "object", "must be provided")
+	v.Check(input.Action != "", "action", "must be provided")
+	if _, err := permission.ParseCondition(input.Condition); err != nil {
+		v.AddError("condition", err.Error())
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return "", "", "", false
+	}
+	return input.Object, input.Action, input.Condition, true
+}
+
+func (app *Application) grantRolePermissionHandeler(c *gin.Context) {
+	obj, act, cond, ok := app.readPolicyInput(c)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Role.Grant(c.Param("name"), obj, act, cond)
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	role, err := app.Models.Role.Get(c.Param("name"))
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
+
+func (app *Application) revokeRolePermissionHandeler(c *gin.Context) {
+	obj, act, _, ok := app.readPolicyInput(c)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Role.Revoke(c.Param("name"), obj, act)
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	role, err := app.Models.Role.Get(c.Param("name"))
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
+
+func (app *Application) getUserRolesHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	roles, err := app.Models.Role.GetForUser(id)
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func (app *Application) assignUserRoleHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateRoleName(v, input.Role); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if _, err := app.Models.UserAccount.Get(id); err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	err = app.Models.Role.Assign(id, input.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "no record") {
+			v.AddError("role", "no role with this name exists")
+			app.failedValidationResponse(c, v.Errors)
+			return
+		}
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	roles, err := app.Models.Role.GetForUser(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func (app *Application) unassignUserRoleHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	err = app.Models.Role.Unassign(id, c.Param("role"))
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	roles, err := app.Models.Role.GetForUser(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// getRolePermissionsHandeler returns the effective permissions of a role, including those
+// it inherits
+func (app *Application) getRolePermissionsHandeler(c *gin.Context) {
+	role, err := app.Models.Role.Get(c.Param("name"))
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role": role.Name, "inherits": role.Inherits, "permissions": role.EffectivePermissions})
+}
+
+func (app *Application) inheritRoleHandeler(c *gin.Context) {
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateRoleName(v, input.Role); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err := app.Models.Role.Inherit(c.Param("name"), input.Role)
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	role, err := app.Models.Role.Get(c.Param("name"))
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
+
+func (app *Application) disinheritRoleHandeler(c *gin.Context) {
+	err := app.Models.Role.Disinherit(c.Param("name"), c.Param("parent"))
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	role, err := app.Models.Role.Get(c.Param("name"))
+	if err != nil {
+		app.ruleErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
@@ -2,8 +2,11 @@ package api
 
 import (
 	"io"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -16,14 +19,54 @@ func Logrus(logger *logrus.Logger) gin.HandlerFunc {
 		c.Next()
 		end := time.Now().UTC()
 		latency := end.Sub(start)
-		logger.WithFields(logrus.Fields{
+		fields := logrus.Fields{
 			"status":     c.Writer.Status(),
 			"method":     c.Request.Method,
 			"path":       path,
 			"ip":         c.ClientIP(),
 			"duration":   latency,
 			"user_agent": c.Request.UserAgent(),
-		}).Info()
+		}
+		// requests made under impersonation carry both identities
+		if user, ok := c.Value(string(userContextKey)).(*data.UserAccount); ok && user.Token != nil && user.Token.ActorID != 0 {
+			fields["user_id"] = user.ID
+			fields["actor_id"] = user.Token.ActorID
+		}
+		logger.WithFields(fields).Info()
+	}
+}
+
+// RealIP sets the remote address of a request forwarded by one of the trusted proxies to the
+// client address in X-Forwarded-For, the rightmost address that is not itself a trusted proxy
+func RealIP(trusted []*net.IPNet) gin.HandlerFunc {
+	isTrusted := func(ip net.IP) bool {
+		for _, network := range trusted {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(c *gin.Context) {
+		host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+		if err != nil || len(trusted) == 0 {
+			return
+		}
+		remote := net.ParseIP(host)
+		if remote == nil || !isTrusted(remote) {
+			return
+		}
+		hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return
+			}
+			if !isTrusted(ip) || i == 0 {
+				c.Request.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+				return
+			}
+		}
 	}
 }
 
@@ -47,30 +90,140 @@ func (app *Application) Routes() *gin.Engine {
 	gin.SetMode(app.Config.GinMode)
 	gin.DefaultWriter = newLogrusWrite()
 	router := gin.New()
+	// gin would believe X-Forwarded-For from any peer, the client IP feeds policy conditions
+	// and the login and impersonation audit so only configured proxies are trusted
+	router.ForwardedByClientIP = false
+	trusted, err := parseTrustedProxies(app.Config.TrustedProxies)
+	if err != nil {
+		log.Error("trusting no proxies: ", err)
+	}
+	router.Use(RealIP(trusted))
 	router.Use(Logrus(log.Log))
 
 	router.NoRoute(func(c *gin.Context) {
 		c.JSON(404, gin.H{"code": "PAGE_NOT_FOUND", "message": "Page not found", "uri": c.Request.RequestURI})
 	})
 
-	public := router.Group("/" + app.Config.Version)
+	// every route is authorized through the policy, requests without a token are evaluated
+	// as the anon role so public routes are those granted to anon
+	group := router.Group("/" + app.Config.Version)
+	authenticate := func() gin.HandlerFunc { return app.Middleware.Authenticate }
 
-	public.GET("/ping", func(c *gin.Context) {
+	group.Use(authenticate())
+	group.GET("/ping", app.Middleware.Authorize("/ping-read"), func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"version": app.Config.Version, 
 			"build_version": app.Config.BuildVersion,
 			"api_version": app.Config.APIVerion,
 		})
 	})
+	group.GET("/servers/signing-key", app.Middleware.Authorize("/signing-key-read"), app.getSigningKeyHandeler)
+	group.DELETE("/users", app.Middleware.Authorize("/users-write"), app.deleteUserHandeler)
+	group.POST("/users", app.Middleware.Authorize("/users-write"), app.registerUserHandeler)
+	group.GET("/users", app.Middleware.Authorize("/users-read"), app.getUserHandeler)
+	group.GET("/user-accounts", app.Middleware.Authorize("/users-list"), app.listUsersHandeler)
+	group.POST("/users/import", app.Middleware.Authorize("/users-import"), app.importUsersHandeler)
+	group.GET("/users/import/:id", app.Middleware.Authorize("/users-import"), app.getImportJobHandeler)
+	group.GET("/users/export", app.Middleware.Authorize("/users-export"), app.exportUsersHandeler)
+	group.PUT("/users/invite", app.Middleware.Authorize("/invites-accept"), app.acceptInviteHandeler)
+	group.GET("/users/me", app.Middleware.Authorize("/profile-read"), app.getMeHandeler)
+	group.PATCH("/users/me", app.Middleware.Authorize("/profile-write"), app.denyImpersonation, app.updateMeHandeler)
+	group.PUT("/users/me/email", app.Middleware.Authorize("/profile-write"), app.denyImpersonation, app.confirmEmailHandeler)
+	group.PUT("/users/me/password", app.Middleware.Authorize("/profile-write"), app.denyImpersonation, app.changePasswordHandeler)
+	group.GET("/users/me/export", app.Middleware.Authorize("/profile-export"), app.exportMeHandeler)
+	group.GET("/users/me/sessions", app.Middleware.Authorize("/sessions-read"), app.listMySessionsHandeler)
+	group.DELETE("/users/me/sessions/:session_id", app.Middleware.Authorize("/sessions-write"), app.denyImpersonation, app.revokeMySessionHandeler)
+	group.GET("/users/me/logins", app.Middleware.Authorize("/sessions-read"), app.listMyLoginsHandeler)
+	group.POST("/users/me/erasure", app.Middleware.Authorize("/profile-erase"), app.denyImpersonation, app.requestErasureMeHandeler)
+	group.DELETE("/users/me/erasure", app.Middleware.Authorize("/profile-erase"), app.denyImpersonation, app.cancelErasureMeHandeler)
+	group.PATCH("/users/:id", app.Middleware.Authorize("/users-write"), app.updateUserHandeler)
+	group.POST("/users/:id/suspend", app.Middleware.Authorize("/users-suspend"), app.suspendUserHandeler)
+	group.POST("/users/:id/reactivate", app.Middleware.Authorize("/users-suspend"), app.reactivateUserHandeler)
+	group.GET("/users/:id/suspensions", app.Middleware.Authorize("/users-list"), app.getSuspensionHistoryHandeler)
+	group.POST("/users/:id/erasure", app.Middleware.Authorize("/users-erase"), app.requestErasureHandeler)
+	group.DELETE("/users/:id/erasure", app.Middleware.Authorize("/users-erase"), app.cancelErasureHandeler)
+	group.POST("/users/:id/impersonate", app.Middleware.Authorize("/users-impersonate"), app.denyImpersonation, app.impersonateUserHandeler)
+	group.GET("/users/:id/impersonations", app.Middleware.Authorize("/users-list"), app.getImpersonationHistoryHandeler)
+	group.GET("/users/:id/sessions", app.Middleware.Authorize("/users-list"), app.listSessionsHandeler)
+	group.DELETE("/users/:id/sessions/:session_id", app.Middleware.Authorize("/users-write"), app.revokeSessionHandeler)
+	group.GET("/users/:id/logins", app.Middleware.Authorize("/users-list"), app.listLoginsHandeler)
+	group.GET("/users/:id/attributes", app.Middleware.Authorize("/users-list"), app.getUserAttributesHandeler)
+	group.PUT("/users/:id/attributes", app.Middleware.Authorize("/attributes-write"), app.setUserAttributesHandeler)
+	group.POST("/tokens/authentication", app.Middleware.Authorize("/tokens-authenticate"), app.createAuthenticationTokenHandeler)
+	group.POST("/tokens/personal", app.Middleware.Authorize("/tokens-write"), app.denyImpersonation, app.createPersonalAccessTokenHandeler)
+	group.POST("/tokens/introspect", app.Middleware.Authorize("/introspect-read"), app.introspectTokenHandeler)
+	group.POST("/authz/check", app.Middleware.Authorize("/authz-read"), app.authzCheckHandeler)
+	group.POST("/authz/check/batch", app.Middleware.Authorize("/authz-read"), app.authzBatchCheckHandeler)
+	group.GET("/authz/explain", app.Middleware.Authorize("/authz-explain"), app.authzExplainHandeler)
+	group.POST("/authz/dry-run", app.Middleware.Authorize("/authz-explain"), app.authzDryRunHandeler)
+	group.POST("/servers", app.Middleware.Authorize("/servers-write"), app.registerServerHandeler)
+	group.GET("/servers/secrets/:name", app.readServerSecretHandeler)
 
-	private := router.Group("/" + app.Config.Version)
-	authenticate := func() gin.HandlerFunc { return app.Middleware.Authenticate }
+	group.GET("/users/:id/roles", app.Middleware.Authorize("/roles-read"), app.getUserRolesHandeler)
+	group.POST("/users/:id/roles", app.Middleware.Authorize("/roles-assign"), app.assignUserRoleHandeler)
+	group.DELETE("/users/:id/roles/:role", app.Middleware.Authorize("/roles-assign"), app.unassignUserRoleHandeler)
+	group.GET("/policy", app.Middleware.Authorize("/policy-read"), app.exportPolicyHandeler)
+	group.POST("/policy", app.Middleware.Authorize("/policy-write"), app.importPolicyHandeler)
+	group.GET("/roles", app.Middleware.Authorize("/roles-read"), app.listRolesHandeler)
+	group.POST("/roles", app.Middleware.Authorize("/roles-write"), app.createRoleHandeler)
+	group.GET("/roles/:name", app.Middleware.Authorize("/roles-read"), app.getRoleHandeler)
+	group.DELETE("/roles/:name", app.Middleware.Authorize("/roles-write"), app.deleteRoleHandeler)
+	group.GET("/roles/:name/permissions", app.Middleware.Authorize("/roles-read"), app.getRolePermissionsHandeler)
+	group.POST("/roles/:name/permissions", app.Middleware.Authorize("/roles-write"), app.grantRolePermissionHandeler)
+	group.POST("/roles/:name/inherits", app.Middleware.Authorize("/roles-write"), app.inheritRoleHandeler)
+	group.DELETE("/roles/:name/inherits/:parent", app.Middleware.Authorize("/roles-write"), app.disinheritRoleHandeler)
+	group.DELETE("/roles/:name/permissions", app.Middleware.Authorize("/roles-write"), app.revokeRolePermissionHandeler)
+
+	group.GET("/attributes/:kind", app.Middleware.Authorize("/attributes-read"), app.listAttributeDefinitionsHandeler)
+	group.PUT("/attributes/:kind/:name", app.Middleware.Authorize("/attributes-write"), app.defineAttributeHandeler)
+	group.DELETE("/attributes/:kind/:name", app.Middleware.Authorize("/attributes-write"), app.deleteAttributeHandeler)
+
+	group.GET("/resources", app.Middleware.Authorize("/resources-read"), app.listResourcesHandeler)
+	group.POST("/resources", app.Middleware.Authorize("/resources-write"), app.registerResourceHandeler)
+	group.GET("/resources/:id", app.Middleware.Authorize("/resources-read"), app.getResourceHandeler)
+	group.DELETE("/resources/:id", app.Middleware.Authorize("/resources-write"), app.deleteResourceHandeler)
+	group.POST("/resource-grants", app.Middleware.Authorize("/resources-write"), app.grantResourceHandeler)
+	group.DELETE("/resource-grants", app.Middleware.Authorize("/resources-write"), app.revokeResourceHandeler)
+
+	group.POST("/orgs", app.Middleware.Authorize("/orgs-write"), app.createOrganizationHandeler)
+	group.GET("/orgs/tree", app.Middleware.Authorize("/orgs-read"), app.getOrganizationTreeHandeler)
+	group.POST("/orgs/:id/admins", app.Middleware.Authorize("/orgs-write"), app.addOrganizationAdminHandeler)
+	group.PUT("/teams/:id/organization", app.Middleware.Authorize("/teams-write"), app.moveTeamHandeler)
+	group.PUT("/teams/:id/owner", app.Middleware.Authorize("/teams-write"), app.transferTeamOwnershipHandeler)
+	group.DELETE("/teams/:id", app.Middleware.Authorize("/teams-write"), app.deleteTeamHandeler)
+	group.POST("/teams/:id/restore", app.Middleware.Authorize("/teams-write"), app.restoreTeamHandeler)
+	group.POST("/teams/:id/members", app.Middleware.Authorize("/teams-write"), app.addTeamMemberHandeler)
+	group.DELETE("/teams/:id/members", app.Middleware.Authorize("/teams-write"), app.removeTeamMemberHandeler)
+	group.GET("/teams/:id/attributes", app.Middleware.Authorize("/attributes-read"), app.getTeamAttributesHandeler)
+	group.PUT("/teams/:id/attributes", app.Middleware.Authorize("/attributes-write"), app.setTeamAttributesHandeler)
+	group.GET("/teams/:id/quota", app.Middleware.Authorize("/quotas-read"), app.getTeamQuotaHandeler)
+	group.PUT("/teams/:id/quota", app.Middleware.Authorize("/quotas-write"), app.setTeamQuotaHandeler)
+	group.GET("/teams/:id/secrets", app.Middleware.Authorize("/secrets-read"), app.listSecretsHandeler)
+	group.GET("/teams/:id/secrets-audit", app.Middleware.Authorize("/secrets-read"), app.getSecretAccessLogHandeler)
+	group.PUT("/teams/:id/secrets/:name", app.Middleware.Authorize("/secrets-write"), app.putSecretHandeler)
+	group.DELETE("/teams/:id/secrets/:name", app.Middleware.Authorize("/secrets-write"), app.deleteSecretHandeler)
+
+	group.POST("/scim/clients", app.Middleware.Authorize("/scim-clients-write"), app.registerSCIMClientHandeler)
 
-	private.Use(authenticate())
-	private.DELETE("/users", app.Middleware.Authorize("/users-write"), app.deleteUserHandeler)
-	private.POST("/users", app.Middleware.Authorize("/users-write"), app.registerUserHandeler)
-	private.GET("/users", app.Middleware.Authorize("/users-read"), app.getUserHandeler)
-	private.POST("/tokens/authentication", app.createAuthenticationTokenHandeler)
+	// identity providers provision users and teams over scim 2.0 with the token issued to
+	// their scim client
+	scim := router.Group("/scim/v2")
+	scim.Use(authenticate())
+	scim.GET("/ServiceProviderConfig", app.Middleware.Authorize("/scim-read"), app.scimServiceProviderConfigHandeler)
+	scim.GET("/ResourceTypes", app.Middleware.Authorize("/scim-read"), app.scimResourceTypesHandeler)
+	scim.GET("/Schemas", app.Middleware.Authorize("/scim-read"), app.scimSchemasHandeler)
+	scim.GET("/Users", app.Middleware.Authorize("/scim-read"), app.scimListUsersHandeler)
+	scim.POST("/Users", app.Middleware.Authorize("/scim-write"), app.scimCreateUserHandeler)
+	scim.GET("/Users/:id", app.Middleware.Authorize("/scim-read"), app.scimGetUserHandeler)
+	scim.PUT("/Users/:id", app.Middleware.Authorize("/scim-write"), app.scimReplaceUserHandeler)
+	scim.PATCH("/Users/:id", app.Middleware.Authorize("/scim-write"), app.scimPatchUserHandeler)
+	scim.DELETE("/Users/:id", app.Middleware.Authorize("/scim-write"), app.scimDeleteUserHandeler)
+	scim.GET("/Groups", app.Middleware.Authorize("/scim-read"), app.scimListGroupsHandeler)
+	scim.POST("/Groups", app.Middleware.Authorize("/scim-write"), app.scimCreateGroupHandeler)
+	scim.GET("/Groups/:id", app.Middleware.Authorize("/scim-read"), app.scimGetGroupHandeler)
+	scim.PUT("/Groups/:id", app.Middleware.Authorize("/scim-write"), app.scimReplaceGroupHandeler)
+	scim.PATCH("/Groups/:id", app.Middleware.Authorize("/scim-write"), app.scimPatchGroupHandeler)
+	scim.DELETE("/Groups/:id", app.Middleware.Authorize("/scim-write"), app.scimDeleteGroupHandeler)
 
 	return router
 }
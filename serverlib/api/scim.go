@@ -0,0 +1,1030 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// scimCredentialTTL is how long the credential of a SCIM client is valid for
+const scimCredentialTTL = 365 * 24 * time.Hour
+
+// scimMaxResults is the most resources a SCIM list returns in one page
+const scimMaxResults = 200
+
+const (
+	scimUserSchema     = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema    = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema     = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema    = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema    = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimProviderSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimTypeSchema     = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema   = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version"`
+}
+
+// scimUser is the SCIM representation of a UserAccount, its userName is the email
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *scimName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Password    string      `json:"password,omitempty"`
+	Groups      []scimRef   `json:"groups,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+// scimGroup is the SCIM representation of a Team
+type scimGroup struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id,omitempty"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	DisplayName string    `json:"displayName"`
+	Members     []scimRef `json:"members"`
+	Meta        *scimMeta `json:"meta,omitempty"`
+}
+
+// scimPatch is a PatchOp request, each operation applies to the resource in turn
+type scimPatch struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimMemberPath matches a value filter selecting one member, as in members[value eq "4"]
+var scimMemberPath = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+// scimError writes a SCIM error response
+func (app *Application) scimError(c *gin.Context, status int, scimType string, detail string) {
+	body := gin.H{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(status), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	app.scimJSON(c, status, body)
+}
+
+// scimErrorResponse maps an error from the SCIM model to its SCIM error response
+func (app *Application) scimErrorResponse(c *gin.Context, err error) {
+	switch {
+	case strings.Contains(err.Error(), "no record"):
+		app.scimError(c, http.StatusNotFound, "", "resource not found")
+	case strings.Contains(err.Error(), "invalid filter"):
+		app.scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+	case strings.Contains(err.Error(), "invalid member"):
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+	case strings.Contains(err.Error(), "duplicate"):
+		app.scimError(c, http.StatusConflict, "uniqueness", err.Error())
+	case strings.Contains(err.Error(), "precondition failed"):
+		app.scimError(c, http.StatusPreconditionFailed, "", "the resource has been modified")
+	case strings.Contains(err.Error(), "quota exceeded"), strings.Contains(err.Error(), "conflict"):
+		app.scimError(c, http.StatusConflict, "", err.Error())
+	default:
+		app.scimError(c, http.StatusBadRequest, "", err.Error())
+	}
+}
+
+func (app *Application) scimJSON(c *gin.Context, status int, body interface{}) {
+	c.Header("Content-Type", "application/scim+json")
+	c.JSON(status, body)
+}
+
+// scimETag is the weak entity tag of a resource at version
+func scimETag(version int) string {
+	return fmt.Sprintf(`W/"%d"`, version)
+}
+
+// scimVersion returns the version an If-Match header expects, or current when there is none
+func scimVersion(c *gin.Context, current int) (int, bool) {
+	match := c.GetHeader("If-Match")
+	if match == "" || match == "*" {
+		return current, true
+	}
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if v, err := strconv.Atoi(strings.Trim(tag, `"`)); err == nil {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// scimNotModified reports whether an If-None-Match header matches the resource
+func scimNotModified(c *gin.Context, version int) bool {
+	for _, tag := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if strings.TrimSpace(tag) == scimETag(version) || strings.TrimSpace(tag) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// scimLocation is the url of a SCIM resource
+func scimLocation(c *gin.Context, resource string, id int64) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/scim/v2/%s/%d", scheme, c.Request.Host, resource, id)
+}
+
+// scimClient returns the SCIMClient making the request
+func (app *Application) scimClient(c *gin.Context) (*data.SCIMClient, bool) {
+	client, err := app.Models.SCIM.GetClient(app.contextGetUser(c).ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.scimError(c, http.StatusForbidden, "", "the token does not belong to a scim client")
+		default:
+			app.scimErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	return client, true
+}
+
+// readSCIMID returns the :id url parameter, ids that are not numbers match no resource
+func (app *Application) readSCIMID(c *gin.Context) (int64, bool) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.scimError(c, http.StatusNotFound, "", "resource not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// readSCIMPage returns the 1-based startIndex and count of a list request
+func (app *Application) readSCIMPage(c *gin.Context) (int, int, bool) {
+	v := validator.New()
+	startIndex := app.readInt(c, "startIndex", 1, v)
+	count := app.readInt(c, "count", 100, v)
+	if !v.Valid() {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", "startIndex and count must be integers")
+		return 0, 0, false
+	}
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scimMaxResults {
+		count = scimMaxResults
+	}
+	return startIndex, count, true
+}
+
+func (app *Application) scimListResponse(c *gin.Context, resources interface{}, total int, startIndex int, n int) {
+	app.scimJSON(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": n,
+		"Resources":    resources,
+	})
+}
+
+func toSCIMUser(c *gin.Context, u *data.ProvisionedUser) *scimUser {
+	active := u.Active
+	user := &scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          strconv.FormatInt(u.ID, 10),
+		ExternalID:  u.ExternalID,
+		UserName:    u.UserName,
+		DisplayName: u.Name,
+		Emails:      []scimEmail{{Value: u.UserName, Type: "work", Primary: true}},
+		Active:      &active,
+		Groups:      []scimRef{},
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.CreatedAt,
+			Location:     scimLocation(c, "Users", u.ID),
+			Version:      scimETag(u.Version),
+		},
+	}
+	if u.Name != "" {
+		user.Name = &scimName{Formatted: u.Name}
+	}
+	for _, g := range u.Groups {
+		id := strconv.FormatInt(g.ID, 10)
+		user.Groups = append(user.Groups, scimRef{Value: id, Display: g.Display, Ref: scimLocation(c, "Groups", g.ID)})
+	}
+	return user
+}
+
+func toSCIMGroup(c *gin.Context, g *data.ProvisionedGroup) *scimGroup {
+	group := &scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          strconv.FormatInt(g.ID, 10),
+		ExternalID:  g.ExternalID,
+		DisplayName: g.Name,
+		Members:     []scimRef{},
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Created:      g.CreatedAt,
+			LastModified: g.CreatedAt,
+			Location:     scimLocation(c, "Groups", g.ID),
+			Version:      scimETag(g.Version),
+		},
+	}
+	for _, m := range g.Members {
+		id := strconv.FormatInt(m.ID, 10)
+		group.Members = append(group.Members, scimRef{Value: id, Display: m.Display, Ref: scimLocation(c, "Users", m.ID)})
+	}
+	return group
+}
+
+// fromSCIMUser copies the writable attributes of a SCIM User onto u. The name is the
+// displayName, or else the formatted name, or else the given and family names.
+func fromSCIMUser(input *scimUser, u *data.ProvisionedUser) {
+	u.UserName = input.UserName
+	u.ExternalID = input.ExternalID
+	u.Name = input.DisplayName
+	if u.Name == "" && input.Name != nil {
+		u.Name = input.Name.Formatted
+		if u.Name == "" {
+			u.Name = strings.TrimSpace(input.Name.GivenName + " " + input.Name.FamilyName)
+		}
+	}
+	u.Active = input.Active == nil || *input.Active
+}
+
+func validateSCIMUser(u *data.ProvisionedUser, plaintext string) error {
+	v := validator.New()
+	data.ValidateEmail(v, u.UserName)
+	data.ValidateName(v, u.Name)
+	if plaintext != "" {
+		data.ValidatePasswordPlaintext(v, plaintext)
+	}
+	for key, msg := range v.Errors {
+		if key == "email" {
+			key = "userName"
+		}
+		return fmt.Errorf("%s %s", key, msg)
+	}
+	return nil
+}
+
+// fromSCIMMembers returns the members of a SCIM Group
+func fromSCIMMembers(refs []scimRef) ([]*data.ProvisionedRef, error) {
+	members := []*data.ProvisionedRef{}
+	for _, ref := range refs {
+		id, err := strconv.ParseInt(ref.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid member: %q is not a user id", ref.Value)
+		}
+		members = append(members, &data.ProvisionedRef{ID: id})
+	}
+	return members, nil
+}
+
+func (app *Application) registerSCIMClientHandeler(c *gin.Context) {
+	var input struct {
+		Name   string `json:"name"`
+		TeamID int64  `json:"team_id"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	client := &data.SCIMClient{Name: input.Name, DefaultTeamID: input.TeamID}
+
+	v := validator.New()
+	if data.ValidateSCIMClient(v, client); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err := app.Models.SCIM.RegisterClient(client)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	// registering again rotates the credential
+	err = app.Models.Token.DeleteAllForUser(data.ScopeSCIM, client.ServiceAccountID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	token, err := app.Models.Token.New(client.ServiceAccountID, scimCredentialTTL, data.ScopeSCIM)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"client": client, "token": token.Plaintext, "expiry": token.Expiry})
+}
+
+func (app *Application) scimListUsersHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	startIndex, count, ok := app.readSCIMPage(c)
+	if !ok {
+		return
+	}
+
+	users, total, err := app.Models.SCIM.ListUsers(client, c.Query("filter"), startIndex, count)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	resources := []*scimUser{}
+	for _, u := range users {
+		resources = append(resources, toSCIMUser(c, u))
+	}
+	app.scimListResponse(c, resources, total, startIndex, len(resources))
+}
+
+func (app *Application) scimGetUserHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	user, err := app.Models.SCIM.GetUser(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", scimETag(user.Version))
+	if scimNotModified(c, user.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	app.scimJSON(c, http.StatusOK, toSCIMUser(c, user))
+}
+
+func (app *Application) scimCreateUserHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+
+	var input scimUser
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	user := &data.ProvisionedUser{}
+	fromSCIMUser(&input, user)
+	if err := validateSCIMUser(user, input.Password); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err := app.Models.SCIM.CreateUser(client, user, input.Password); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	app.writeSCIMUser(c, client, http.StatusCreated, user.ID)
+}
+
+// writeSCIMUser responds with a user as it is stored
+func (app *Application) writeSCIMUser(c *gin.Context, client *data.SCIMClient, status int, id int64) {
+	user, err := app.Models.SCIM.GetUser(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	c.Header("ETag", scimETag(user.Version))
+	if status == http.StatusCreated {
+		c.Header("Location", scimLocation(c, "Users", user.ID))
+	}
+	app.scimJSON(c, status, toSCIMUser(c, user))
+}
+
+func (app *Application) scimReplaceUserHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	var input scimUser
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	user, err := app.Models.SCIM.GetUser(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	if user.Version, ok = scimVersion(c, user.Version); !ok {
+		app.scimError(c, http.StatusPreconditionFailed, "", "the resource has been modified")
+		return
+	}
+
+	fromSCIMUser(&input, user)
+	if err = validateSCIMUser(user, input.Password); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err = app.Models.SCIM.ReplaceUser(client, user, input.Password); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	app.writeSCIMUser(c, client, http.StatusOK, user.ID)
+}
+
+func (app *Application) scimPatchUserHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	var input scimPatch
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	user, err := app.Models.SCIM.GetUser(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	if user.Version, ok = scimVersion(c, user.Version); !ok {
+		app.scimError(c, http.StatusPreconditionFailed, "", "the resource has been modified")
+		return
+	}
+
+	for _, op := range input.Operations {
+		if err = patchSCIMUser(user, strings.ToLower(op.Op), op.Path, op.Value); err != nil {
+			app.scimError(c, http.StatusBadRequest, scimPatchErrorType(err), err.Error())
+			return
+		}
+	}
+	if err = validateSCIMUser(user, ""); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err = app.Models.SCIM.ReplaceUser(client, user, ""); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	app.writeSCIMUser(c, client, http.StatusOK, user.ID)
+}
+
+// scimPatchErrorType is the scimType of an error applying a patch operation
+func scimPatchErrorType(err error) string {
+	switch {
+	case strings.Contains(err.Error(), "invalid path"):
+		return "invalidPath"
+	case strings.Contains(err.Error(), "no target"):
+		return "noTarget"
+	default:
+		return "invalidValue"
+	}
+}
+
+// scimAttribute returns a patch path lowercased and without its schema urn
+func scimAttribute(path string) string {
+	path = strings.ToLower(strings.TrimSpace(path))
+	if strings.HasPrefix(path, "urn:") {
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	return path
+}
+
+// patchSCIMUser applies one patch operation to a user. The emails of a user are derived from
+// its userName, so operations on them are accepted and ignored.
+func patchSCIMUser(user *data.ProvisionedUser, op string, path string, value json.RawMessage) error {
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("invalid op %q", op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return errors.New("no target: remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return errors.New("value must be an object when there is no path")
+		}
+		for attr, v := range attrs {
+			if err := patchSCIMUser(user, op, attr, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	attr := scimAttribute(path)
+	if attr == "name" && op != "remove" {
+		var name scimName
+		if err := json.Unmarshal(value, &name); err != nil {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		user.Name = name.Formatted
+		if user.Name == "" {
+			user.Name = strings.TrimSpace(name.GivenName + " " + name.FamilyName)
+		}
+		return nil
+	}
+	if attr == "emails" || strings.HasPrefix(attr, "emails[") || strings.HasPrefix(attr, "emails.") {
+		return nil
+	}
+
+	var s string
+	switch attr {
+	case "active":
+		if op == "remove" {
+			return fmt.Errorf("invalid path: %s can not be removed", path)
+		}
+		// some identity providers send booleans as strings
+		var b bool
+		if err := json.Unmarshal(value, &b); err != nil {
+			if err = json.Unmarshal(value, &s); err != nil {
+				return fmt.Errorf("%s must be a boolean", path)
+			}
+			if b, err = strconv.ParseBool(s); err != nil {
+				return fmt.Errorf("%s must be a boolean", path)
+			}
+		}
+		user.Active = b
+		return nil
+	case "username", "displayname", "name.formatted", "externalid", "password":
+	default:
+		return fmt.Errorf("invalid path: %s is not supported", path)
+	}
+
+	if op != "remove" {
+		if err := json.Unmarshal(value, &s); err != nil {
+			return fmt.Errorf("%s must be a string", path)
+		}
+	}
+	switch attr {
+	case "username":
+		if op == "remove" {
+			return fmt.Errorf("invalid path: %s can not be removed", path)
+		}
+		user.UserName = s
+	case "displayname", "name.formatted":
+		user.Name = s
+	case "externalid":
+		user.ExternalID = s
+	case "password":
+		return fmt.Errorf("invalid path: %s can only be set with a PUT", path)
+	}
+	return nil
+}
+
+func (app *Application) scimDeleteUserHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.SCIM.DeleteUser(client, id); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (app *Application) scimListGroupsHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	startIndex, count, ok := app.readSCIMPage(c)
+	if !ok {
+		return
+	}
+
+	groups, total, err := app.Models.SCIM.ListGroups(client, c.Query("filter"), startIndex, count)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	resources := []*scimGroup{}
+	for _, g := range groups {
+		group := toSCIMGroup(c, g)
+		if strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members") {
+			group.Members = nil
+		}
+		resources = append(resources, group)
+	}
+	app.scimListResponse(c, resources, total, startIndex, len(resources))
+}
+
+func (app *Application) scimGetGroupHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	group, err := app.Models.SCIM.GetGroup(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", scimETag(group.Version))
+	if scimNotModified(c, group.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	app.scimJSON(c, http.StatusOK, toSCIMGroup(c, group))
+}
+
+// writeSCIMGroup responds with a group as it is stored
+func (app *Application) writeSCIMGroup(c *gin.Context, client *data.SCIMClient, status int, id int64) {
+	group, err := app.Models.SCIM.GetGroup(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	c.Header("ETag", scimETag(group.Version))
+	if status == http.StatusCreated {
+		c.Header("Location", scimLocation(c, "Groups", group.ID))
+	}
+	app.scimJSON(c, status, toSCIMGroup(c, group))
+}
+
+func validateSCIMGroup(group *data.ProvisionedGroup) error {
+	if group.Name == "" {
+		return errors.New("displayName must be provided")
+	}
+	if len(group.Name) > 500 {
+		return errors.New("displayName must not be more than 500 bytes long")
+	}
+	return nil
+}
+
+func (app *Application) scimCreateGroupHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+
+	var input scimGroup
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	members, err := fromSCIMMembers(input.Members)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	group := &data.ProvisionedGroup{Name: input.DisplayName, ExternalID: input.ExternalID, Members: members}
+	if err = validateSCIMGroup(group); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err = app.Models.SCIM.CreateGroup(client, group); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	app.writeSCIMGroup(c, client, http.StatusCreated, group.ID)
+}
+
+func (app *Application) scimReplaceGroupHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	var input scimGroup
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	group, err := app.Models.SCIM.GetGroup(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	if group.Version, ok = scimVersion(c, group.Version); !ok {
+		app.scimError(c, http.StatusPreconditionFailed, "", "the resource has been modified")
+		return
+	}
+
+	if group.Members, err = fromSCIMMembers(input.Members); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	group.Name = input.DisplayName
+	group.ExternalID = input.ExternalID
+	if err = validateSCIMGroup(group); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err = app.Models.SCIM.ReplaceGroup(client, group); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	app.writeSCIMGroup(c, client, http.StatusOK, group.ID)
+}
+
+func (app *Application) scimPatchGroupHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	var input scimPatch
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	group, err := app.Models.SCIM.GetGroup(client, id)
+	if err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	if group.Version, ok = scimVersion(c, group.Version); !ok {
+		app.scimError(c, http.StatusPreconditionFailed, "", "the resource has been modified")
+		return
+	}
+
+	for _, op := range input.Operations {
+		if err = patchSCIMGroup(group, strings.ToLower(op.Op), op.Path, op.Value); err != nil {
+			if strings.Contains(err.Error(), "invalid member") {
+				app.scimErrorResponse(c, err)
+				return
+			}
+			app.scimError(c, http.StatusBadRequest, scimPatchErrorType(err), err.Error())
+			return
+		}
+	}
+	if err = validateSCIMGroup(group); err != nil {
+		app.scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if err = app.Models.SCIM.ReplaceGroup(client, group); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+
+	app.writeSCIMGroup(c, client, http.StatusOK, group.ID)
+}
+
+// patchSCIMGroup applies one patch operation to a group
+func patchSCIMGroup(group *data.ProvisionedGroup, op string, path string, value json.RawMessage) error {
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("invalid op %q", op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return errors.New("no target: remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return errors.New("value must be an object when there is no path")
+		}
+		for attr, v := range attrs {
+			if err := patchSCIMGroup(group, op, attr, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if m := scimMemberPath.FindStringSubmatch(strings.TrimSpace(path)); m != nil {
+		if op != "remove" {
+			return fmt.Errorf("invalid path: %s can only be removed", path)
+		}
+		id, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid member: %q is not a user id", m[1])
+		}
+		group.Members = removeSCIMMembers(group.Members, []*data.ProvisionedRef{{ID: id}})
+		return nil
+	}
+
+	attr := scimAttribute(path)
+	switch attr {
+	case "members":
+		var members []*data.ProvisionedRef
+		if len(value) > 0 {
+			var refs []scimRef
+			if err := json.Unmarshal(value, &refs); err != nil {
+				return fmt.Errorf("%s must be a list of members", path)
+			}
+			var err error
+			if members, err = fromSCIMMembers(refs); err != nil {
+				return err
+			}
+		}
+		switch op {
+		case "add":
+			group.Members = append(removeSCIMMembers(group.Members, members), members...)
+		case "replace":
+			group.Members = members
+		case "remove":
+			if len(value) == 0 {
+				group.Members = []*data.ProvisionedRef{}
+			} else {
+				group.Members = removeSCIMMembers(group.Members, members)
+			}
+		}
+		return nil
+	case "displayname", "externalid":
+	default:
+		return fmt.Errorf("invalid path: %s is not supported", path)
+	}
+
+	var s string
+	if op != "remove" {
+		if err := json.Unmarshal(value, &s); err != nil {
+			return fmt.Errorf("%s must be a string", path)
+		}
+	}
+	switch attr {
+	case "displayname":
+		if op == "remove" {
+			return fmt.Errorf("invalid path: %s can not be removed", path)
+		}
+		group.Name = s
+	case "externalid":
+		group.ExternalID = s
+	}
+	return nil
+}
+
+// removeSCIMMembers returns members without any of remove
+func removeSCIMMembers(members []*data.ProvisionedRef, remove []*data.ProvisionedRef) []*data.ProvisionedRef {
+	drop := map[int64]bool{}
+	for _, m := range remove {
+		drop[m.ID] = true
+	}
+	kept := []*data.ProvisionedRef{}
+	for _, m := range members {
+		if !drop[m.ID] {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+func (app *Application) scimDeleteGroupHandeler(c *gin.Context) {
+	client, ok := app.scimClient(c)
+	if !ok {
+		return
+	}
+	id, ok := app.readSCIMID(c)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.SCIM.DeleteGroup(client, id); err != nil {
+		app.scimErrorResponse(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (app *Application) scimServiceProviderConfigHandeler(c *gin.Context) {
+	app.scimJSON(c, http.StatusOK, gin.H{
+		"schemas":        []string{scimProviderSchema},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": gin.H{"supported": true},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": true},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "the token issued when the scim client was registered",
+			"primary":     true,
+		}},
+	})
+}
+
+func (app *Application) scimResourceTypesHandeler(c *gin.Context) {
+	types := []gin.H{
+		{"schemas": []string{scimTypeSchema}, "id": "User", "name": "User", "endpoint": "/Users", "schema": scimUserSchema},
+		{"schemas": []string{scimTypeSchema}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": scimGroupSchema},
+	}
+	app.scimListResponse(c, types, len(types), 1, len(types))
+}
+
+func (app *Application) scimSchemasHandeler(c *gin.Context) {
+	attr := func(name string, typ string, required bool, uniqueness string) gin.H {
+		return gin.H{"name": name, "type": typ, "multiValued": false, "required": required, "mutability": "readWrite", "returned": "default", "uniqueness": uniqueness}
+	}
+	schemas := []gin.H{
+		{
+			"schemas": []string{scimSchemaSchema}, "id": scimUserSchema, "name": "User",
+			"attributes": []gin.H{
+				attr("userName", "string", true, "server"),
+				attr("displayName", "string", false, "none"),
+				attr("externalId", "string", false, "none"),
+				attr("active", "boolean", false, "none"),
+			},
+		},
+		{
+			"schemas": []string{scimSchemaSchema}, "id": scimGroupSchema, "name": "Group",
+			"attributes": []gin.H{
+				attr("displayName", "string", true, "server"),
+				attr("externalId", "string", false, "none"),
+			},
+		},
+	}
+	app.scimListResponse(c, schemas, len(schemas), 1, len(schemas))
+}
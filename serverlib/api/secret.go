@@ -0,0 +1,238 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
+	"github.com/gin-gonic/gin"
+)
+
+// secretAD binds a secret's ciphertext to its team and name
+func secretAD(teamID int64, name string) []byte {
+	return []byte(fmt.Sprintf("team:%d/%s", teamID, name))
+}
+
+// secretAccess is the audit trail entry for the current user's action on a secret
+func (app *Application) secretAccess(c *gin.Context, teamID int64, name string, action string) *data.SecretAccess {
+	return &data.SecretAccess{
+		TeamID:        teamID,
+		Name:          name,
+		UserAccountID: app.contextGetUser(c).ID,
+		Action:        action,
+		IP:            c.ClientIP(),
+	}
+}
+
+// logSecretAccess writes to the secret audit trail, a failure to audit fails the request
+func (app *Application) logSecretAccess(c *gin.Context, teamID int64, name string, action string) bool {
+	err := app.Models.Secret.LogAccess(app.secretAccess(c, teamID, name, action))
+	if err != nil {
+		app.badRequest(c, err)
+		return false
+	}
+	return true
+}
+
+// auditRefusedSecretRead records a secret read that did not release the value. The
+// request has already failed, so a failure to audit it is only logged.
+func (app *Application) auditRefusedSecretRead(c *gin.Context, teamID int64, name string, action string) {
+	err := app.Models.Secret.LogAccess(app.secretAccess(c, teamID, name, action))
+	if err != nil {
+		log.Error("unable to audit secret read: ", err)
+	}
+}
+
+func (app *Application) putSecretHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	if app.Vault == nil {
+		app.vaultNotConfiguredResponse(c)
+		return
+	}
+
+	var input struct {
+		Kind  string `json:"kind"`
+		Value string `json:"value"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	secret := &data.Secret{TeamID: id, Name: c.Param("name"), Kind: input.Kind}
+
+	v := validator.New()
+	if data.ValidateSecret(v, secret, input.Value); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	secret.Ciphertext, err = app.Vault.Seal([]byte(input.Value), secretAD(id, secret.Name))
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	// the write and its audit entry are saved together
+	err = app.Models.Secret.Put(secret, app.secretAccess(c, id, secret.Name, data.SecretActionWrite))
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret})
+}
+
+func (app *Application) listSecretsHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	secrets, err := app.Models.Secret.List(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secrets": secrets})
+}
+
+func (app *Application) deleteSecretHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	name := c.Param("name")
+	err = app.Models.Secret.Delete(id, name, app.secretAccess(c, id, name, data.SecretActionDelete))
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": gin.H{"team_id": id, "name": name}})
+}
+
+func (app *Application) getSecretAccessLogHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	log, err := app.Models.Secret.GetAccessLog(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"access_log": log})
+}
+
+// readServerSecretHandeler is the only way to read a secret's value, and is limited to the
+// service account of the server registered for the secret's team. The route is not
+// authorized by the middleware so that denied reads are checked, and audited, here.
+func (app *Application) readServerSecretHandeler(c *gin.Context) {
+	if app.Vault == nil {
+		app.vaultNotConfiguredResponse(c)
+		return
+	}
+
+	name := c.Param("name")
+	caller := app.contextGetUser(c)
+	if caller.IsAnon() || caller.Role != data.RoleService {
+		app.auditRefusedSecretRead(c, 0, name, data.SecretActionReadDenied)
+		app.notPermittedResponse(c)
+		return
+	}
+	obj, act := permission.SplitCode("/server-secrets-read")
+	decision, err := app.Models.Permission.Decide(caller.ID, obj, act, requestEnv(c, caller))
+	if err != nil {
+		app.auditRefusedSecretRead(c, 0, name, data.SecretActionReadFailed)
+		app.badRequest(c, err)
+		return
+	}
+	if !decision.Allow {
+		app.auditRefusedSecretRead(c, 0, name, data.SecretActionReadDenied)
+		app.notPermittedResponse(c)
+		return
+	}
+
+	server, err := app.Models.Server.GetForServiceAccount(caller.ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.auditRefusedSecretRead(c, 0, name, data.SecretActionReadDenied)
+			app.notPermittedResponse(c)
+		default:
+			app.auditRefusedSecretRead(c, 0, name, data.SecretActionReadFailed)
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	secret, err := app.Models.Secret.Get(server.TeamID, name)
+	if err != nil {
+		app.auditRefusedSecretRead(c, server.TeamID, name, data.SecretActionReadFailed)
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	value, err := app.Vault.Open(secret.Ciphertext, secretAD(secret.TeamID, secret.Name))
+	if err != nil {
+		app.auditRefusedSecretRead(c, secret.TeamID, secret.Name, data.SecretActionReadFailed)
+		app.badRequest(c, err)
+		return
+	}
+
+	// the read is audited before the value is released
+	if !app.logSecretAccess(c, secret.TeamID, secret.Name, data.SecretActionRead) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "value": string(value)})
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// serviceCredentialTTL is how long a registered server's credential is valid for
+const serviceCredentialTTL = 365 * 24 * time.Hour
+
+// serviceCredential is handed to a sql-manager server when it registers. The signature lets
+// the server check the credential was issued by auth-manager for its own server_url
+type serviceCredential struct {
+	ServerID  int64     `json:"server_id"`
+	TeamID    int64     `json:"team_id"`
+	Audience  string    `json:"audience"`
+	Expiry    time.Time `json:"expiry"`
+	Token     string    `json:"token"`
+	Signature string    `json:"signature"`
+}
+
+// message is the canonical form of the credential that is signed
+func (sc *serviceCredential) message() []byte {
+	return []byte(fmt.Sprintf("%d|%d|%s|%d|%s", sc.ServerID, sc.TeamID, sc.Audience, sc.Expiry.Unix(), sc.Token))
+}
+
+func (app *Application) registerServerHandeler(c *gin.Context) {
+	var input struct {
+		TeamID    int64  `json:"team_id"`
+		ServerURL string `json:"server_url"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	server := &data.Server{TeamID: input.TeamID, ServerURL: strings.TrimRight(input.ServerURL, "/")}
+
+	v := validator.New()
+	if data.ValidateServer(v, server); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(server.TeamID)) {
+		return
+	}
+
+	err := app.Models.Server.Register(server)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "quota exceeded"):
+			app.quotaExceededResponse(c, err)
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	// registering again rotates the credential
+	err = app.Models.Token.DeleteAllForUser(data.ScopeService, server.ServiceAccountID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	token, err := app.Models.Token.New(server.ServiceAccountID, serviceCredentialTTL, data.ScopeService)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	credential := &serviceCredential{
+		ServerID: server.ID,
+		TeamID:   server.TeamID,
+		Audience: server.ServerURL,
+		Expiry:   token.Expiry,
+		Token:    token.Plaintext,
+	}
+	credential.Signature = app.Signer.Sign(credential.message())
+
+	c.JSON(http.StatusCreated, gin.H{"server": server, "credential": credential})
+}
+
+func (app *Application) getSigningKeyHandeler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"algorithm": "ed25519", "public_key": app.Signer.PublicKey()})
+}
+
+func (app *Application) introspectTokenHandeler(c *gin.Context) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	caller := app.contextGetUser(c)
+	server, err := app.Models.Server.GetForServiceAccount(caller.ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notPermittedResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	// tokens are only accepted by the server they were issued for
+	user, err := app.Models.UserAccount.GetForAudience(data.ScopeLogin, input.Token, server.ServerURL)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no records"):
+			c.JSON(http.StatusOK, gin.H{"active": false})
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+	if user.IsSuspended() {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+
+	// the attributes of the user and its teams are claims of the token
+	claims, err := app.Models.Attribute.Claims(user.ID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"active": true, "audience": server.ServerURL, "user": user, "claims": claims})
+}
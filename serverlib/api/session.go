@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
+	"github.com/gin-gonic/gin"
+)
+
+// recordLogin adds an authentication attempt to the login history. A failure to record it
+// is logged and does not fail the login.
+func (app *Application) recordLogin(c *gin.Context, userID int64, email string, outcome string, token *data.Token) {
+	event := &data.LoginEvent{
+		UserAccountID: userID,
+		Email:         email,
+		Method:        data.LoginPassword,
+		Outcome:       outcome,
+		IP:            c.ClientIP(),
+		UserAgent:     c.Request.UserAgent(),
+	}
+	if err := app.Models.Login.Record(event, token); err != nil {
+		log.Error("unable to record login for ", email, ": ", err)
+	}
+}
+
+func (app *Application) listMySessionsHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+	app.listSessions(c, user.ID, user.Token)
+}
+
+func (app *Application) revokeMySessionHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+	app.revokeSession(c, user.ID)
+}
+
+func (app *Application) listMyLoginsHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+	app.listLogins(c, user.ID)
+}
+
+func (app *Application) listSessionsHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	app.listSessions(c, id, app.contextGetUser(c).Token)
+}
+
+func (app *Application) revokeSessionHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	app.revokeSession(c, id)
+}
+
+func (app *Application) listLoginsHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	app.listLogins(c, id)
+}
+
+// listSessions returns where a user is logged in, marking the session of the request
+func (app *Application) listSessions(c *gin.Context, userID int64, current *data.Token) {
+	var hash []byte
+	if current != nil {
+		hash = current.Hash
+	}
+
+	sessions, err := app.Models.Login.Sessions(userID, hash)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "sessions": sessions})
+}
+
+// revokeSession logs a user out of one of their sessions
+func (app *Application) revokeSession(c *gin.Context, userID int64) {
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil || sessionID < 1 {
+		app.notFoundResponse(c)
+		return
+	}
+
+	err = app.Models.Login.RevokeSession(userID, sessionID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// listLogins returns the recent authentication attempts of a user, most recent first
+func (app *Application) listLogins(c *gin.Context, userID int64) {
+	logins, err := app.Models.Login.History(userID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "logins": logins})
+}
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/gin-gonic/gin"
+)
+
+func (app *Application) transferTeamOwnershipHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	user, err := app.Models.UserAccount.GetByEmail(input.Email)
+	if err != nil {
+		v.AddError("email", "no user with this email exists")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err = app.Models.Team.TransferOwnership(id, user.ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not a member"):
+			v.AddError("email", "the new owner must be a member of the team")
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	team, err := app.Models.Team.Get(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team": team})
+}
+
+func (app *Application) deleteTeamHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		ReassignTo int64 `json:"reassign_to"`
+	}
+
+	// the body is optional, without it the delete is blocked when members would be left without a team
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			app.badRequest(c, err)
+			return
+		}
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	if input.ReassignTo != 0 && !app.requireAdmin(c, permission.TeamSubject(input.ReassignTo)) {
+		return
+	}
+
+	stranded, err := app.Models.Team.Stranded(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	if len(stranded) > 0 && input.ReassignTo == 0 {
+		app.teamHasMembersResponse(c, stranded)
+		return
+	}
+
+	err = app.Models.Team.Delete(id, input.ReassignTo)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "reassignment"):
+			v := validator.New()
+			v.AddError("reassign_to", "team does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		case strings.Contains(err.Error(), "default team of a scim client"):
+			app.teamIsSCIMDefaultResponse(c)
+		case strings.Contains(err.Error(), "conflict"):
+			app.editConflictResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"team":       gin.H{"id": id},
+		"reassigned": stranded,
+		"restorable": app.Config.TeamDeleteGrace.String(),
+	})
+}
+
+func (app *Application) restoreTeamHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	err = app.Models.Team.Restore(id, app.Config.TeamDeleteGrace)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	team, err := app.Models.Team.Get(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team": team})
+}
+
+func (app *Application) addTeamMemberHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+		Admin bool   `json:"admin"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	user, err := app.Models.UserAccount.GetByEmail(input.Email)
+	if err != nil {
+		v.AddError("email", "no user with this email exists")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err = app.Models.Team.AddMember(id, user, input.Admin)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "quota exceeded"):
+			app.quotaExceededResponse(c, err)
+		case strings.Contains(err.Error(), "duplicate"):
+			v.AddError("email", "user is already a member of the team")
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"team": gin.H{"id": id}, "user": user})
+}
+
+func (app *Application) removeTeamMemberHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if !app.requireAdmin(c, permission.TeamSubject(id)) {
+		return
+	}
+
+	user, err := app.Models.UserAccount.GetByEmail(input.Email)
+	if err != nil {
+		v.AddError("email", "no user with this email exists")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err = app.Models.Team.RemoveMember(id, user.ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "conflict"):
+			c.JSON(http.StatusConflict, gin.H{"errors": "user is not a member of the team or has no other team"})
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team": gin.H{"id": id}, "user": user})
+}
+
+func (app *Application) getTeamQuotaHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	if _, err := app.Models.Team.Get(id); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	usage, err := app.Models.Quota.Usage(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"usage": usage})
+}
+
+func (app *Application) setTeamQuotaHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		MaxMembers         *int `json:"max_members"`
+		MaxTokens          *int `json:"max_tokens"`
+		MaxServiceAccounts *int `json:"max_service_accounts"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	quota := &data.Quota{
+		TeamID:             id,
+		MaxMembers:         input.MaxMembers,
+		MaxTokens:          input.MaxTokens,
+		MaxServiceAccounts: input.MaxServiceAccounts,
+	}
+
+	v := validator.New()
+	if data.ValidateQuota(v, quota); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if _, err := app.Models.Team.Get(id); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	err = app.Models.Quota.Set(quota)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quota": quota})
+}
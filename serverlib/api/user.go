@@ -0,0 +1,437 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
+	"github.com/gin-gonic/gin"
+)
+
+// listUsersHandeler returns a page of users. Pages are selected with ?page= or by passing the
+// next_cursor of the previous page as ?cursor=.
+func (app *Application) listUsersHandeler(c *gin.Context) {
+	v := validator.New()
+
+	filter := data.UserFilter{
+		TeamID:        int64(app.readInt(c, "team_id", 0, v)),
+		Role:          c.Query("role"),
+		Activated:     app.readBool(c, "activated", v),
+		CreatedAfter:  app.readTime(c, "created_after", v),
+		CreatedBefore: app.readTime(c, "created_before", v),
+		EmailPrefix:   c.Query("email_prefix"),
+		Search:        c.Query("q"),
+		Sort:          c.DefaultQuery("sort", "id"),
+		Page:          app.readInt(c, "page", 1, v),
+		PageSize:      app.readInt(c, "page_size", 20, v),
+		Cursor:        c.Query("cursor"),
+	}
+
+	if data.ValidateUserFilter(v, &filter); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.Models.UserAccount.List(filter)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "invalid cursor"):
+			v.AddError("cursor", err.Error())
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "metadata": metadata})
+}
+
+// emailChangeTTL is how long the token confirming a new email address is valid
+const emailChangeTTL = 72 * time.Hour
+
+// setETag sets the ETag header to the version of a UserAccount, for use with If-Match
+func setETag(c *gin.Context, user *data.UserAccount) {
+	c.Header("ETag", strconv.Quote(strconv.Itoa(user.Version)))
+}
+
+// readIfMatch returns the version in the If-Match header, or -1 when there is none
+func readIfMatch(c *gin.Context) (int, error) {
+	h := c.GetHeader("If-Match")
+	if h == "" {
+		return -1, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(h, "W/"), `"`))
+	if err != nil {
+		return 0, errors.New("invalid If-Match header")
+	}
+	return version, nil
+}
+
+func (app *Application) getMeHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+
+	user, err := app.Models.UserAccount.Get(user.ID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	setETag(c, user)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+func (app *Application) updateMeHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+
+	// users can not change their own role
+	app.updateUser(c, user.ID, false)
+}
+
+func (app *Application) updateUserHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	app.updateUser(c, id, true)
+}
+
+// updateUser applies a partial update to the name, email and, when allowRole is set, the
+// role of a UserAccount. A new email is only used once it has been confirmed.
+func (app *Application) updateUser(c *gin.Context, id int64, allowRole bool) {
+	user, err := app.Models.UserAccount.Get(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name    *string `json:"name"`
+		Email   *string `json:"email"`
+		Role    *string `json:"role"`
+		Version *int    `json:"version"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	version, err := readIfMatch(c)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+	if input.Version != nil {
+		version = *input.Version
+	}
+	if version >= 0 && version != user.Version {
+		app.editConflictResponse(c)
+		return
+	}
+
+	v := validator.New()
+	if input.Name != nil {
+		user.Name = *input.Name
+		data.ValidateName(v, user.Name)
+	}
+
+	changeEmail := input.Email != nil && !strings.EqualFold(*input.Email, user.Email)
+	if changeEmail {
+		data.ValidateEmail(v, *input.Email)
+		if _, err := app.Models.UserAccount.GetByEmail(*input.Email); err == nil {
+			v.AddError("email", "a user with this email already exists")
+		}
+		user.PendingEmail = *input.Email
+	}
+
+	if input.Role != nil {
+		switch {
+		case !allowRole:
+			v.AddError("role", "can only be changed by an admin")
+		default:
+			data.ValidateRoleName(v, *input.Role)
+			if _, err := app.Models.Role.Get(*input.Role); err != nil {
+				v.AddError("role", "no role with this name exists")
+			}
+			user.Role = *input.Role
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	// the new address has to be confirmed before it replaces the current one, the pending
+	// email is saved with its confirmation token and dropped again if it can not be sent
+	var token *data.Token
+	if changeEmail {
+		token, err = app.Models.UserAccount.UpdateWithEmailChange(user, emailChangeTTL)
+	} else {
+		err = app.Models.UserAccount.Update(user)
+	}
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "conflict"):
+			app.editConflictResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	if changeEmail {
+		body := "Confirm your new email address with the token " + token.Plaintext
+		if err := app.Notifier.Notify(user.PendingEmail, "Confirm your email address", body); err != nil {
+			if cerr := app.Models.UserAccount.CancelEmailChange(user.ID); cerr != nil {
+				log.Error("unable to cancel email change: ", cerr)
+			}
+			app.badRequest(c, err)
+			return
+		}
+	}
+
+	setETag(c, user)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// confirmEmailHandeler replaces the email of the current user with the pending email, given
+// the token sent to the pending address
+func (app *Application) confirmEmailHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err := app.Models.UserAccount.ConfirmEmail(user.ID, input.Token)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no records"):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(c, v.Errors)
+		case strings.Contains(err.Error(), "duplicate"):
+			v.AddError("email", "a user with this email already exists")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	user, err = app.Models.UserAccount.Get(user.ID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	setETag(c, user)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// changePasswordHandeler changes the password of the current user, given their current
+// password, and revokes every other session and token they hold
+func (app *Application) changePasswordHandeler(c *gin.Context) {
+	current := app.contextGetUser(c)
+	if current.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlaintext(v, input.NewPassword)
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	user, err := app.Models.UserAccount.Get(current.ID)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if err = user.Password.Set(input.NewPassword); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	err = app.Models.UserAccount.Update(user)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "conflict"):
+			app.editConflictResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	// the session making the change stays signed in
+	var keep []byte
+	if current.Token != nil {
+		keep = current.Token.Hash
+	}
+	if err = app.Models.Token.DeleteAllForUserExcept(user.ID, keep); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	body := "The password of your account was changed from " + c.ClientIP() + " at " + time.Now().UTC().Format(time.RFC1123) +
+		". Every other session has been signed out. If this was not you, contact your administrator."
+	if err = app.Notifier.Notify(user.Email, "Your password was changed", body); err != nil {
+		log.Error("unable to send password change notification: ", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password successfully changed"})
+}
+
+// suspendUserHandeler suspends a UserAccount, keeping its team memberships and history
+func (app *Application) suspendUserHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	var input struct {
+		Reason       string     `json:"reason"`
+		ReactivateAt *time.Time `json:"reactivate_at"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	actor := app.contextGetUser(c)
+
+	v := validator.New()
+	data.ValidateSuspension(v, input.Reason, input.ReactivateAt)
+	v.Check(actor.ID != id, "id", "you can not suspend your own account")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	err = app.Models.UserAccount.Suspend(id, actor.ID, input.Reason, input.ReactivateAt)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	user, err := app.Models.UserAccount.Get(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// reactivateUserHandeler lifts the suspension of a UserAccount
+func (app *Application) reactivateUserHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	err = app.Models.UserAccount.Reactivate(id, app.contextGetUser(c).ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	user, err := app.Models.UserAccount.Get(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+func (app *Application) getSuspensionHistoryHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	events, err := app.Models.UserAccount.GetSuspensionHistory(id)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"suspensions": events})
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportMeHandeler returns everything stored about the current user as a download
+func (app *Application) exportMeHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+
+	export, err := app.Models.UserAccount.Export(user.ID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+	if export.Erasure != nil {
+		export.Erasure.EraseAfter = export.Erasure.RequestedAt.Add(app.Config.ErasureGrace)
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.json"`, user.ID))
+	c.JSON(http.StatusOK, export)
+}
+
+func (app *Application) requestErasureMeHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+	app.requestErasure(c, user.ID)
+}
+
+func (app *Application) cancelErasureMeHandeler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	if user.IsAnon() {
+		app.invalidAuthenticationTokenResponse(c)
+		return
+	}
+	app.cancelErasure(c, user.ID)
+}
+
+func (app *Application) requestErasureHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	app.requestErasure(c, id)
+}
+
+func (app *Application) cancelErasureHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	app.cancelErasure(c, id)
+}
+
+// requestErasure schedules a user to be erased, it can be cancelled until the erasure
+// grace period has passed
+func (app *Application) requestErasure(c *gin.Context, id int64) {
+	erasure, err := app.Models.UserAccount.RequestErasure(id, app.Config.ErasureGrace)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"erasure": erasure})
+}
+
+func (app *Application) cancelErasure(c *gin.Context, id int64) {
+	err := app.Models.UserAccount.CancelErasure(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "erasure cancelled"})
+}
@@ -0,0 +1,502 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
+	"github.com/gin-gonic/gin"
+)
+
+// inviteTTL is how long an invited user has to choose a password
+const inviteTTL = 7 * 24 * time.Hour
+
+// maxImportRows is the most users a single import can add
+const maxImportRows = 1000
+
+// importJobRetention is how long the results of an import run in the background are kept
+const importJobRetention = 7 * 24 * time.Hour
+
+// importRow is one user of a bulk import. Invited users choose their own password.
+type importRow struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Team     string `json:"team"`
+	Role     string `json:"role"`
+	Password string `json:"password"`
+	Invite   bool   `json:"invite"`
+}
+
+// readImportRows reads the users of an import from a csv body with a header row, or from a
+// json body of the form {"users": [...]}
+func readImportRows(c *gin.Context) ([]*importRow, error) {
+	if !strings.Contains(c.ContentType(), "csv") {
+		var input struct {
+			Users []*importRow `json:"users"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			return nil, err
+		}
+		return input.Users, nil
+	}
+
+	r := csv.NewReader(c.Request.Body)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read csv header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"email", "team"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("csv header is missing the %s column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	rows := []*importRow{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := &importRow{
+			Email:    field(record, "email"),
+			Name:     field(record, "name"),
+			Team:     field(record, "team"),
+			Role:     field(record, "role"),
+			Password: field(record, "password"),
+		}
+		if s := field(record, "invite"); s != "" {
+			row.Invite, err = strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invite must be true or false", len(rows)+1)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// hashPasswords sets the password of each user, concurrently as each bcrypt hash is slow.
+// Users without a password get one that can not be used to log in.
+func hashPasswords(users []*data.UserAccount, passwords []string) error {
+	jobs := make(chan int)
+	errs := make(chan error, len(users))
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var err error
+				if passwords[i] == "" {
+					err = users[i].Password.SetUnusable()
+				} else {
+					err = users[i].Password.Set(passwords[i])
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// userImport is an import whose rows have been validated, results holds the outcome of every
+// row and users those still to be written, at positions of rows
+type userImport struct {
+	rows      []*importRow
+	results   []*data.ImportResult
+	users     []*data.UserAccount
+	passwords []string
+	positions []int
+	atomic    bool
+	dryRun    bool
+	checkOnly bool
+	inviter   string
+}
+
+// importUsersHandeler adds users in bulk from a csv or json body. ?mode=transactional, the
+// default, writes nothing unless every row succeeds, ?mode=best-effort keeps the rows that
+// do. ?dry_run=true validates every row without writing and ?invite=true invites every user
+// instead of setting their password.
+//
+// Each password takes a slow bcrypt hash, close to a second per core, so an import that sets
+// passwords runs in the background. It is answered with 202 and a job whose results are read
+// from GET /users/import/:id, every other import is answered with its results.
+func (app *Application) importUsersHandeler(c *gin.Context) {
+	v := validator.New()
+	mode := c.DefaultQuery("mode", "transactional")
+	v.Check(mode == "transactional" || mode == "best-effort", "mode", "must be one of transactional or best-effort")
+	dryRun := app.readBool(c, "dry_run", v)
+	inviteAll := app.readBool(c, "invite", v)
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	rows, err := readImportRows(c)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v.Check(len(rows) > 0, "users", "must contain at least one user")
+	v.Check(len(rows) <= maxImportRows, "users", fmt.Sprintf("must not contain more than %d users", maxImportRows))
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	roles, err := app.Models.Role.List()
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+	known := map[string]bool{}
+	for _, role := range roles {
+		known[role.Name] = true
+	}
+
+	results := make([]*data.ImportResult, len(rows))
+	var users []*data.UserAccount
+	var passwords []string
+	var positions []int
+	seen := map[string]int{}
+	for i, row := range rows {
+		if inviteAll != nil && *inviteAll {
+			row.Invite = true
+		}
+		if row.Role == "" {
+			row.Role = "user"
+		}
+
+		rv := validator.New()
+		data.ValidateEmail(rv, row.Email)
+		data.ValidateName(rv, row.Name)
+		rv.Check(row.Team != "", "team", "must be provided")
+		rv.Check(known[row.Role], "role", "must be an existing role")
+		if row.Invite {
+			rv.Check(row.Password == "", "password", "must not be provided for an invited user")
+		} else {
+			data.ValidatePasswordPlaintext(rv, row.Password)
+		}
+		if first, ok := seen[strings.ToLower(row.Email)]; ok {
+			rv.AddError("email", fmt.Sprintf("is a duplicate of row %d", first))
+		} else {
+			seen[strings.ToLower(row.Email)] = i + 1
+		}
+
+		results[i] = &data.ImportResult{Row: i + 1, Email: row.Email, Invite: row.Invite}
+		if !rv.Valid() {
+			results[i].Status = data.ImportFailed
+			results[i].Errors = rv.Errors
+			continue
+		}
+
+		users = append(users, &data.UserAccount{
+			Name:      row.Name,
+			Email:     row.Email,
+			Role:      row.Role,
+			Activated: !row.Invite,
+			Team:      &data.Team{Name: row.Team},
+		})
+		passwords = append(passwords, row.Password)
+		positions = append(positions, i)
+	}
+
+	imp := &userImport{
+		rows:      rows,
+		results:   results,
+		users:     users,
+		passwords: passwords,
+		positions: positions,
+		atomic:    mode == "transactional",
+		dryRun:    dryRun != nil && *dryRun,
+		inviter:   app.contextGetUser(c).Email,
+	}
+	// nothing will be written, so the cheap unusable hash is enough to check the rows
+	imp.checkOnly = imp.dryRun || (imp.atomic && len(rows) > len(users))
+	if imp.checkOnly {
+		imp.passwords = make([]string, len(users))
+	}
+
+	withPassword := false
+	for _, password := range imp.passwords {
+		if password != "" {
+			withPassword = true
+			break
+		}
+	}
+	if withPassword {
+		job := &data.ImportJob{CreatedBy: app.contextGetUser(c).ID, Mode: mode}
+		if err = app.Models.UserAccount.AddImportJob(job); err != nil {
+			app.badRequest(c, err)
+			return
+		}
+		// the job is answered before it runs, it is then only changed by the import
+		c.JSON(http.StatusAccepted, gin.H{"job": job})
+		go app.runImportJob(job, imp)
+		return
+	}
+
+	created, failed, err := app.runImport(imp)
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	switch {
+	case created > 0:
+		status = http.StatusCreated
+	case imp.atomic && failed > 0:
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, gin.H{
+		"results": imp.results,
+		"created": created,
+		"failed":  failed,
+		"mode":    mode,
+		"dry_run": imp.dryRun,
+	})
+}
+
+// runImport hashes the passwords of an import, writes its users and invites those that were
+// created, completing its results
+func (app *Application) runImport(imp *userImport) (int, int, error) {
+	if err := hashPasswords(imp.users, imp.passwords); err != nil {
+		return 0, 0, err
+	}
+
+	imported, err := app.Models.UserAccount.Import(imp.users, imp.atomic, imp.checkOnly)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	created := 0
+	for j, result := range imported {
+		i := imp.positions[j]
+		result.Row = i + 1
+		result.Invite = imp.rows[i].Invite
+		imp.results[i] = result
+		if result.Status == data.ImportCreated {
+			created++
+		}
+	}
+
+	failed := 0
+	for _, result := range imp.results {
+		if result.Status == data.ImportFailed {
+			failed++
+		}
+	}
+	if !imp.dryRun {
+		for _, result := range imp.results {
+			// the valid rows of a failed transactional import were rolled back
+			if result.Status == data.ImportValid {
+				result.Status = data.ImportSkipped
+			}
+		}
+	}
+
+	for j, user := range imp.users {
+		result := imp.results[imp.positions[j]]
+		if result.Status == data.ImportCreated && result.Invite {
+			app.sendInvite(imp.inviter, user)
+		}
+	}
+	return created, failed, nil
+}
+
+// runImportJob runs an import in the background and records its outcome in its job
+func (app *Application) runImportJob(job *data.ImportJob, imp *userImport) {
+	var err error
+	job.Created, job.Failed, err = app.runImport(imp)
+	job.Status = data.ImportJobFinished
+	job.Results = imp.results
+	if err != nil {
+		job.Status = data.ImportJobFailed
+		job.Error = err.Error()
+	}
+	if err = app.Models.UserAccount.FinishImportJob(job); err != nil {
+		log.Error("unable to record the outcome of import job ", job.ID, ": ", err)
+	}
+}
+
+// getImportJobHandeler returns an import run in the background, with its results once it
+// has finished
+func (app *Application) getImportJobHandeler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+
+	job, err := app.Models.UserAccount.GetImportJob(id)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no record"):
+			app.notFoundResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// sendInvite issues an invite token to a new user and sends it to their email on behalf of
+// inviter. A failure is logged, the user can be invited again by an admin.
+func (app *Application) sendInvite(inviter string, user *data.UserAccount) {
+	token, err := app.Models.Token.New(user.ID, inviteTTL, data.ScopeInvite)
+	if err != nil {
+		log.Error("unable to create invite token: ", err)
+		return
+	}
+
+	body := "You have been invited to sql-manager by " + inviter +
+		". Choose your password within " + inviteTTL.String() + " using the invitation token " + token.Plaintext
+	if err = app.Notifier.Notify(user.Email, "You have been invited to sql-manager", body); err != nil {
+		log.Error("unable to send invite: ", err)
+	}
+}
+
+// acceptInviteHandeler sets the password of an invited user and activates their account
+func (app *Application) acceptInviteHandeler(c *gin.Context) {
+	var input struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.Token)
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	user, err := app.Models.UserAccount.GetForToken(data.ScopeInvite, input.Token)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "no records"):
+			v.AddError("token", "invalid or expired invitation token")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(c)
+		return
+	}
+
+	if err = user.Password.Set(input.Password); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+	user.Activated = true
+
+	err = app.Models.UserAccount.Update(user)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "conflict"):
+			app.editConflictResponse(c)
+		default:
+			app.badRequest(c, err)
+		}
+		return
+	}
+
+	if err = app.Models.Token.DeleteAllForUser(data.ScopeInvite, user.ID); err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// exportUsersHandeler writes every team membership as json, or as csv with ?format=csv.
+// ?team_id limits the export to one team. The csv has no password or invite column, it can
+// be imported again with ?invite=true.
+func (app *Application) exportUsersHandeler(c *gin.Context) {
+	v := validator.New()
+	teamID := app.readInt(c, "team_id", 0, v)
+	format := c.DefaultQuery("format", "json")
+	v.Check(format == "json" || format == "csv", "format", "must be one of json or csv")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	records, err := app.Models.UserAccount.Records(int64(teamID))
+	if err != nil {
+		app.badRequest(c, err)
+		return
+	}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{"users": records})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="users.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "email", "name", "team", "role", "activated", "created_at"})
+	for _, r := range records {
+		w.Write([]string{
+			strconv.FormatInt(r.ID, 10),
+			r.Email,
+			r.Name,
+			r.Team,
+			r.Role,
+			strconv.FormatBool(r.Activated),
+			r.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		log.Error("unable to write users csv: ", err)
+	}
+}
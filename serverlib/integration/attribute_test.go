@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestAttributes(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "kings"}}
+	member.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	memberToken, err := app.Models.Token.New(member.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	// only admins define attributes
+	def := []byte(`{"type": "enum", "values": ["eng", "ops"], "required": true}`)
+	_, code := DoRequest(app, def, "/v1/attributes/user/dept", memberToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	_, code = DoRequest(app, def, "/v1/attributes/user/dept", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(`{"type": "number"}`), "/v1/attributes/user/level", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(`{"type": "string"}`), "/v1/attributes/team/region", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(`{"type": "date"}`), "/v1/attributes/team/founded", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	out, code := DoRequest(app, nil, "/v1/attributes/user", memberToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "attributes.#").Int(), int64(2))
+	assert.Equal(t, gjson.Get(out.String(), "attributes.0.name").Str, "dept")
+
+	// values are checked against their definitions
+	userURL := "/v1/users/" + strconv.FormatInt(member.ID, 10) + "/attributes"
+	out, code = DoRequest(app, []byte(`{"attributes": {"dept": "sales", "level": "3", "shoe": 9}}`), userURL, adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Equal(t, gjson.Get(out.String(), "errors.attributes\\.dept").Str, "must be one of eng, ops")
+	assert.Equal(t, gjson.Get(out.String(), "errors.attributes\\.level").Str, "must be a number")
+	assert.Equal(t, gjson.Get(out.String(), "errors.attributes\\.shoe").Str, "is not a defined attribute")
+	_, code = DoRequest(app, []byte(`{"attributes": {"level": 3}}`), userURL, adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	_, code = DoRequest(app, []byte(`{"attributes": {"dept": "eng", "level": 3}}`), userURL, adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+	teamURL := "/v1/teams/" + strconv.FormatInt(member.Team.ID, 10) + "/attributes"
+	_, code = DoRequest(app, []byte(`{"attributes": {"region": "eu"}}`), teamURL, memberToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	_, code = DoRequest(app, []byte(`{"attributes": {"region": "eu"}}`), teamURL, adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+
+	// the attributes are part of the user and the team
+	out, code = DoRequest(app, nil, "/v1/users/me", memberToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.attributes.dept").Str, "eng")
+	assert.Equal(t, gjson.Get(out.String(), "user.attributes.level").Int(), int64(3))
+	out, _ = DoRequest(app, nil, teamURL, memberToken.Plaintext, http.MethodGet)
+	assert.Equal(t, gjson.Get(out.String(), "attributes.region").Str, "eu")
+
+	// and claims of the tokens issued to the user
+	out, code = DoRequest(app, []byte(`{"email": "a@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, gjson.Get(out.String(), "claims.user.dept").Str, "eng")
+	assert.Equal(t, gjson.Get(out.String(), "claims.teams.kings.region").Str, "eu")
+
+	// policy conditions can use user and team attributes
+	err = app.Models.Role.Grant("user", "/reports", "read", "user.dept=eng|ops;team.region=eu")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Grant("user", "/reports", "write", "user.level=5")
+	assert.Equal(t, err, nil)
+
+	decision, err := app.Models.Permission.Decide(member.ID, "/reports", "read", &permission.Env{Time: time.Now()})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, true)
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "write", &permission.Env{Time: time.Now()})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+	decision, err = app.Models.Permission.Decide(admin.ID, "/reports", "read", &permission.Env{Time: time.Now()})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	// attributes are only read for policies with attribute conditions
+	failing := func() (map[string][]string, error) { return nil, errors.New("attributes unavailable") }
+	decision, err = app.Models.Permission.Decide(member.ID, "/users", "read", &permission.Env{Time: time.Now(), LoadAttributes: failing})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, true)
+	_, err = app.Models.Permission.Decide(member.ID, "/reports", "read", &permission.Env{Time: time.Now(), LoadAttributes: failing})
+	assert.NotEqual(t, err, nil)
+
+	// a definition can not be changed from under the values already held
+	out, code = DoRequest(app, []byte(`{"type": "enum", "values": ["ops"]}`), "/v1/attributes/user/dept", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Equal(t, strings.Contains(gjson.Get(out.String(), "errors.name").Str, "stored values of user.dept do not match the new definition, 1 to update"), true)
+	_, code = DoRequest(app, []byte(`{"type": "string"}`), "/v1/attributes/user/level", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	_, code = DoRequest(app, []byte(`{"type": "enum", "values": ["eng", "ops", "sales"], "required": true}`), "/v1/attributes/user/dept", adminToken.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+	out, _ = DoRequest(app, nil, "/v1/attributes/user", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, gjson.Get(out.String(), "attributes.0.values.#").Int(), int64(3))
+
+	// deleting a definition removes its values
+	_, code = DoRequest(app, nil, "/v1/attributes/team/region", adminToken.Plaintext, http.MethodDelete)
+	assert.Equal(t, code, http.StatusOK)
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "read", &permission.Env{Time: time.Now()})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	app.Migrations.DoMigrations("down")
+}
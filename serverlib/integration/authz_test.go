@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestAuthzCheck(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	token, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	in := []byte(fmt.Sprintf(`{"user_id": %d, "object": "/users", "action": "read"}`, user.ID))
+	out, code := DoRequest(app, in, "/v1/authz/check", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "decision.allow").Bool(), true)
+	assert.Equal(t, gjson.Get(out.String(), "decision.rule").String(), `["user","/users","read"]`)
+
+	in = []byte(fmt.Sprintf(`{"token": "%s", "object": "/users", "action": "write"}`, token.Plaintext))
+	out, code = DoRequest(app, in, "/v1/authz/check", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "decision.allow").Bool(), false)
+
+	in = []byte(`{"object": "/users", "action": "write"}`)
+	_, code = DoRequest(app, in, "/v1/authz/check", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	in = []byte(fmt.Sprintf(`{"checks": [
+		{"user_id": %d, "object": "/users", "action": "read"},
+		{"user_id": %d, "object": "/quotas", "action": "write"},
+		{"user_id": 9999, "object": "/users", "action": "read"}
+	]}`, user.ID, user.ID))
+	out, code = DoRequest(app, in, "/v1/authz/check/batch", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "decisions.#.allow").String(), `[true,false,false]`)
+	assert.NotEqual(t, gjson.Get(out.String(), "decisions.2.error").String(), "")
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestPolicyConditions(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	member.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	outsider := &data.UserAccount{Email: "b@c", Role: "user", Team: &data.Team{Name: "kings"}}
+	outsider.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(outsider)
+	assert.Equal(t, err, nil)
+
+	err = app.Models.Role.Grant("user", "/reports", "read", "time=09:00-17:00;ip=10.0.0.0/8")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Grant("user", "/reports", "write", "mfa;scope=login")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Grant("user", "/reports", "read", "weekday=mon")
+	assert.NotEqual(t, err, nil)
+	err = app.Models.Role.Grant("user", "/reports", "read", "mfa=true")
+	assert.NotEqual(t, err, nil)
+	// an empty window would deny every request
+	err = app.Models.Role.Grant("user", "/reports", "read", "time=09:00-09:00")
+	assert.NotEqual(t, err, nil)
+
+	office := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	night := time.Date(2021, 6, 1, 22, 0, 0, 0, time.UTC)
+
+	decision, err := app.Models.Permission.Decide(member.ID, "/reports", "read", &permission.Env{Time: office, IP: "10.1.2.3"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, true)
+	assert.Equal(t, decision.Rule, []string{"user", "/reports", "read", "time=09:00-17:00;ip=10.0.0.0/8"})
+
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "read", &permission.Env{Time: night, IP: "10.1.2.3"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "read", &permission.Env{Time: office, IP: "192.168.1.1"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "write", &permission.Env{Scope: data.ScopeService})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "write", &permission.Env{Scope: data.ScopeLogin})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	decision, err = app.Models.Permission.Decide(member.ID, "/reports", "write", &permission.Env{Scope: data.ScopeLogin, MFA: true})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, true)
+
+	// the mfa flag of a token subject is read from the token
+	token, err := app.Models.Token.New(member.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	in := []byte(fmt.Sprintf(`{"token": "%s", "object": "/reports", "action": "write"}`, token.Plaintext))
+	out, code := DoRequest(app, in, "/v1/authz/check", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "decision.allow").Bool(), false)
+	_, err = app.Migrations.DB.Exec(`update token set mfa = true where user_account_id = $1`, member.ID)
+	assert.Equal(t, err, nil)
+	out, _ = DoRequest(app, in, "/v1/authz/check", "", http.MethodPost)
+	assert.Equal(t, gjson.Get(out.String(), "decision.allow").Bool(), true)
+
+	// team=owner only allows members of the team owning the resource
+	repo := &data.Resource{Kind: data.ResourceRepo, Name: "analytics", TeamID: member.Team.ID}
+	err = app.Models.Resource.Add(repo)
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Grant("user", "sqlm/repo/*", permission.Write, "team=owner")
+	assert.Equal(t, err, nil)
+
+	decision, err = app.Models.Permission.Decide(member.ID, repo.Path, permission.Write, &permission.Env{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, true)
+
+	decision, err = app.Models.Permission.Decide(outsider.ID, repo.Path, permission.Write, &permission.Env{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Allow, false)
+
+	app.Migrations.DoMigrations("down")
+}
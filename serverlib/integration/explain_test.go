@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainAndDryRun(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	explanation, err := app.Models.Permission.Explain(user.ID, "/users-read", &permission.Env{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, explanation.Role, "user")
+	assert.Equal(t, explanation.Allow, true)
+	assert.Equal(t, explanation.Matched, []string{"user", "/users", "read", ""})
+	assert.Contains(t, explanation.Chain, []string{permission.UserSubject(user.ID), "user"})
+
+	explanation, err = app.Models.Permission.Explain(user.ID, "/reports-read", &permission.Env{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, explanation.Allow, false)
+	assert.Equal(t, len(explanation.Matched), 0)
+
+	// proposed changes are evaluated against a copy of the policy
+	changes := []permission.Change{
+		{Op: "add", PType: "p", Rule: []string{"user", "/reports", "read", ""}},
+		{Op: "remove", PType: "p", Rule: []string{"user", "/users", "read", ""}},
+	}
+	results, err := app.Models.Permission.DryRun([]int64{user.ID}, []string{"/reports-read", "/users-read"}, changes, &permission.Env{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(results), 2)
+	assert.Equal(t, *results[0], data.DryRunResult{UserID: user.ID, Code: "/reports-read", Before: false, After: true, Changed: true})
+	assert.Equal(t, *results[1], data.DryRunResult{UserID: user.ID, Code: "/users-read", Before: true, After: false, Changed: true})
+
+	ok, err := app.Models.Permission.Can(user.ID, "/reports", "read")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	_, err = app.Models.Permission.DryRun([]int64{user.ID}, []string{"/reports-read"}, []permission.Change{{Op: "replace", PType: "p"}}, &permission.Env{})
+	assert.NotEqual(t, err, nil)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -9,10 +9,13 @@ import (
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/migrations"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/mocks"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/signer"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/vault"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"time"
 )
 
 
@@ -63,6 +66,9 @@ func setup(mockAuth bool) *api.Application {
 	cfg.DB.ConnStr = dbConnStr
 	cfg.DB.MaxIdelTime = 5
 	cfg.DB.MaxOpenConns = 3
+	cfg.TeamDeleteGrace = time.Hour
+	cfg.ErasureGrace = time.Hour
+	cfg.LoginRetention = time.Hour
 
 	db, err := db.New(cfg)
 
@@ -80,11 +86,24 @@ func setup(mockAuth bool) *api.Application {
 		middleware = api.NewMiddleware("/", db)
 	}
 
+	s, err := signer.New("")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	vt, err := vault.New("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	app := api.Application{
 		Config:     &cfg,
 		Models:     data.NewModels(db),
 		Middleware: middleware,
 		Migrations: migrations.Migrations{DB: db},
+		Signer:     s,
+		Vault:      vt,
+		Notifier:   &testNotifier{},
 	}
 	app.Migrations.DoMigrations("up")
 	app.Migrations.DoMigrations("down")
@@ -92,3 +111,33 @@ func setup(mockAuth bool) *api.Application {
 
 	return &app
 }
+
+// testNotifier records the notifications sent by the app, or fails them with fail
+type testNotifier struct {
+	sent []notification
+	fail error
+}
+
+type notification struct {
+	to      string
+	subject string
+	body    string
+}
+
+func (n *testNotifier) Notify(to string, subject string, body string) error {
+	if n.fail != nil {
+		return n.fail
+	}
+	n.sent = append(n.sent, notification{to: to, subject: subject, body: body})
+	return nil
+}
+
+// last returns the last notification sent to an address
+func (n *testNotifier) last(to string) (notification, bool) {
+	for i := len(n.sent) - 1; i >= 0; i-- {
+		if n.sent[i].to == to {
+			return n.sent[i], true
+		}
+	}
+	return notification{}, false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestImpersonation(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "kings"}}
+	member.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	memberToken, err := app.Models.Token.New(member.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	memberURL := "/v1/users/" + strconv.FormatInt(member.ID, 10)
+	adminURL := "/v1/users/" + strconv.FormatInt(admin.ID, 10)
+
+	// only admins can impersonate, and only with a reason
+	input := []byte(`{"reason": "ticket 42", "ttl_minutes": 10}`)
+	_, code := DoRequest(app, input, adminURL+"/impersonate", memberToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	_, code = DoRequest(app, []byte(`{}`), memberURL+"/impersonate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	_, code = DoRequest(app, []byte(`{"reason": "ticket 42", "ttl_minutes": 120}`), memberURL+"/impersonate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	_, code = DoRequest(app, input, adminURL+"/impersonate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	// nor can a user assigned the admin role
+	ops := &data.UserAccount{Email: "ops@b", Role: "user", Team: &data.Team{Name: "kings"}}
+	ops.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(ops)
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Assign(ops.ID, "admin")
+	assert.Equal(t, err, nil)
+	_, code = DoRequest(app, input, "/v1/users/"+strconv.FormatInt(ops.ID, 10)+"/impersonate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	out, code := DoRequest(app, input, memberURL+"/impersonate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, gjson.Get(out.String(), "impersonation_token.scope").Str, data.ScopeImpersonation)
+	assert.Equal(t, gjson.Get(out.String(), "impersonation_token.actor_id").Int(), admin.ID)
+	token := gjson.Get(out.String(), "impersonation_token.plain_text").Str
+	assert.Equal(t, strings.HasPrefix(token, "smx_"), true)
+
+	// the token acts as the member
+	out, code = DoRequest(app, nil, "/v1/users/me", token, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.email").Str, "a@b")
+
+	// but can not change their profile, credentials or erase the account
+	_, code = DoRequest(app, []byte(`{"name": "Mallory"}`), "/v1/users/me", token, http.MethodPatch)
+	assert.Equal(t, code, http.StatusForbidden)
+	pwd := []byte(`{"current_password": "abc123456", "new_password": "xyz123456"}`)
+	_, code = DoRequest(app, pwd, "/v1/users/me/password", token, http.MethodPut)
+	assert.Equal(t, code, http.StatusForbidden)
+	_, code = DoRequest(app, nil, "/v1/users/me/erasure", token, http.MethodPost)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	// every request is logged with both identities
+	out, code = DoRequest(app, nil, memberURL+"/impersonations", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "impersonations.#").Int(), int64(5))
+	assert.Equal(t, gjson.Get(out.String(), "impersonations.0.path").Str, "/v1/users/me/erasure")
+	assert.Equal(t, gjson.Get(out.String(), "impersonations.0.status").Int(), int64(http.StatusForbidden))
+	assert.Equal(t, gjson.Get(out.String(), "impersonations.0.actor_id").Int(), admin.ID)
+	assert.Equal(t, gjson.Get(out.String(), "impersonations.4.reason").Str, "ticket 42")
+	out, _ = DoRequest(app, nil, adminURL+"/impersonations", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, gjson.Get(out.String(), "impersonations.#").Int(), int64(5))
+
+	// the impersonation is part of the impersonated user's export
+	export, err := app.Models.UserAccount.Export(member.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(export.Impersonations), 5)
+	assert.Equal(t, export.Profile.Email, "a@b")
+
+	// the token only works while its actor may still impersonate
+	setRole := func(role string) {
+		actor, err := app.Models.UserAccount.GetByEmail("admin@b")
+		assert.Equal(t, err, nil)
+		actor.Role = role
+		assert.Equal(t, app.Models.UserAccount.Update(actor), nil)
+	}
+	setRole("user")
+	_, code = DoRequest(app, nil, "/v1/users/me", token, http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	setRole("admin")
+	_, code = DoRequest(app, nil, "/v1/users/me", token, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	err = app.Models.UserAccount.Suspend(admin.ID, member.ID, "left", nil)
+	assert.Equal(t, err, nil)
+	_, code = DoRequest(app, nil, "/v1/users/me", token, http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	// the audit trail outlives the impersonated user
+	member, err = app.Models.UserAccount.GetByEmail("a@b")
+	assert.Equal(t, err, nil)
+	err = app.Models.UserAccount.Delete(member)
+	assert.Equal(t, err, nil)
+	history, err := app.Models.Impersonation.History(admin.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(history), 6)
+	assert.Equal(t, history[0].UserAccountID, int64(0))
+	assert.Equal(t, history[0].ActorID, admin.ID)
+
+	app.Migrations.DoMigrations("down")
+}
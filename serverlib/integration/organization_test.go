@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestOrganizationTree(t *testing.T) {
+
+	type model struct {
+		org   *data.Organization
+		team  string
+		users []string
+	}
+	testcases := []struct {
+		code  int
+		model model
+	}{
+		{
+			model: model{
+				org:   &data.Organization{Name: "bu-one"},
+				team:  "aces",
+				users: []string{"a@b", "b@c"},
+			},
+			code: http.StatusOK,
+		},
+	}
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	root := &data.UserAccount{Email: "root@b", Role: "admin", Team: &data.Team{Name: "root"}}
+	root.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(root)
+	assert.Equal(t, err, nil)
+	rootToken, err := app.Models.Token.New(root.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	for _, tcase := range testcases {
+
+		err := app.Models.Organization.Add(tcase.model.org)
+		assert.Equal(t, err, nil)
+
+		var teamID, userID int64
+		for _, u := range tcase.model.users {
+			userAdd := &data.UserAccount{
+				Email: u,
+				Role:  "user",
+				Team:  &data.Team{Name: tcase.model.team},
+			}
+			userAdd.Password.Set("abc123456")
+			err := app.Models.UserAccount.Add(userAdd)
+			assert.Equal(t, err, nil)
+			teamID, userID = userAdd.Team.ID, userAdd.ID
+		}
+
+		out, code := DoRequest(app, []byte(``), "/v1/orgs/tree", rootToken.Plaintext, http.MethodGet)
+		assert.Equal(t, tcase.code, code)
+		assert.Equal(t, gjson.Get(out.String(), "tree.unassigned.#").Int(), int64(2))
+
+		err = app.Models.Organization.MoveTeam(teamID, tcase.model.org.ID)
+		assert.Equal(t, err, nil)
+
+		out, code = DoRequest(app, []byte(``), "/v1/orgs/tree", rootToken.Plaintext, http.MethodGet)
+		t.Log(out.String())
+		assert.Equal(t, tcase.code, code)
+		assert.Equal(t, gjson.Get(out.String(), "tree.organizations.0.teams.0.user_accounts.#").Int(), int64(len(tcase.model.users)))
+
+		// other users only see the organizations they belong to
+		tree, err := app.Models.Organization.Tree(userID, false)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(tree.Organizations), 1)
+		assert.Equal(t, len(tree.Unassigned), 0)
+		tree, err = app.Models.Organization.Tree(root.ID, false)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(tree.Organizations), 0)
+		assert.Equal(t, len(tree.Unassigned), 1)
+	}
+	app.Migrations.DoMigrations("down")
+}
+
+func TestOrganizationAdmin(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	org := &data.Organization{Name: "bu-one"}
+	err := app.Models.Organization.Add(org)
+	assert.Equal(t, err, nil)
+
+	admin := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	member := &data.UserAccount{Email: "b@c", Role: "user", Team: &data.Team{Name: "kings"}}
+	member.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	err = app.Models.Organization.MoveTeam(member.Team.ID, org.ID)
+	assert.Equal(t, err, nil)
+
+	ok, err := app.Models.Permission.Can(admin.ID, permission.TeamSubject(member.Team.ID), permission.Admin)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	err = app.Models.Organization.AddAdmin(org.ID, admin.ID)
+	assert.Equal(t, err, nil)
+
+	// org admins inherit admin over every team in the organization
+	ok, err = app.Models.Permission.Can(admin.ID, permission.TeamSubject(member.Team.ID), permission.Admin)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+
+	permissions, err := app.Models.Permission.GetForUser(admin.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/teams-write"), true)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
 	"github.com/stretchr/testify/assert"
 	"github.com/tidwall/gjson"
 )
@@ -109,3 +110,117 @@ func TestAuthorize(t *testing.T) {
 	}
 	app.Migrations.DoMigrations("down")
 }
+
+func TestPolicyFromDB(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	manager := permission.New(app.Migrations.DB)
+	permissions, err := manager.GetForRole("user")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Permissions(permissions).Include("/users-read"), true)
+	assert.Equal(t, data.Permissions(permissions).Include("/reports-read"), false)
+
+	// changes to casbin_rule bump the policy version and are picked up on the next refresh,
+	// so they apply without a redeploy
+	_, err = app.Migrations.DB.Exec(`insert into casbin_rule(ptype, v0, v1, v2) values ('p', 'user', '/reports', 'read')`)
+	assert.Equal(t, err, nil)
+
+	err = manager.Refresh()
+	assert.Equal(t, err, nil)
+	permissions, err = manager.GetForRole("user")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data.Permissions(permissions).Include("/reports-read"), true)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestPermissionCache(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	permissions, err := app.Models.Permission.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/reports-read"), false)
+
+	// a change made by another replica is served from the cache until the policy is refreshed
+	_, err = app.Migrations.DB.Exec(`insert into casbin_rule(ptype, v0, v1, v2) values ('p', 'user', '/reports', 'read')`)
+	assert.Equal(t, err, nil)
+	permissions, err = app.Models.Permission.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/reports-read"), false)
+
+	err = app.Models.Permission.Refresh()
+	assert.Equal(t, err, nil)
+	permissions, err = app.Models.Permission.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/reports-read"), true)
+
+	// changes to the hierarchy made by this replica apply straight away
+	org := &data.Organization{Name: "acme"}
+	err = app.Models.Organization.Add(org)
+	assert.Equal(t, err, nil)
+	ok, err := app.Models.Permission.Can(user.ID, permission.OrgSubject(org.ID), permission.Admin)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	err = app.Models.Organization.AddAdmin(org.ID, user.ID)
+	assert.Equal(t, err, nil)
+	ok, err = app.Models.Permission.Can(user.ID, permission.OrgSubject(org.ID), permission.Admin)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestAnonymousPrincipal(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	permissions, err := app.Models.Permission.GetForUser(data.AnonUserID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/ping-read"), true)
+	assert.Equal(t, permissions.Include("/users-read"), false)
+
+	decision, err := app.Models.Permission.Decide(data.AnonUserID, "/ping", permission.Read, &permission.Env{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decision.Subject, permission.AnonRole)
+	assert.Equal(t, decision.Allow, true)
+
+	// public routes are the ones granted to anon
+	_, code := DoRequest(app, []byte(``), "/v1/ping", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(``), "/v1/users", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	// a stale or malformed token does not lock a client out of public routes, other routes
+	// still report the token as invalid
+	_, code = DoRequest(app, []byte(``), "/v1/ping", "smt_ABCDEFGHIJKLMNOPQRSTUVWXYZ", http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(``), "/v1/ping", "not a token", http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	out, code := DoRequest(app, []byte(``), "/v1/users/me", "smt_ABCDEFGHIJKLMNOPQRSTUVWXYZ", http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	assert.Equal(t, gjson.Get(out.String(), "errors").Str, "invalid or missing authentication token")
+
+	// every request gets its own anonymous user
+	assert.Equal(t, data.NewAnonUser() != data.NewAnonUser(), true)
+	assert.Equal(t, data.NewAnonUser().IsAnon(), true)
+
+	// opening a route to anonymous requests is a policy change
+	err = app.Models.Role.Grant(permission.AnonRole, "/users", permission.Read, "")
+	assert.Equal(t, err, nil)
+	permissions, err = app.Models.Permission.GetForUser(data.AnonUserID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/users-read"), true)
+
+	app.Migrations.DoMigrations("down")
+}
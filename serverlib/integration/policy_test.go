@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestPolicyImportExport(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	err = app.Models.Role.Add(&data.Role{Name: "legacy"})
+	assert.Equal(t, err, nil)
+
+	doc, err := app.Models.Policy.Export()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, doc.Version, data.PolicyDocumentVersion)
+
+	doc.Roles = append(doc.Roles, &data.PolicyRole{
+		Name:     "analyst",
+		Policies: []*data.PolicyRule{{Object: "/reports", Action: "read"}},
+	})
+	doc.Teams = append(doc.Teams, &data.PolicyTeam{Name: "kings", GitURL: "https://git.example.com/kings.git", Members: []*data.PolicyMember{{Email: "a@b", Admin: true}}})
+	for _, a := range doc.Assignments {
+		if a.Email == "a@b" {
+			a.Roles = []string{"analyst"}
+		}
+	}
+
+	// a dry run returns the diff without applying it
+	changes, err := app.Models.Policy.Import(doc, false, true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(changes), 5)
+	_, err = app.Models.Role.Get("analyst")
+	assert.NotEqual(t, err, nil)
+
+	changes, err = app.Models.Policy.Import(doc, false, false)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(changes), 5)
+
+	ok, err := app.Models.Permission.Can(user.ID, "/reports", "read")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+
+	// importing the same document again is a no-op
+	changes, err = app.Models.Policy.Import(doc, false, false)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(changes), 0)
+
+	// prune removes the custom roles missing from the document
+	changes, err = app.Models.Policy.Import(doc, true, true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, changes, []*data.PolicyChange{{Op: "remove", Kind: data.PolicyKindRole, Target: "legacy"}})
+
+	// a document referring to an unknown user is rejected as a whole
+	doc.Roles = append(doc.Roles, &data.PolicyRole{Name: "auditor"})
+	doc.Teams = append(doc.Teams, &data.PolicyTeam{Name: "queens", Members: []*data.PolicyMember{{Email: "x@y"}}})
+	_, err = app.Models.Policy.Import(doc, false, false)
+	assert.NotEqual(t, err, nil)
+	_, err = app.Models.Role.Get("auditor")
+	assert.NotEqual(t, err, nil)
+
+	out, code := DoRequest(app, []byte(``), "/v1/policy?format=yaml", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Contains(t, out.String(), "name: analyst")
+
+	in := []byte(`{"version": 2, "roles": []}`)
+	_, code = DoRequest(app, in, "/v1/policy", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	in = []byte(`{"version": 1, "roles": [{"name": "analyst", "policies": []}]}`)
+	out, code = DoRequest(app, in, "/v1/policy?prune=true&dry_run=true", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "applied").Bool(), false)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourcePermissions(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	member.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	outsider := &data.UserAccount{Email: "b@c", Role: "user", Team: &data.Team{Name: "kings"}}
+	outsider.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(outsider)
+	assert.Equal(t, err, nil)
+
+	repo := &data.Resource{Kind: data.ResourceRepo, Name: "analytics", TeamID: member.Team.ID}
+	err = app.Models.Resource.Add(repo)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, repo.Path, "sqlm/repo/analytics")
+	err = app.Models.Resource.Add(&data.Resource{Kind: data.ResourceRepo, Name: "analytics", TeamID: member.Team.ID})
+	assert.NotEqual(t, err, nil)
+
+	schema := &data.Resource{Kind: data.ResourceSchema, Name: "analytics/public", TeamID: member.Team.ID}
+	err = app.Models.Resource.Add(schema)
+	assert.Equal(t, err, nil)
+
+	// the team gets write on its repo, the outsider gets read on every schema in it
+	err = app.Models.Resource.Grant(&data.ResourceGrant{Subject: permission.TeamSubject(member.Team.ID), Object: repo.Path, Action: permission.Write})
+	assert.Equal(t, err, nil)
+	err = app.Models.Resource.Grant(&data.ResourceGrant{Subject: permission.UserSubject(outsider.ID), Object: "sqlm/schema/analytics/*", Action: permission.Read})
+	assert.Equal(t, err, nil)
+
+	ok, err := app.Models.Permission.Can(member.ID, repo.Path, permission.Write)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = app.Models.Permission.Can(outsider.ID, repo.Path, permission.Write)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+	ok, err = app.Models.Permission.Can(outsider.ID, schema.Path, permission.Read)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = app.Models.Permission.Can(outsider.ID, schema.Path, permission.Write)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	grants, err := app.Models.Resource.Grants(schema)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(grants), 1)
+
+	err = app.Models.Resource.Delete(repo.ID)
+	assert.Equal(t, err, nil)
+	ok, err = app.Models.Permission.Can(member.ID, repo.Path, permission.Write)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	err = app.Models.Resource.Revoke(&data.ResourceGrant{Subject: permission.UserSubject(outsider.ID), Object: "sqlm/schema/analytics/*", Action: permission.Read})
+	assert.Equal(t, err, nil)
+	ok, err = app.Models.Permission.Can(outsider.ID, schema.Path, permission.Read)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	app.Migrations.DoMigrations("down")
+}
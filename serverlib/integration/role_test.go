@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestRoleLifecycle(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	role := &data.Role{Name: "auditor", Description: "reads secrets audit trails"}
+	err = app.Models.Role.Add(role)
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Add(&data.Role{Name: "auditor"})
+	assert.NotEqual(t, err, nil)
+
+	// a role name fits in user_account.role
+	v := validator.New()
+	data.ValidateRoleName(v, "a-role-name-over-twenty")
+	assert.Equal(t, v.Valid(), false)
+
+	// the built in roles can not be deleted
+	for _, name := range []string{"admin", "user", data.RoleService, data.RoleSCIM} {
+		assert.NotEqual(t, app.Models.Role.Delete(name), nil)
+	}
+
+	err = app.Models.Role.Grant("auditor", "/reports", "read", "")
+	assert.Equal(t, err, nil)
+	// rules that do not fit the casbin model are rejected
+	err = app.Models.Role.Grant("auditor", "/reports,/users", "read", "")
+	assert.NotEqual(t, err, nil)
+	err = app.Models.Role.Grant("missing", "/reports", "read", "")
+	assert.NotEqual(t, err, nil)
+
+	role, err = app.Models.Role.Get("auditor")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, role.Permissions.Include("/reports-read"), true)
+
+	err = app.Models.Role.Assign(user.ID, "auditor")
+	assert.Equal(t, err, nil)
+	roles, err := app.Models.Role.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, roles, []string{"user", "auditor"})
+
+	permissions, err := app.Models.Permission.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/reports-read"), true)
+	assert.Equal(t, permissions.Include("/users-read"), true)
+
+	err = app.Models.Role.Revoke("auditor", "/reports", "read")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Revoke("auditor", "/reports", "read")
+	assert.NotEqual(t, err, nil)
+
+	err = app.Models.Role.Delete("user")
+	assert.NotEqual(t, err, nil)
+	err = app.Models.Role.Delete("auditor")
+	assert.Equal(t, err, nil)
+
+	roles, err = app.Models.Role.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, roles, []string{"user"})
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestRoleHierarchy(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	// admin inherits user, which inherits anon
+	admin, err := app.Models.Role.Get("admin")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, admin.Inherits, []string{"user"})
+	assert.Equal(t, admin.Permissions.Include("/ping-read"), false)
+	assert.Equal(t, admin.EffectivePermissions.Include("/ping-read"), true)
+	assert.Equal(t, admin.EffectivePermissions.Include("/users-read"), true)
+
+	err = app.Models.Role.Add(&data.Role{Name: "analyst"})
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Grant("analyst", "/reports", "read", "")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Grant("analyst", "/reports", "write", "ip=10.0.0.0/8")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Inherit("user", "analyst")
+	assert.Equal(t, err, nil)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	permissions, err := app.Models.Permission.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/reports-read"), true)
+
+	admin, err = app.Models.Role.Get("admin")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, admin.EffectivePermissions.Include("/reports-read"), true)
+	// a conditional grant is listed with its condition
+	assert.Equal(t, admin.EffectivePermissions.Include("/reports-write"), false)
+	assert.Equal(t, admin.EffectivePermissions.Include("/reports-write;ip=10.0.0.0/8"), true)
+
+	// a role can not inherit a role that inherits it
+	err = app.Models.Role.Inherit("analyst", "admin")
+	assert.NotEqual(t, err, nil)
+	err = app.Models.Role.Inherit("analyst", "analyst")
+	assert.NotEqual(t, err, nil)
+
+	// two inherits that only form a cycle together can not both succeed
+	err = app.Models.Role.Add(&data.Role{Name: "viewer"})
+	assert.Equal(t, err, nil)
+	errs := make(chan error, 2)
+	go func() { errs <- app.Models.Role.Inherit("analyst", "viewer") }()
+	go func() { errs <- app.Models.Role.Inherit("viewer", "analyst") }()
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if <-errs != nil {
+			failed++
+		}
+	}
+	assert.Equal(t, failed, 1)
+
+	err = app.Models.Role.Disinherit("user", "analyst")
+	assert.Equal(t, err, nil)
+	permissions, err = app.Models.Permission.GetForUser(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, permissions.Include("/reports-read"), false)
+
+	out, code := DoRequest(app, []byte(``), "/v1/roles/admin/permissions", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "inherits.0").Str, "user")
+
+	app.Migrations.DoMigrations("down")
+}
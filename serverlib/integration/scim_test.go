@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/api"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// doSCIMRequest is DoRequest with extra headers, returning the response headers too
+func doSCIMRequest(app *api.Application, json []byte, url string, token string, method string, headers map[string]string) (*bytes.Buffer, int, http.Header) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(json))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/scim+json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	app.Routes().ServeHTTP(w, req)
+	return w.Body, w.Code, w.Header()
+}
+
+// setupSCIMClient registers a scim client whose users join the admin's team and returns
+// its token
+func setupSCIMClient(t *testing.T, app *api.Application) string {
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	body := []byte(`{"name": "okta", "team_id": ` + strconv.FormatInt(admin.Team.ID, 10) + `}`)
+	out, code := DoRequest(app, body, "/v1/scim/clients", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	return gjson.Get(out.String(), "token").Str
+}
+
+func TestSCIMUsers(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+	token := setupSCIMClient(t, app)
+
+	// the discovery endpoints describe what is supported
+	out, code, _ := doSCIMRequest(app, nil, "/scim/v2/ServiceProviderConfig", token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "patch.supported").Bool(), true)
+	assert.Equal(t, gjson.Get(out.String(), "etag.supported").Bool(), true)
+
+	// create
+	user := []byte(`{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "ann@b",
+		"externalId": "00u1",
+		"name": {"givenName": "Ann", "familyName": "Lee"},
+		"emails": [{"value": "ann@b", "type": "work", "primary": true}],
+		"active": true
+	}`)
+	out, code, headers := doSCIMRequest(app, user, "/scim/v2/Users", token, http.MethodPost, nil)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, headers.Get("Content-Type"), "application/scim+json")
+	id := gjson.Get(out.String(), "id").Str
+	assert.Equal(t, gjson.Get(out.String(), "name.formatted").Str, "Ann Lee")
+	assert.Equal(t, gjson.Get(out.String(), "groups.0.display").Str, "aces")
+	assert.Equal(t, gjson.Get(out.String(), "meta.version").Str, headers.Get("ETag"))
+	etag := headers.Get("ETag")
+
+	// the same userName is a uniqueness conflict
+	out, code, _ = doSCIMRequest(app, user, "/scim/v2/Users", token, http.MethodPost, nil)
+	assert.Equal(t, code, http.StatusConflict)
+	assert.Equal(t, gjson.Get(out.String(), "scimType").Str, "uniqueness")
+
+	// get, and not modified while the etag matches
+	out, code, _ = doSCIMRequest(app, nil, "/scim/v2/Users/"+id, token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "userName").Str, "ann@b")
+	assert.Equal(t, gjson.Get(out.String(), "password").Exists(), false)
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Users/"+id, token, http.MethodGet, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, code, http.StatusNotModified)
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Users/999999", token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// filters
+	out, code, _ = doSCIMRequest(app, nil, `/scim/v2/Users?filter=userName%20eq%20%22ANN@b%22`, token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(1))
+	assert.Equal(t, gjson.Get(out.String(), "Resources.0.id").Str, id)
+	out, _, _ = doSCIMRequest(app, nil, `/scim/v2/Users?filter=externalId%20eq%20%22nobody%22`, token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(0))
+	out, _, _ = doSCIMRequest(app, nil, `/scim/v2/Users?filter=userName%20sw%20%22ann%22%20and%20active%20eq%20true`, token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(1))
+	out, code, _ = doSCIMRequest(app, nil, `/scim/v2/Users?filter=password%20eq%20%22x%22`, token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, gjson.Get(out.String(), "scimType").Str, "invalidFilter")
+
+	// only the users the client provisioned are visible, not the admin or the scim service account
+	out, _, _ = doSCIMRequest(app, nil, "/scim/v2/Users", token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(1))
+
+	// nor can the client take over the admin or a user it did not provision
+	carl := &data.UserAccount{Email: "carl@b", Team: &data.Team{Name: "aces"}}
+	err := app.Models.UserAccount.Add(carl)
+	assert.Equal(t, err, nil)
+	admin, err := app.Models.UserAccount.GetByEmail("admin@b")
+	assert.Equal(t, err, nil)
+	for _, other := range []int64{admin.ID, carl.ID} {
+		url := "/scim/v2/Users/" + strconv.FormatInt(other, 10)
+		_, code, _ = doSCIMRequest(app, nil, url, token, http.MethodGet, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+		takeover := []byte(`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "evil@b", "password": "xyz987654", "active": true}`)
+		_, code, _ = doSCIMRequest(app, takeover, url, token, http.MethodPut, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+		takeover = []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "password", "value": "xyz987654"}]}`)
+		_, code, _ = doSCIMRequest(app, takeover, url, token, http.MethodPatch, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+		_, code, _ = doSCIMRequest(app, nil, url, token, http.MethodDelete, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+	}
+	_, code = DoRequest(app, []byte(`{"email": "admin@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+
+	// replace with a stale etag fails, with the current one it succeeds
+	replace := []byte(`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "ann@b", "displayName": "Ann L", "active": true}`)
+	_, code, _ = doSCIMRequest(app, replace, "/scim/v2/Users/"+id, token, http.MethodPut, map[string]string{"If-Match": `W/"99"`})
+	assert.Equal(t, code, http.StatusPreconditionFailed)
+	out, code, headers = doSCIMRequest(app, replace, "/scim/v2/Users/"+id, token, http.MethodPut, map[string]string{"If-Match": etag})
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "displayName").Str, "Ann L")
+	assert.Equal(t, gjson.Get(out.String(), "externalId").Exists(), false)
+	assert.NotEqual(t, headers.Get("ETag"), etag)
+
+	// deactivating suspends the user, as identity providers send it
+	patch := []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "Replace", "path": "active", "value": "False"}]}`)
+	out, code, _ = doSCIMRequest(app, patch, "/scim/v2/Users/"+id, token, http.MethodPatch, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "active").Bool(), false)
+	ann, err := app.Models.UserAccount.GetByEmail("ann@b")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ann.IsSuspended(), true)
+	out, _, _ = doSCIMRequest(app, nil, `/scim/v2/Users?filter=active%20eq%20false`, token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(1))
+
+	// a patch without a path sets each attribute of its value
+	patch = []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "value": {"active": true, "displayName": "Ann Lee"}}]}`)
+	out, code, _ = doSCIMRequest(app, patch, "/scim/v2/Users/"+id, token, http.MethodPatch, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "active").Bool(), true)
+	assert.Equal(t, gjson.Get(out.String(), "displayName").Str, "Ann Lee")
+
+	patch = []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "nickName", "value": "A"}]}`)
+	out, code, _ = doSCIMRequest(app, patch, "/scim/v2/Users/"+id, token, http.MethodPatch, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, gjson.Get(out.String(), "scimType").Str, "invalidPath")
+
+	// delete hides the user and blocks it from logging in
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Users/"+id, token, http.MethodDelete, nil)
+	assert.Equal(t, code, http.StatusNoContent)
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Users/"+id, token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+	ann, err = app.Models.UserAccount.GetByEmail("ann@b")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ann.IsSuspended(), true)
+
+	// deleted users can not be issued tokens
+	userToken, err := app.Models.Token.New(ann.ID, time.Hour, data.ScopeLogin)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, userToken == nil, true)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestSCIMPrivilegedUsersHidden(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+	token := setupSCIMClient(t, app)
+
+	ids := map[string]int64{}
+	for _, name := range []string{"ann", "bob", "cat", "dan", "eve"} {
+		user := []byte(`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "` + name + `@b", "active": true}`)
+		out, code, _ := doSCIMRequest(app, user, "/scim/v2/Users", token, http.MethodPost, nil)
+		assert.Equal(t, code, http.StatusCreated)
+		ids[name], _ = strconv.ParseInt(gjson.Get(out.String(), "id").Str, 10, 64)
+	}
+
+	// users the client provisioned that were later made admins of an organization, of a team,
+	// or given an admin role directly or through inheritance, are out of its reach
+	org := &data.Organization{Name: "acme"}
+	err := app.Models.Organization.Add(org)
+	assert.Equal(t, err, nil)
+	err = app.Models.Organization.AddAdmin(org.ID, ids["bob"])
+	assert.Equal(t, err, nil)
+	_, err = app.Migrations.DB.Exec(`update users_teams set is_admin = 1 where user_account_id = $1`, ids["cat"])
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Assign(ids["dan"], "admin")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Add(&data.Role{Name: "ops"})
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Inherit("ops", "admin")
+	assert.Equal(t, err, nil)
+	err = app.Models.Role.Assign(ids["eve"], "ops")
+	assert.Equal(t, err, nil)
+
+	takeover := []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "password", "value": "xyz987654"}]}`)
+	for _, name := range []string{"bob", "cat", "dan", "eve"} {
+		url := "/scim/v2/Users/" + strconv.FormatInt(ids[name], 10)
+		_, code, _ := doSCIMRequest(app, takeover, url, token, http.MethodPatch, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+	}
+	_, code, _ := doSCIMRequest(app, takeover, "/scim/v2/Users/"+strconv.FormatInt(ids["ann"], 10), token, http.MethodPatch, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	out, _, _ := doSCIMRequest(app, nil, "/scim/v2/Users", token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(1))
+
+	app.Migrations.DoMigrations("down")
+}
+func TestSCIMGroups(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+	token := setupSCIMClient(t, app)
+
+	ids := []string{}
+	for _, email := range []string{"ann@b", "bob@b"} {
+		out, code, _ := doSCIMRequest(app, []byte(`{"userName": "`+email+`"}`), "/scim/v2/Users", token, http.MethodPost, nil)
+		assert.Equal(t, code, http.StatusCreated)
+		ids = append(ids, gjson.Get(out.String(), "id").Str)
+	}
+
+	// create with members
+	group := []byte(`{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"],
+		"displayName": "bees",
+		"members": [{"value": "` + ids[0] + `"}]
+	}`)
+	out, code, headers := doSCIMRequest(app, group, "/scim/v2/Groups", token, http.MethodPost, nil)
+	assert.Equal(t, code, http.StatusCreated)
+	id := gjson.Get(out.String(), "id").Str
+	assert.Equal(t, gjson.Get(out.String(), "members.#").Int(), int64(1))
+	assert.Equal(t, gjson.Get(out.String(), "members.0.display").Str, "ann@b")
+	etag := headers.Get("ETag")
+
+	_, code, _ = doSCIMRequest(app, group, "/scim/v2/Groups", token, http.MethodPost, nil)
+	assert.Equal(t, code, http.StatusConflict)
+
+	bad := []byte(`{"displayName": "cees", "members": [{"value": "999999"}]}`)
+	out, code, _ = doSCIMRequest(app, bad, "/scim/v2/Groups", token, http.MethodPost, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, gjson.Get(out.String(), "scimType").Str, "invalidValue")
+
+	out, _, _ = doSCIMRequest(app, nil, `/scim/v2/Groups?filter=displayName%20eq%20%22Bees%22`, token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(1))
+	assert.Equal(t, gjson.Get(out.String(), "Resources.0.id").Str, id)
+
+	// teams the client did not provision, other than its default team, are out of its reach
+	dees := &data.Team{Name: "dees"}
+	err := app.Models.Team.Add(dees)
+	assert.Equal(t, err, nil)
+	out, _, _ = doSCIMRequest(app, nil, "/scim/v2/Groups", token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "totalResults").Int(), int64(2))
+	deesURL := "/scim/v2/Groups/" + strconv.FormatInt(dees.ID, 10)
+	_, code, _ = doSCIMRequest(app, nil, deesURL, token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+	_, code, _ = doSCIMRequest(app, []byte(`{"displayName": "mine", "members": []}`), deesURL, token, http.MethodPut, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+	_, code, _ = doSCIMRequest(app, nil, deesURL, token, http.MethodDelete, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// add a member
+	patch := []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "add", "path": "members", "value": [{"value": "` + ids[1] + `"}]}]}`)
+	out, code, headers = doSCIMRequest(app, patch, "/scim/v2/Groups/"+id, token, http.MethodPatch, map[string]string{"If-Match": etag})
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "members.#").Int(), int64(2))
+
+	// the old etag no longer matches
+	_, code, _ = doSCIMRequest(app, patch, "/scim/v2/Groups/"+id, token, http.MethodPatch, map[string]string{"If-Match": etag})
+	assert.Equal(t, code, http.StatusPreconditionFailed)
+	etag = headers.Get("ETag")
+
+	// remove a member with a value filter
+	patch = []byte(`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "remove", "path": "members[value eq \"` + ids[0] + `\"]"}]}`)
+	out, code, _ = doSCIMRequest(app, patch, "/scim/v2/Groups/"+id, token, http.MethodPatch, map[string]string{"If-Match": etag})
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "members.#").Int(), int64(1))
+	assert.Equal(t, gjson.Get(out.String(), "members.0.value").Str, ids[1])
+
+	// the user's groups follow its teams
+	out, _, _ = doSCIMRequest(app, nil, "/scim/v2/Users/"+ids[1], token, http.MethodGet, nil)
+	assert.Equal(t, gjson.Get(out.String(), "groups.#").Int(), int64(2))
+
+	// replace renames and sets the members
+	replace := []byte(`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"], "displayName": "bumblebees", "members": []}`)
+	out, code, _ = doSCIMRequest(app, replace, "/scim/v2/Groups/"+id, token, http.MethodPut, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "displayName").Str, "bumblebees")
+	assert.Equal(t, gjson.Get(out.String(), "members.#").Int(), int64(0))
+
+	// delete, the default team can not be deleted
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Groups/"+id, token, http.MethodDelete, nil)
+	assert.Equal(t, code, http.StatusNoContent)
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Groups/"+id, token, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+	out, _, _ = doSCIMRequest(app, nil, `/scim/v2/Groups?filter=displayName%20eq%20%22aces%22`, token, http.MethodGet, nil)
+	aces := gjson.Get(out.String(), "Resources.0.id").Str
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Groups/"+aces, token, http.MethodDelete, nil)
+	assert.Equal(t, code, http.StatusConflict)
+
+	// nor deleted outside of scim, so purging teams never trips over it
+	acesID, _ := strconv.ParseInt(aces, 10, 64)
+	err = app.Models.Team.Delete(acesID, 0)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, strings.Contains(err.Error(), "default team of a scim client"), true)
+	_, err = app.Models.Team.Purge(0)
+	assert.Equal(t, err, nil)
+
+	// only scim clients can provision
+	admin, err := app.Models.UserAccount.GetByEmail("admin@b")
+	assert.Equal(t, err, nil)
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	_, code, _ = doSCIMRequest(app, nil, "/scim/v2/Groups", adminToken.Plaintext, http.MethodGet, nil)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	// deleting the default team is a conflict a retry does not resolve
+	out, code = DoRequest(app, []byte(`{}`), "/v1/teams/"+aces, adminToken.Plaintext, http.MethodDelete)
+	assert.Equal(t, code, http.StatusConflict)
+	assert.Equal(t, strings.Contains(gjson.Get(out.String(), "errors").Str, "default team of a scim client"), true)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestTeamSecrets(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	ad := []byte("team/git")
+	ciphertext, err := app.Vault.Seal([]byte("ghp_secret"), ad)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, string(ciphertext), "ghp_secret")
+
+	secret := &data.Secret{TeamID: user.Team.ID, Name: "git", Kind: data.SecretHTTPSToken, Ciphertext: ciphertext}
+	err = app.Models.Secret.Put(secret, &data.SecretAccess{TeamID: user.Team.ID, Name: "git", UserAccountID: user.ID, Action: data.SecretActionWrite})
+	assert.Equal(t, err, nil)
+
+	// team_meta is created for teams that did not have one
+	team, err := app.Models.Team.Get(user.Team.ID)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, team.Meta.ID, int64(0))
+
+	secrets, err := app.Models.Secret.List(user.Team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(secrets), 1)
+	assert.Equal(t, len(secrets[0].Ciphertext), 0)
+
+	stored, err := app.Models.Secret.Get(user.Team.ID, "git")
+	assert.Equal(t, err, nil)
+	value, err := app.Vault.Open(stored.Ciphertext, ad)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(value), "ghp_secret")
+
+	_, err = app.Vault.Open(stored.Ciphertext, []byte("team/other"))
+	assert.NotEqual(t, err, nil)
+
+	err = app.Models.Secret.LogAccess(&data.SecretAccess{TeamID: user.Team.ID, Name: "git", UserAccountID: user.ID, Action: data.SecretActionRead})
+	assert.Equal(t, err, nil)
+	log, err := app.Models.Secret.GetAccessLog(user.Team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(log), 2)
+	assert.Equal(t, log[1].Action, data.SecretActionWrite)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestServerSecretReadAudit(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	server := &data.Server{TeamID: user.Team.ID, ServerURL: "https://sqlm.aces.io"}
+	err = app.Models.Server.Register(server)
+	assert.Equal(t, err, nil)
+	serverToken, err := app.Models.Token.New(server.ServiceAccountID, time.Hour, data.ScopeService)
+	assert.Equal(t, err, nil)
+
+	// reads that do not release a value are audited too
+	_, code := DoRequest(app, nil, "/v1/servers/secrets/git", serverToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	log, err := app.Models.Secret.GetAccessLog(user.Team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(log), 1)
+	assert.Equal(t, log[0].Action, data.SecretActionReadFailed)
+	assert.Equal(t, log[0].UserAccountID, server.ServiceAccountID)
+
+	// the server's service account reads the value
+	ciphertext, err := app.Vault.Seal([]byte("ghp_secret"), []byte("team:"+strconv.FormatInt(user.Team.ID, 10)+"/git"))
+	assert.Equal(t, err, nil)
+	secret := &data.Secret{TeamID: user.Team.ID, Name: "git", Kind: data.SecretHTTPSToken, Ciphertext: ciphertext}
+	err = app.Models.Secret.Put(secret, &data.SecretAccess{TeamID: user.Team.ID, Name: "git", UserAccountID: user.ID, Action: data.SecretActionWrite})
+	assert.Equal(t, err, nil)
+	out, code := DoRequest(app, nil, "/v1/servers/secrets/git", serverToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "value").Str, "ghp_secret")
+
+	// other callers are refused, and audited
+	userToken, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	_, code = DoRequest(app, nil, "/v1/servers/secrets/git", userToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	var denied int
+	err = app.Migrations.DB.QueryRow(`select count(*) from team_secret_audit where user_account_id = $1 and action = $2`, user.ID, data.SecretActionReadDenied).Scan(&denied)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, denied, 1)
+
+	app.Migrations.DoMigrations("down")
+}
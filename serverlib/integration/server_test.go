@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestRegisterServer(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	server := &data.Server{TeamID: user.Team.ID, ServerURL: "https://sqlm.aces.io"}
+	err = app.Models.Server.Register(server)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, server.ServiceAccountID, int64(0))
+
+	// registering again keeps the same service account
+	serviceAccountID := server.ServiceAccountID
+	server.ServerURL = "https://sqlm2.aces.io"
+	err = app.Models.Server.Register(server)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, server.ServiceAccountID, serviceAccountID)
+
+	registered, err := app.Models.Server.GetForTeam(user.Team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, registered.ServerURL, "https://sqlm2.aces.io")
+
+	token, err := app.Models.Token.NewForAudience(user.ID, time.Hour, data.ScopeLogin, registered.ServerURL)
+	assert.Equal(t, err, nil)
+
+	found, err := app.Models.UserAccount.GetForAudience(data.ScopeLogin, token.Plaintext, registered.ServerURL)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, found.ID, user.ID)
+
+	_, err = app.Models.UserAccount.GetForAudience(data.ScopeLogin, token.Plaintext, "https://sqlm.kings.io")
+	assert.NotEqual(t, err, nil)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestAudienceTokenOnlyForServer(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	token, err := app.Models.Token.NewForAudience(user.ID, time.Hour, data.ScopeLogin, "https://sqlm.aces.io")
+	assert.Equal(t, err, nil)
+	_, code := DoRequest(app, nil, "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	token, err = app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	_, code = DoRequest(app, nil, "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestIntrospectWithServerCredential(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "root"}}
+	admin.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	member.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	teamID := strconv.FormatInt(member.Team.ID, 10)
+	body := []byte(`{"team_id": ` + teamID + `, "server_url": "https://sqlm.aces.io"}`)
+	out, code := DoRequest(app, body, "/v1/servers", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	credential := gjson.Get(out.String(), "credential.token").Str
+
+	// a token asked for the team is bound to its server
+	login := []byte(`{"email": "a@b", "password": "abc123456", "team_id": ` + teamID + `}`)
+	out, code = DoRequest(app, login, "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	bound := gjson.Get(out.String(), "authentication_token.plain_text").Str
+
+	out, code = DoRequest(app, []byte(`{"token": "`+bound+`"}`), "/v1/tokens/introspect", credential, http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "active").Bool(), true)
+	assert.Equal(t, gjson.Get(out.String(), "user.id").Int(), member.ID)
+
+	// a token asked without a team is only accepted by this service
+	out, code = DoRequest(app, []byte(`{"email": "a@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	unbound := gjson.Get(out.String(), "authentication_token.plain_text").Str
+
+	_, code = DoRequest(app, nil, "/v1/users/me", unbound, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	out, code = DoRequest(app, []byte(`{"token": "`+unbound+`"}`), "/v1/tokens/introspect", credential, http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "active").Bool(), false)
+
+	// tokens can only be asked for a team of the user
+	login = []byte(`{"email": "a@b", "password": "abc123456", "team_id": ` + strconv.FormatInt(admin.Team.ID, 10) + `}`)
+	_, code = DoRequest(app, login, "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestSessions(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "kings"}}
+	member.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	// logins come from the address httptest gives every request, 192.0.2.1
+	login := func(email string, password string) (string, int) {
+		body := []byte(`{"email": "` + email + `", "password": "` + password + `"}`)
+		w := httptest.NewRecorder()
+		app.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", bytes.NewBuffer(body)))
+		return gjson.Get(w.Body.String(), "authentication_token.plain_text").Str, w.Code
+	}
+
+	// failed and successful logins are both recorded, attempts for unknown emails are not
+	_, code := login("a@b", "wrong12345")
+	assert.Equal(t, code, http.StatusUnauthorized)
+	_, code = login("nobody@b", "abc123456")
+	assert.Equal(t, code, http.StatusUnauthorized)
+	var unknown int
+	err = app.Migrations.DB.QueryRow(`select count(*) from login_event where email = 'nobody@b'`).Scan(&unknown)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, unknown, 0)
+	first, code := login("a@b", "abc123456")
+	assert.Equal(t, code, http.StatusCreated)
+	second, code := login("a@b", "abc123456")
+	assert.Equal(t, code, http.StatusCreated)
+	adminToken, _ := login("admin@b", "abc123456")
+
+	out, code := DoRequest(app, nil, "/v1/users/me/logins", second, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "logins.#").Int(), int64(3))
+	assert.Equal(t, gjson.Get(out.String(), "logins.0.outcome").Str, data.LoginSucceeded)
+	assert.Equal(t, gjson.Get(out.String(), "logins.0.method").Str, data.LoginPassword)
+	assert.Equal(t, gjson.Get(out.String(), "logins.2.outcome").Str, data.LoginInvalidCredentials)
+	assert.Equal(t, gjson.Get(out.String(), "logins.2.ip").Str, "192.0.2.1")
+
+	// each login is a session, the one making the request is marked
+	out, code = DoRequest(app, nil, "/v1/users/me/sessions", second, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "sessions.#").Int(), int64(2))
+	assert.Equal(t, gjson.Get(out.String(), "sessions.0.current").Bool(), true)
+	assert.Equal(t, gjson.Get(out.String(), "sessions.1.current").Bool(), false)
+	firstID := gjson.Get(out.String(), "sessions.1.id").Int()
+
+	// revoking a session logs it out
+	sessionURL := "/v1/users/me/sessions/" + strconv.FormatInt(firstID, 10)
+	_, code = DoRequest(app, nil, sessionURL, second, http.MethodDelete)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, nil, "/v1/users/me", first, http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	_, code = DoRequest(app, nil, sessionURL, second, http.MethodDelete)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// admins can see and revoke the sessions of any user, members can not
+	memberURL := "/v1/users/" + strconv.FormatInt(member.ID, 10)
+	_, code = DoRequest(app, nil, "/v1/users/"+strconv.FormatInt(admin.ID, 10)+"/logins", second, http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	out, code = DoRequest(app, nil, memberURL+"/logins", adminToken, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "logins.#").Int(), int64(3))
+	out, code = DoRequest(app, nil, memberURL+"/sessions", adminToken, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "sessions.#").Int(), int64(1))
+	assert.Equal(t, gjson.Get(out.String(), "sessions.0.current").Bool(), false)
+	secondID := gjson.Get(out.String(), "sessions.0.id").Int()
+	_, code = DoRequest(app, nil, memberURL+"/sessions/"+strconv.FormatInt(secondID, 10), adminToken, http.MethodDelete)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, nil, "/v1/users/me", second, http.MethodGet)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	// the login history is part of the user's export
+	export, err := app.Models.UserAccount.Export(member.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(export.Logins), 3)
+
+	// the history outlives a deleted user until it is older than the retention
+	_, err = app.Migrations.DB.Exec(`update login_event set created_at = now() - interval '2 hours' where outcome = $1`, data.LoginInvalidCredentials)
+	assert.Equal(t, err, nil)
+	member, err = app.Models.UserAccount.GetByEmail("a@b")
+	assert.Equal(t, err, nil)
+	err = app.Models.UserAccount.Delete(member)
+	assert.Equal(t, err, nil)
+	n, err := app.Models.Login.Purge(time.Hour)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, int64(1))
+	var kept int
+	err = app.Migrations.DB.QueryRow(`select count(*) from login_event where email = 'a@b' and user_account_id is null`).Scan(&kept)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, kept, 2)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestTrustedProxies(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+	app.Config.TrustedProxies = []string{"192.0.2.1", "10.0.0.0/8"}
+
+	member := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "kings"}}
+	member.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	login := func(remoteAddr string, forwardedFor string) string {
+		body := []byte(`{"email": "a@b", "password": "abc123456"}`)
+		req, _ := http.NewRequest(http.MethodPost, "/v1/tokens/authentication", bytes.NewBuffer(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		app.Routes().ServeHTTP(w, req)
+		assert.Equal(t, w.Code, http.StatusCreated)
+		return gjson.Get(w.Body.String(), "authentication_token.plain_text").Str
+	}
+
+	// a client can not pick its own address, through a trusted proxy the forwarded
+	// address is used skipping any other trusted proxy it came through
+	login("203.0.113.9:4000", "198.51.100.7")
+	login("192.0.2.1:4000", "198.51.100.7, 10.1.2.3")
+	token := login("192.0.2.1:4000", "")
+
+	out, code := DoRequest(app, nil, "/v1/users/me/logins", token, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "logins.#").Int(), int64(3))
+	assert.Equal(t, gjson.Get(out.String(), "logins.0.ip").Str, "192.0.2.1")
+	assert.Equal(t, gjson.Get(out.String(), "logins.1.ip").Str, "198.51.100.7")
+	assert.Equal(t, gjson.Get(out.String(), "logins.2.ip").Str, "203.0.113.9")
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteTeam(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	users := []string{"a@b", "b@c"}
+	var teamID int64
+	for _, u := range users {
+		userAdd := &data.UserAccount{Email: u, Role: "user", Team: &data.Team{Name: "aces"}}
+		userAdd.Password.Set("abc123456")
+		err := app.Models.UserAccount.Add(userAdd)
+		assert.Equal(t, err, nil)
+		teamID = userAdd.Team.ID
+	}
+
+	other := &data.Team{Name: "kings"}
+	err := app.Models.Team.Add(other)
+	assert.Equal(t, err, nil)
+
+	team, err := app.Models.Team.Get(teamID)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, team.OwnerID, int64(0))
+
+	// every member would be left without a team so the delete is blocked
+	stranded, err := app.Models.Team.Stranded(teamID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(stranded), len(users))
+	err = app.Models.Team.Delete(teamID, 0)
+	assert.NotEqual(t, err, nil)
+
+	err = app.Models.Team.Delete(teamID, other.ID)
+	assert.Equal(t, err, nil)
+
+	user, err := app.Models.UserAccount.GetByEmail(users[0])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, user.Team.ID, other.ID)
+
+	err = app.Models.Team.Restore(teamID, time.Hour)
+	assert.Equal(t, err, nil)
+
+	err = app.Models.Team.Delete(teamID, other.ID)
+	assert.Equal(t, err, nil)
+	n, err := app.Models.Team.Purge(0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, int64(1))
+
+	err = app.Models.Team.Restore(teamID, time.Hour)
+	assert.NotEqual(t, err, nil)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestTransferTeamOwnership(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	owner := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	owner.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(owner)
+	assert.Equal(t, err, nil)
+
+	member := &data.UserAccount{Email: "b@c", Role: "user", Team: &data.Team{Name: "aces"}}
+	member.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(member)
+	assert.Equal(t, err, nil)
+
+	outsider := &data.UserAccount{Email: "c@d", Role: "user", Team: &data.Team{Name: "kings"}}
+	outsider.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(outsider)
+	assert.Equal(t, err, nil)
+
+	err = app.Models.Team.TransferOwnership(owner.Team.ID, outsider.ID)
+	assert.NotEqual(t, err, nil)
+
+	err = app.Models.Team.TransferOwnership(owner.Team.ID, member.ID)
+	assert.Equal(t, err, nil)
+
+	team, err := app.Models.Team.Get(owner.Team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, team.OwnerID, member.ID)
+
+	// the previous owner stays a team admin
+	var isAdmin int
+	err = app.Migrations.DB.QueryRow(`select is_admin from users_teams where team_id = $1 and user_account_id = $2`, owner.Team.ID, owner.ID).Scan(&isAdmin)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, isAdmin, 1)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestTeamQuota(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	team := &data.Team{Name: "aces"}
+	err := app.Models.Team.Add(team)
+	assert.Equal(t, err, nil)
+
+	members, tokens := 2, 1
+	err = app.Models.Quota.Set(&data.Quota{TeamID: team.ID, MaxMembers: &members, MaxTokens: &tokens})
+	assert.Equal(t, err, nil)
+
+	testcases := []struct {
+		user     string
+		exceeded bool
+	}{
+		{user: "a@b", exceeded: false},
+		{user: "b@c", exceeded: false},
+		{user: "c@d", exceeded: true},
+	}
+
+	var userID int64
+	for _, tcase := range testcases {
+		userAdd := &data.UserAccount{Email: tcase.user, Role: "user", Team: &data.Team{Name: team.Name}}
+		userAdd.Password.Set("abc123456")
+		err := app.Models.UserAccount.Add(userAdd)
+		if tcase.exceeded {
+			assert.NotEqual(t, err, nil)
+			continue
+		}
+		assert.Equal(t, err, nil)
+		userID = userAdd.ID
+	}
+
+	_, err = app.Models.Token.New(userID, time.Hour, data.ScopeRO)
+	assert.Equal(t, err, nil)
+	_, err = app.Models.Token.New(userID, time.Hour, data.ScopeRO)
+	assert.NotEqual(t, err, nil)
+
+	// login sessions and single use tokens do not count against the token quota
+	_, err = app.Models.Token.New(userID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	_, err = app.Models.Token.New(userID, time.Hour, data.ScopeEmailChange)
+	assert.Equal(t, err, nil)
+
+	usage, err := app.Models.Quota.Usage(team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, usage.Members.Used, members)
+	assert.Equal(t, usage.Tokens.Used, tokens)
+	assert.Equal(t, usage.ServiceAccounts.Limit == nil, true)
+
+	// there is no usage for a team that does not exist
+	_, code := DoRequest(app, nil, "/v1/teams/"+strconv.FormatInt(team.ID+1, 10)+"/quota", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestTeamQuotaConcurrent(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	team := &data.Team{Name: "aces"}
+	err := app.Models.Team.Add(team)
+	assert.Equal(t, err, nil)
+
+	members := 3
+	err = app.Models.Quota.Set(&data.Quota{TeamID: team.ID, MaxMembers: &members})
+	assert.Equal(t, err, nil)
+
+	// members added at the same time are still held to the seat limit
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userAdd := &data.UserAccount{Email: fmt.Sprintf("u%d@b", i), Role: "user", Team: &data.Team{Name: team.Name}}
+			userAdd.Password.Set("abc123456")
+			app.Models.UserAccount.Add(userAdd)
+		}(i)
+	}
+	wg.Wait()
+
+	usage, err := app.Models.Quota.Usage(team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, usage.Members.Used, members)
+
+	// and so are tokens
+	var userID int64
+	err = app.Migrations.DB.QueryRow(`select user_account_id from users_teams where team_id = $1 limit 1`, team.ID).Scan(&userID)
+	assert.Equal(t, err, nil)
+	tokens := 2
+	err = app.Models.Quota.Set(&data.Quota{TeamID: team.ID, MaxMembers: &members, MaxTokens: &tokens})
+	assert.Equal(t, err, nil)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.Models.Token.New(userID, time.Hour, data.ScopeRO)
+		}()
+	}
+	wg.Wait()
+
+	usage, err = app.Models.Quota.Usage(team.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, usage.Tokens.Used, tokens)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestExportAndEraseUser(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Name: "Ann", Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	token, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	err = app.Models.UserAccount.Suspend(user.ID, admin.ID, "review", nil)
+	assert.Equal(t, err, nil)
+	err = app.Models.UserAccount.Reactivate(user.ID, admin.ID)
+	assert.Equal(t, err, nil)
+
+	out, code := DoRequest(app, []byte(``), "/v1/users/me/export", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "profile.email").Str, "a@b")
+	assert.Equal(t, gjson.Get(out.String(), "memberships.0.team_name").Str, "aces")
+	assert.Equal(t, gjson.Get(out.String(), "memberships.0.is_owner").Bool(), true)
+	assert.Equal(t, gjson.Get(out.String(), "tokens.#").Int(), int64(1))
+	assert.Equal(t, gjson.Get(out.String(), "tokens.0.hash").Exists(), false)
+	assert.Equal(t, gjson.Get(out.String(), "suspensions.#").Int(), int64(2))
+
+	// an erasure can be cancelled during its grace period
+	out, code = DoRequest(app, []byte(``), "/v1/users/me/erasure", token.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusAccepted)
+	assert.Equal(t, gjson.Get(out.String(), "erasure.erase_after").Exists(), true)
+	_, code = DoRequest(app, []byte(``), "/v1/users/me/erasure", token.Plaintext, http.MethodDelete)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(``), "/v1/users/me/erasure", token.Plaintext, http.MethodDelete)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	_, code = DoRequest(app, []byte(``), "/v1/users/me/erasure", token.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusAccepted)
+
+	// nothing is erased before the grace period has passed
+	app.EraseUsers()
+	_, err = app.Models.UserAccount.GetForToken(data.ScopeLogin, token.Plaintext)
+	assert.Equal(t, err, nil)
+
+	// the identifier the user had at an identity provider goes too
+	_, err = app.Migrations.DB.Exec("update user_account set scim_external_id = '00u1' where id = $1", user.ID)
+	assert.Equal(t, err, nil)
+	_, err = app.Migrations.DB.Exec("update user_account set erasure_requested_at = now() - interval '2 hours' where id = $1", user.ID)
+	assert.Equal(t, err, nil)
+	app.EraseUsers()
+
+	_, err = app.Models.UserAccount.GetForToken(data.ScopeLogin, token.Plaintext)
+	assert.NotEqual(t, err, nil)
+	_, err = app.Models.UserAccount.GetByEmail("a@b")
+	assert.NotEqual(t, err, nil)
+
+	// the row is kept, pseudonymized, so the audit history still refers to it
+	var email string
+	var name, externalID *string
+	var scimClientID *int64
+	err = app.Migrations.DB.QueryRow("select email, name, scim_external_id, scim_client_id from user_account where id = $1", user.ID).Scan(&email, &name, &externalID, &scimClientID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, email, fmt.Sprintf("erased-%d@erased.invalid", user.ID))
+	assert.Equal(t, name == nil, true)
+	assert.Equal(t, externalID == nil, true)
+	assert.Equal(t, scimClientID == nil, true)
+
+	events, err := app.Models.UserAccount.GetSuspensionHistory(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(events), 2)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/api"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// doRequestCSV is DoRequest with a csv body
+func doRequestCSV(app *api.Application, body string, url string, token string, method string) (*bytes.Buffer, int) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "text/csv")
+	app.Routes().ServeHTTP(w, req)
+	return w.Body, w.Code
+}
+
+// waitImportJob polls an import run in the background until it is no longer running
+func waitImportJob(t *testing.T, app *api.Application, out *bytes.Buffer, token string) string {
+	url := fmt.Sprintf("/v1/users/import/%d", gjson.Get(out.String(), "job.id").Int())
+	for i := 0; i < 600; i++ {
+		job, code := DoRequest(app, nil, url, token, http.MethodGet)
+		assert.Equal(t, code, http.StatusOK)
+		if gjson.Get(job.String(), "job.status").Str != data.ImportJobRunning {
+			return job.String()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("import job did not finish")
+	return ""
+}
+
+func TestImportUsers(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	rows := []byte(`{"users": [
+		{"email": "a@b", "name": "Ann", "team": "aces", "password": "abc123456"},
+		{"email": "b@b", "team": "aces", "password": "short"}
+	]}`)
+
+	// a dry run reports every row and writes nothing
+	out, code := DoRequest(app, rows, "/v1/users/import?dry_run=true", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Equal(t, gjson.Get(out.String(), "results.0.status").Str, data.ImportValid)
+	assert.Equal(t, gjson.Get(out.String(), "results.1.status").Str, data.ImportFailed)
+	assert.Equal(t, gjson.Get(out.String(), "results.1.errors.password").Exists(), true)
+	_, err = app.Models.UserAccount.GetByEmail("a@b")
+	assert.NotEqual(t, err, nil)
+
+	// best effort keeps the rows that succeed, an import setting passwords runs in the
+	// background
+	out, code = DoRequest(app, rows, "/v1/users/import?mode=best-effort", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusAccepted)
+	assert.Equal(t, gjson.Get(out.String(), "job.status").Str, data.ImportJobRunning)
+	job := waitImportJob(t, app, out, adminToken.Plaintext)
+	assert.Equal(t, gjson.Get(job, "job.status").Str, data.ImportJobFinished)
+	assert.Equal(t, gjson.Get(job, "job.created").Int(), int64(1))
+	assert.Equal(t, gjson.Get(job, "job.failed").Int(), int64(1))
+	user, err := app.Models.UserAccount.GetByEmail("a@b")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, user.Name, "Ann")
+
+	// a transactional import writes nothing when a row fails in the database
+	rows = []byte(`{"users": [
+		{"email": "c@b", "team": "aces", "password": "abc123456"},
+		{"email": "a@b", "team": "aces", "password": "abc123456"}
+	]}`)
+	out, code = DoRequest(app, rows, "/v1/users/import", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusAccepted)
+	job = waitImportJob(t, app, out, adminToken.Plaintext)
+	assert.Equal(t, gjson.Get(job, "job.created").Int(), int64(0))
+	assert.Equal(t, gjson.Get(job, "job.results.0.status").Str, data.ImportSkipped)
+	assert.Equal(t, gjson.Get(job, "job.results.1.errors.email").Str, "a user with this email already exists")
+	_, err = app.Models.UserAccount.GetByEmail("c@b")
+	assert.NotEqual(t, err, nil)
+
+	// invited users choose their own password
+	csv := "email,name,team\nd@b,Dee,aces\ne@b,,bees\n"
+	out, code = doRequestCSV(app, csv, "/v1/users/import?invite=true", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, gjson.Get(out.String(), "created").Int(), int64(2))
+	assert.Equal(t, gjson.Get(out.String(), "results.1.invite").Bool(), true)
+
+	sent, ok := app.Notifier.(*testNotifier).last("d@b")
+	assert.Equal(t, ok, true)
+	invite := sent.body[strings.LastIndex(sent.body, " ")+1:]
+
+	_, code = DoRequest(app, []byte(`{"email": "d@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	out, code = DoRequest(app, []byte(`{"token": "`+invite+`", "password": "xyz987654"}`), "/v1/users/invite", "", http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.activated").Bool(), true)
+
+	_, code = DoRequest(app, []byte(`{"token": "`+invite+`", "password": "xyz987654"}`), "/v1/users/invite", "", http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	_, code = DoRequest(app, []byte(`{"email": "d@b", "password": "xyz987654"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+
+	// many more users than fit in a request's write timeout can be given a password
+	var many []string
+	for i := 0; i < 50; i++ {
+		many = append(many, fmt.Sprintf(`{"email": "p%d@b", "team": "aces", "password": "abc123456"}`, i))
+	}
+	body := []byte(`{"users": [` + strings.Join(many, ",") + `]}`)
+	out, code = DoRequest(app, body, "/v1/users/import", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusAccepted)
+	job = waitImportJob(t, app, out, adminToken.Plaintext)
+	assert.Equal(t, gjson.Get(job, "job.status").Str, data.ImportJobFinished)
+	assert.Equal(t, gjson.Get(job, "job.created").Int(), int64(50))
+	_, code = DoRequest(app, []byte(`{"email": "p49@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+
+	_, code = DoRequest(app, nil, "/v1/users/import/999999", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// the export can be imported again
+	out, code = DoRequest(app, []byte(``), "/v1/users/export?format=csv", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, lines[0], "id,email,name,team,role,activated,created_at")
+	assert.Equal(t, len(lines), 55)
+	// every exported user already exists here, but no row fails for a missing password
+	out, code = doRequestCSV(app, out.String(), "/v1/users/import?invite=true&dry_run=true", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Equal(t, gjson.Get(out.String(), "results.#").Int(), int64(54))
+	assert.Equal(t, gjson.Get(out.String(), "results.#.errors.password").String(), "[]")
+
+	out, code = DoRequest(app, []byte(``), "/v1/users/export", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "users.#").Int(), int64(54))
+
+	app.Migrations.DoMigrations("down")
+}
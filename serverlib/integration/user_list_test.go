@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestListUsers(t *testing.T) {
+
+	mockAuth := true
+	app := setup(mockAuth)
+
+	for _, u := range []struct{ email, role, team string }{
+		{"ann@acme.io", "user", "aces"},
+		{"bob@acme.io", "admin", "aces"},
+		{"cat@other.io", "user", "kings"},
+		{"dan@acme.io", "user", "kings"},
+	} {
+		user := &data.UserAccount{Email: u.email, Role: u.role, Team: &data.Team{Name: u.team}}
+		user.Password.Set("abc123456")
+		err := app.Models.UserAccount.Add(user)
+		assert.Equal(t, err, nil)
+	}
+
+	base := data.UserFilter{Sort: "email", Page: 1, PageSize: 20}
+
+	users, meta, err := app.Models.UserAccount.List(base)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(users), 4)
+	assert.Equal(t, meta.TotalRecords, 4)
+	assert.Equal(t, meta.LastPage, 1)
+
+	f := base
+	f.Role = "user"
+	f.EmailPrefix = "ANN"
+	users, _, err = app.Models.UserAccount.List(f)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, users[0].Email, "ann@acme.io")
+
+	f = base
+	f.Search = "other"
+	users, _, err = app.Models.UserAccount.List(f)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, users[0].Email, "cat@other.io")
+
+	kings, err := app.Models.UserAccount.GetByEmail("cat@other.io")
+	assert.Equal(t, err, nil)
+	f = base
+	f.TeamID = kings.Team.ID
+	f.Sort = "-email"
+	users, _, err = app.Models.UserAccount.List(f)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(users), 2)
+	assert.Equal(t, users[0].Email, "dan@acme.io")
+
+	// a cursor continues from the last user of the previous page
+	f = base
+	f.PageSize = 3
+	users, meta, err = app.Models.UserAccount.List(f)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(users), 3)
+	assert.NotEqual(t, meta.NextCursor, "")
+
+	f.Cursor = meta.NextCursor
+	users, meta, err = app.Models.UserAccount.List(f)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, users[0].Email, "dan@acme.io")
+	assert.Equal(t, meta.NextCursor, "")
+
+	f.Sort = "id"
+	_, _, err = app.Models.UserAccount.List(f)
+	assert.NotEqual(t, err, nil)
+
+	// every user has a created_at to page by
+	_, err = app.Migrations.DB.Exec(`update user_account set created_at = null where email = 'ann@acme.io'`)
+	assert.NotEqual(t, err, nil)
+
+	out, code := DoRequest(app, []byte(``), "/v1/user-accounts?page_size=2&sort=-created_at", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "metadata.last_page").Int(), int64(2))
+
+	_, code = DoRequest(app, []byte(``), "/v1/user-accounts?sort=password", "", http.MethodGet)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/api"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// doRequestIfMatch is DoRequest with an If-Match header, it also returns the ETag
+func doRequestIfMatch(app *api.Application, json []byte, url string, token string, method string, ifMatch string) (*bytes.Buffer, int, string) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(json))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	app.Routes().ServeHTTP(w, req)
+	return w.Body, w.Code, w.Header().Get("ETag")
+}
+
+func TestUpdateProfile(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Name: "Ann", Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	// Add persists the name
+	got, err := app.Models.UserAccount.Get(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, got.Name, "Ann")
+
+	token, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	_, code, etag := doRequestIfMatch(app, []byte(``), "/v1/users/me", token.Plaintext, http.MethodGet, "")
+	assert.Equal(t, code, http.StatusOK)
+
+	out, code, next := doRequestIfMatch(app, []byte(`{"name": "Ann Lee"}`), "/v1/users/me", token.Plaintext, http.MethodPatch, etag)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.name").Str, "Ann Lee")
+	assert.NotEqual(t, next, etag)
+
+	// a stale version is an edit conflict
+	_, code, _ = doRequestIfMatch(app, []byte(`{"name": "Ann"}`), "/v1/users/me", token.Plaintext, http.MethodPatch, etag)
+	assert.Equal(t, code, http.StatusConflict)
+
+	// users can not change their own role
+	_, code, _ = doRequestIfMatch(app, []byte(`{"role": "admin"}`), "/v1/users/me", token.Plaintext, http.MethodPatch, "")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	// a new email is pending until it is confirmed with the token sent to it
+	out, code, _ = doRequestIfMatch(app, []byte(`{"email": "ann@c"}`), "/v1/users/me", token.Plaintext, http.MethodPatch, "")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.email").Str, "a@b")
+	assert.Equal(t, gjson.Get(out.String(), "user.pending_email").Str, "ann@c")
+
+	sent, ok := app.Notifier.(*testNotifier).last("ann@c")
+	assert.Equal(t, ok, true)
+	confirm := sent.body[strings.LastIndex(sent.body, " ")+1:]
+
+	_, code, _ = doRequestIfMatch(app, []byte(`{"token": "sme_AAAAAAAAAAAAAAAAAAAAAAAAAA"}`), "/v1/users/me/email", token.Plaintext, http.MethodPut, "")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	out, code, _ = doRequestIfMatch(app, []byte(`{"token": "`+confirm+`"}`), "/v1/users/me/email", token.Plaintext, http.MethodPut, "")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.email").Str, "ann@c")
+
+	// an address the confirmation can not be sent to is not left pending
+	app.Notifier.(*testNotifier).fail = errors.New("mailbox unavailable")
+	_, code, _ = doRequestIfMatch(app, []byte(`{"email": "ann@d"}`), "/v1/users/me", token.Plaintext, http.MethodPatch, "")
+	assert.Equal(t, code, http.StatusBadRequest)
+	app.Notifier.(*testNotifier).fail = nil
+	out, code, _ = doRequestIfMatch(app, nil, "/v1/users/me", token.Plaintext, http.MethodGet, "")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.email").Str, "ann@c")
+	assert.Equal(t, gjson.Get(out.String(), "user.pending_email").Str, "")
+
+	// admins can change the role of a user
+	out, code, _ = doRequestIfMatch(app, []byte(`{"role": "admin"}`), "/v1/users/"+gjson.Get(out.String(), "user.id").Raw, adminToken.Plaintext, http.MethodPatch, "")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.role").Str, "admin")
+
+	app.Migrations.DoMigrations("down")
+}
+
+func TestChangePassword(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	token, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	other, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	_, code := DoRequest(app, []byte(`{"current_password": "wrong12345", "new_password": "xyz987654"}`), "/v1/users/me/password", token.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	_, code = DoRequest(app, []byte(`{"current_password": "abc123456", "new_password": "short"}`), "/v1/users/me/password", token.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	_, code = DoRequest(app, []byte(`{"current_password": "abc123456", "new_password": "xyz987654"}`), "/v1/users/me/password", token.Plaintext, http.MethodPut)
+	assert.Equal(t, code, http.StatusOK)
+
+	// every other session is signed out, the one that made the change is kept
+	_, err = app.Models.UserAccount.GetForToken(data.ScopeLogin, other.Plaintext)
+	assert.NotEqual(t, err, nil)
+	_, code = DoRequest(app, []byte(``), "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+
+	_, ok := app.Notifier.(*testNotifier).last("a@b")
+	assert.Equal(t, ok, true)
+
+	// the new password is required to log in
+	_, code = DoRequest(app, []byte(`{"email": "a@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	_, code = DoRequest(app, []byte(`{"email": "a@b", "password": "xyz987654"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+
+	app.Migrations.DoMigrations("down")
+}
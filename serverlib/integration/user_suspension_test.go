@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestSuspendUser(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	admin := &data.UserAccount{Email: "admin@b", Role: "admin", Team: &data.Team{Name: "aces"}}
+	admin.Password.Set("abc123456")
+	err = app.Models.UserAccount.Add(admin)
+	assert.Equal(t, err, nil)
+
+	token, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+	adminToken, err := app.Models.Token.New(admin.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	url := fmt.Sprintf("/v1/users/%d", user.ID)
+
+	// only admins may suspend
+	_, code := DoRequest(app, []byte(`{"reason": "left"}`), url+"/suspend", token.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	_, code = DoRequest(app, []byte(`{}`), url+"/suspend", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	out, code := DoRequest(app, []byte(`{"reason": "left the company"}`), url+"/suspend", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.suspension.reason").Str, "left the company")
+	assert.Equal(t, gjson.Get(out.String(), "user.suspension.suspended_by").Int(), admin.ID)
+
+	// existing tokens and new logins are blocked
+	_, code = DoRequest(app, []byte(``), "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusForbidden)
+	_, code = DoRequest(app, []byte(`{"email": "a@b", "password": "abc123456"}`), "/v1/tokens/authentication", "", http.MethodPost)
+	assert.Equal(t, code, http.StatusForbidden)
+	_, err = app.Models.Token.New(user.ID, time.Hour, data.ScopeRO)
+	assert.NotEqual(t, err, nil)
+
+	// team membership is kept
+	got, err := app.Models.UserAccount.Get(user.ID)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, got.Team.Name, "aces")
+	assert.Equal(t, got.IsSuspended(), true)
+
+	_, code = DoRequest(app, []byte(``), url+"/reactivate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+	_, code = DoRequest(app, []byte(``), url+"/reactivate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	_, code = DoRequest(app, []byte(``), "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+
+	// a suspension with a reactivation time ends by itself
+	err = app.Models.UserAccount.Suspend(user.ID, admin.ID, "on leave", nil)
+	assert.Equal(t, err, nil)
+	_, err = app.Migrations.DB.Exec("update user_account set reactivate_at = now() - interval '1 minute' where id = $1", user.ID)
+	assert.Equal(t, err, nil)
+	_, code = DoRequest(app, []byte(``), "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+
+	out, code = DoRequest(app, []byte(``), url+"/suspensions", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "suspensions.#").Int(), int64(3))
+	assert.Equal(t, gjson.Get(out.String(), "suspensions.0.action").Str, "suspend")
+
+	// deleting a user deactivates it, the account and its history are kept
+	_, code = DoRequest(app, []byte(`{"email": "admin@b"}`), "/v1/users", adminToken.Plaintext, http.MethodDelete)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	out, code = DoRequest(app, []byte(`{"email": "a@b"}`), "/v1/users", adminToken.Plaintext, http.MethodDelete)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.suspension.reason").Str, "account deleted")
+	_, code = DoRequest(app, []byte(``), "/v1/users/me", token.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusForbidden)
+	out, code = DoRequest(app, []byte(``), url+"/suspensions", adminToken.Plaintext, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "suspensions.#").Int(), int64(4))
+	_, code = DoRequest(app, []byte(``), url+"/reactivate", adminToken.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusOK)
+
+	app.Migrations.DoMigrations("down")
+}
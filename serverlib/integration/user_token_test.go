@@ -3,10 +3,12 @@ package main
 import (
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/data"
 	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 
@@ -200,11 +202,34 @@ func TestToken(t *testing.T) {
 		{
 			user:     "a@b",
 			team:     &data.Team{Name: "aces"},
-			password: "abcdef133",
+			password: "abcdef123",
 			code:     http.StatusCreated,
-			expect:   "user",
+			expect:   "authentication_token",
 			in:       []byte(`{"email":"a@b", "password":"abcdef123"}`),
 		},
+		{
+			user:     "c@b",
+			team:     &data.Team{Name: "aces"},
+			password: "abcdef133",
+			code:     http.StatusUnauthorized,
+			expect:   "invalid credentials",
+			in:       []byte(`{"email":"c@b", "password":"abcdef123"}`),
+		},
+		{
+			// an account without a password can not log in with any password
+			user:   "d@b",
+			team:   &data.Team{Name: "aces"},
+			code:   http.StatusUnauthorized,
+			expect: "invalid credentials",
+			in:     []byte(`{"email":"d@b", "password":"abcdef123"}`),
+		},
+		{
+			user:   "e@b",
+			team:   &data.Team{Name: "aces"},
+			code:   http.StatusBadRequest,
+			expect: "errors",
+			in:     []byte(`{"email":`),
+		},
 	}
 	mockAuth := true
 	app := setup(mockAuth)
@@ -216,11 +241,43 @@ func TestToken(t *testing.T) {
 			Activated: true,
 			Team:      &data.Team{Name: tcase.team.Name},
 		}
+		if tcase.password != "" {
+			userAdd.Password.Set(tcase.password)
+		}
 		err := app.Models.UserAccount.Add(userAdd)
 		assert.Equal(t, err, nil)
 		out, code := DoRequest(app, tcase.in, "/v1/tokens/authentication", "", http.MethodPost)
 		t.Log(out.String())
 		assert.Equal(t, code, tcase.code)
+		assert.Equal(t, strings.Contains(out.String(), tcase.expect), true)
+		// a rejected request writes a single response
+		assert.Equal(t, gjson.Valid(out.String()), true)
 	}
 	app.Migrations.DoMigrations("down")
 }
+
+func TestPersonalAccessToken(t *testing.T) {
+
+	mockAuth := false
+	app := setup(mockAuth)
+
+	user := &data.UserAccount{Email: "a@b", Role: "user", Team: &data.Team{Name: "aces"}}
+	user.Password.Set("abc123456")
+	err := app.Models.UserAccount.Add(user)
+	assert.Equal(t, err, nil)
+
+	token, err := app.Models.Token.New(user.ID, time.Hour, data.ScopeLogin)
+	assert.Equal(t, err, nil)
+
+	out, code := DoRequest(app, []byte(`{"ttl_hours": 1}`), "/v1/tokens/personal", token.Plaintext, http.MethodPost)
+	assert.Equal(t, code, http.StatusCreated)
+	pat := gjson.Get(out.String(), "personal_access_token.plain_text").Str
+	assert.Equal(t, strings.HasPrefix(pat, "smr_"), true)
+
+	// personal access tokens authenticate like the login that created them
+	out, code = DoRequest(app, nil, "/v1/users/me", pat, http.MethodGet)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, gjson.Get(out.String(), "user.email").Str, "a@b")
+
+	app.Migrations.DoMigrations("down")
+}
@@ -0,0 +1,431 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/lib/pq"
+)
+
+// the kinds of entity attributes are defined for
+const (
+	AttributeUser = "user"
+	AttributeTeam = "team"
+)
+
+// the types an attribute can hold, enum attributes hold one of the definition's values
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+)
+
+// maxAttributeLength is the longest string an attribute can hold
+const maxAttributeLength = 500
+
+// Attributes are the typed key/value fields of a UserAccount or Team, stored as jsonb.
+// Numbers are float64 once read back, as with any json.
+type Attributes map[string]interface{}
+
+// Value stores Attributes as a json object
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(a)
+}
+
+// Scan reads Attributes from a jsonb column
+func (a *Attributes) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*a = Attributes{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("unable to scan %T into attributes", src)
+	}
+	*a = Attributes{}
+	return json.Unmarshal(b, a)
+}
+
+// AttributeDefinition is the schema of an attribute that can be set on every UserAccount or
+// every Team, depending on its Kind
+type AttributeDefinition struct {
+	ID          int64     `json:"id"`
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Required    bool      `json:"required"`
+	Values      []string  `json:"values,omitempty"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AttributeClaims are the attributes of a UserAccount and of each of its Teams, by team name.
+// They are evaluated by policy conditions and included in the claims of issued tokens.
+type AttributeClaims struct {
+	User  Attributes            `json:"user"`
+	Teams map[string]Attributes `json:"teams"`
+}
+
+// AttributeModel wraps the connection pool
+type AttributeModel struct {
+	DB *sql.DB
+}
+
+func ValidateAttributeKind(v *validator.Validator, kind string) {
+	v.Check(kind == AttributeUser || kind == AttributeTeam, "kind", "must be one of user or team")
+}
+
+func ValidateAttributeDefinition(v *validator.Validator, def *AttributeDefinition) {
+	ValidateAttributeKind(v, def.Kind)
+	v.Check(def.Name != "", "name", "must be provided")
+	v.Check(len(def.Name) <= 100, "name", "must be less than 100 bytes (chars) long")
+	v.Check(strings.Trim(def.Name, "abcdefghijklmnopqrstuvwxyz0123456789_") == "", "name", "must only contain a-z, 0-9 and _")
+	v.Check(len(def.Description) <= 500, "description", "must be less than 500 bytes (chars) long")
+
+	switch def.Type {
+	case AttributeString, AttributeNumber, AttributeBoolean:
+		v.Check(len(def.Values) == 0, "values", "must only be provided for enum attributes")
+	case AttributeEnum:
+		v.Check(len(def.Values) > 0, "values", "must be provided for enum attributes")
+		for _, value := range def.Values {
+			v.Check(value != "", "values", "must not be empty")
+			v.Check(len(value) <= maxAttributeLength, "values", fmt.Sprintf("must be less than %d bytes (chars) long", maxAttributeLength))
+		}
+	default:
+		v.AddError("type", "must be one of string, number, boolean or enum")
+	}
+}
+
+// ValidateAttributes checks attrs against the definitions for their kind, every attribute
+// must be defined and required attributes must be set
+func ValidateAttributes(v *validator.Validator, defs []*AttributeDefinition, attrs Attributes) {
+	byName := map[string]*AttributeDefinition{}
+	for _, def := range defs {
+		byName[def.Name] = def
+		if _, ok := attrs[def.Name]; def.Required && !ok {
+			v.AddError("attributes."+def.Name, "must be provided")
+		}
+	}
+
+	for name, value := range attrs {
+		key := "attributes." + name
+		def, ok := byName[name]
+		if !ok {
+			v.AddError(key, "is not a defined attribute")
+			continue
+		}
+
+		switch def.Type {
+		case AttributeString:
+			s, ok := value.(string)
+			v.Check(ok, key, "must be a string")
+			v.Check(len(s) <= maxAttributeLength, key, fmt.Sprintf("must be less than %d bytes (chars) long", maxAttributeLength))
+		case AttributeNumber:
+			_, ok := value.(float64)
+			v.Check(ok, key, "must be a number")
+		case AttributeBoolean:
+			_, ok := value.(bool)
+			v.Check(ok, key, "must be true or false")
+		case AttributeEnum:
+			s, _ := value.(string)
+			v.Check(validator.In(s, def.Values...), key, "must be one of "+strings.Join(def.Values, ", "))
+		}
+	}
+}
+
+// Define creates or replaces an AttributeDefinition. A redefinition is refused while any
+// UserAccount or Team holds a value the new definition does not allow, so policy conditions
+// never evaluate values that are no longer valid. A newly required attribute is checked the
+// next time each one's attributes are written, until then a condition on it does not hold.
+func (m AttributeModel) Define(def *AttributeDefinition) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		insert into attribute_definition(kind, name, type, required, enum_values, description, created_at)
+		values ($1, $2, $3, $4, $5, nullif($6, ''), now())
+		on conflict (kind, name)
+		do update set type = excluded.type
+					, required = excluded.required
+					, enum_values = excluded.enum_values
+					, description = excluded.description
+		returning 	id, created_at
+	`
+	args := []interface{}{def.Kind, def.Name, def.Type, def.Required, pq.Array(def.Values), def.Description}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&def.ID, &def.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	n, err := countInvalidAttributes(ctx, tx, def)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("invalid stored values: stored values of %s.%s do not match the new definition, %d to update", def.Kind, def.Name, n)
+	}
+	return tx.Commit()
+}
+
+// countInvalidAttributes counts the users or teams holding a value of an attribute that does
+// not match its definition, as ValidateAttributes would check it
+func countInvalidAttributes(ctx context.Context, tx *sql.Tx, def *AttributeDefinition) (int, error) {
+	args := []interface{}{def.Name}
+	var invalid string
+	switch def.Type {
+	case AttributeString:
+		invalid = fmt.Sprintf(`jsonb_typeof(attributes -> $1::text) <> 'string' or length(attributes ->> $1::text) > %d`, maxAttributeLength)
+	case AttributeNumber:
+		invalid = `jsonb_typeof(attributes -> $1::text) <> 'number'`
+	case AttributeBoolean:
+		invalid = `jsonb_typeof(attributes -> $1::text) <> 'boolean'`
+	case AttributeEnum:
+		invalid = `jsonb_typeof(attributes -> $1::text) <> 'string' or not (attributes ->> $1::text = any($2::text[]))`
+		args = append(args, pq.Array(def.Values))
+	default:
+		return 0, fmt.Errorf("invalid attribute type %s", def.Type)
+	}
+
+	held := `
+		select 		attributes
+		from 		user_account
+		where 		erased_at is null
+	`
+	if def.Kind == AttributeTeam {
+		held = `
+			select 		tm.attributes
+			from 		team as t
+			inner join 	team_meta as tm
+			on 			tm.id = t.team_meta_id
+			where 		t.deleted_at is null
+		`
+	}
+	query := `
+		select 		count(*)
+		from 		(` + held + `) as held
+		where 		attributes ? $1 and (` + invalid + `)
+	`
+	var n int
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+// List returns the AttributeDefinitions of a kind, ordered by name
+func (m AttributeModel) List(kind string) ([]*AttributeDefinition, error) {
+	query := `
+		select 		id, kind, name, type, required, coalesce(enum_values, '{}'), coalesce(description, ''), created_at
+		from 		attribute_definition
+		where 		kind = $1
+		order by 	name
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	rows, err := m.DB.QueryContext(ctx, query, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	defs := []*AttributeDefinition{}
+	for rows.Next() {
+		var def AttributeDefinition
+		err := rows.Scan(&def.ID, &def.Kind, &def.Name, &def.Type, &def.Required, pq.Array(&def.Values), &def.Description, &def.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, &def)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// Delete removes an AttributeDefinition and the attribute from every UserAccount or Team
+func (m AttributeModel) Delete(kind string, name string) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		delete from attribute_definition
+		where 		kind = $1 and name = $2
+	`
+	result, err := tx.ExecContext(ctx, query, kind, name)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no record found: attribute %s.%s", kind, name)
+	}
+
+	query = `
+		update 		user_account
+		set 		attributes = attributes - $1
+		where 		attributes ? $1
+	`
+	if kind == AttributeTeam {
+		query = `
+			update 		team_meta
+			set 		attributes = attributes - $1
+			where 		attributes ? $1
+		`
+	}
+	if _, err = tx.ExecContext(ctx, query, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetForUser replaces the attributes of a UserAccount
+func (m AttributeModel) SetForUser(userID int64, attrs Attributes) error {
+	query := `
+		update 		user_account
+		set 		attributes = $1, version = version + 1
+		where 		id = $2
+		returning 	id
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, attrs, userID).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SetForTeam replaces the attributes of a Team, kept in its team_meta
+func (m AttributeModel) SetForTeam(teamID int64, attrs Attributes) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	metaID, err := ensureTeamMeta(ctx, tx, teamID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		update 		team_meta
+		set 		attributes = $1, version = version + 1
+		where 		id = $2
+	`
+	if _, err = tx.ExecContext(ctx, query, attrs, metaID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Claims returns the attributes of a UserAccount and of the Teams it is a member of
+func (m AttributeModel) Claims(userID int64) (*AttributeClaims, error) {
+	query := `
+		select 		'', ua.attributes
+		from 		user_account as ua
+		where 		ua.id = $1
+		union all
+		select 		t.name, coalesce(tm.attributes, '{}')
+		from 		users_teams as ut
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		left join 	team_meta as tm
+		on 			tm.id = t.team_meta_id
+		where 		ut.user_account_id = $1
+		and 		t.deleted_at is null
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := &AttributeClaims{User: Attributes{}, Teams: map[string]Attributes{}}
+	for rows.Next() {
+		var team string
+		var attrs Attributes
+		if err := rows.Scan(&team, &attrs); err != nil {
+			return nil, err
+		}
+		if team == "" {
+			claims.User = attrs
+		} else {
+			claims.Teams[team] = attrs
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Flatten returns the claims as policy conditions see them, user.<name> for the attributes
+// of the UserAccount and team.<name> for those of its Teams, with one value per Team
+func (c *AttributeClaims) Flatten() map[string][]string {
+	flat := map[string][]string{}
+	for name, value := range c.User {
+		flat["user."+name] = append(flat["user."+name], attributeString(value))
+	}
+	for _, attrs := range c.Teams {
+		for name, value := range attrs {
+			flat["team."+name] = append(flat["team."+name], attributeString(value))
+		}
+	}
+	return flat
+}
+
+// attributeString is the text form of an attribute value that conditions compare against
+func attributeString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+// ImpersonationEvent is a request made by an admin, the actor, while impersonating a
+// UserAccount. The request that started the impersonation carries its reason.
+type ImpersonationEvent struct {
+	ID            int64     `json:"id"`
+	ActorID       int64     `json:"actor_id"`
+	UserAccountID int64     `json:"user_account_id"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Status        int       `json:"status"`
+	IP            string    `json:"ip"`
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ImpersonationModel wraps the connection pool
+type ImpersonationModel struct {
+	DB *sql.DB
+}
+
+func ValidateImpersonation(v *validator.Validator, reason string, ttl time.Duration) {
+	v.Check(reason != "", "reason", "must be provided")
+	v.Check(len(reason) <= 500, "reason", "must be less than 500 bytes (chars) long")
+	v.Check(ttl > 0, "ttl_minutes", "must be greater than zero")
+	v.Check(ttl <= time.Hour, "ttl_minutes", "must not be more than 60")
+}
+
+// Start issues an impersonation token acting as userID on behalf of actorID and records
+// start as the first event of the impersonation. Users who administer something, by their
+// role, an organization or team, or an assigned role, can not be impersonated, nor can
+// suspended users.
+func (m ImpersonationModel) Start(actorID int64, userID int64, ttl time.Duration, start *ImpersonationEvent) (*Token, error) {
+	if actorID == userID {
+		return nil, errors.New("invalid impersonation: an admin can not impersonate themselves")
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	query := `
+		select 		ua.role, ` + privilegedUser + `
+		from 		user_account as ua
+		where 		ua.id = $1 and ua.erased_at is null
+	`
+	var role string
+	var privileged bool
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&role, &privileged)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	if role == "admin" || role == RoleService || role == RoleSCIM {
+		return nil, fmt.Errorf("invalid impersonation: %s accounts can not be impersonated", role)
+	}
+	if privileged {
+		return nil, errors.New("invalid impersonation: administrators can not be impersonated")
+	}
+	if err = checkSuspended(ctx, m.DB, userID); err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, ttl, ScopeImpersonation)
+	if err != nil {
+		return nil, err
+	}
+	token.ActorID = actorID
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query = `
+		insert into token(hash, user_account_id, expiry, scope, mfa, actor_id)
+		values ($1, $2, $3, $4, false, $5)
+	`
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserAccountID, token.Expiry, token.Scope, token.ActorID)
+	if err != nil {
+		return nil, err
+	}
+
+	start.ActorID, start.UserAccountID = actorID, userID
+	if err = logImpersonation(ctx, tx, start); err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// Log records a request made under impersonation
+func (m ImpersonationModel) Log(event *ImpersonationEvent) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	return logImpersonation(ctx, m.DB, event)
+}
+
+// History returns the impersonation events in which a UserAccount was the actor or the
+// user impersonated, most recent first
+func (m ImpersonationModel) History(userID int64) ([]*ImpersonationEvent, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	return impersonationHistory(ctx, m.DB, userID)
+}
+
+func impersonationHistory(ctx context.Context, q querier, userID int64) ([]*ImpersonationEvent, error) {
+	query := `
+		select 		id, coalesce(actor_id, 0), coalesce(user_account_id, 0), method, path, status, coalesce(ip, ''), coalesce(reason, ''), created_at
+		from 		impersonation_log
+		where 		user_account_id = $1 or actor_id = $1
+		order by 	created_at desc, id desc
+	`
+	rows, err := q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*ImpersonationEvent{}
+	for rows.Next() {
+		var e ImpersonationEvent
+		err := rows.Scan(&e.ID, &e.ActorID, &e.UserAccountID, &e.Method, &e.Path, &e.Status, &e.IP, &e.Reason, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func logImpersonation(ctx context.Context, q querier, e *ImpersonationEvent) error {
+	query := `
+		insert into impersonation_log(actor_id, user_account_id, method, path, status, ip, reason, created_at)
+		values ($1, $2, $3, $4, $5, nullif($6, ''), nullif($7, ''), now())
+		returning id, created_at
+	`
+	args := []interface{}{e.ActorID, e.UserAccountID, e.Method, e.Path, e.Status, e.IP, e.Reason}
+	return q.QueryRowContext(ctx, query, args...).Scan(&e.ID, &e.CreatedAt)
+}
@@ -0,0 +1,217 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// the ways a user can authenticate
+const (
+	LoginPassword = "password"
+)
+
+// the outcomes of an authentication attempt
+const (
+	LoginSucceeded          = "succeeded"
+	LoginInvalidCredentials = "invalid_credentials"
+	LoginSuspended          = "account_suspended"
+	LoginFailed             = "failed"
+)
+
+// LoginEvent is an attempt to authenticate as a UserAccount, successful or not. Attempts
+// with an email matching no UserAccount are not recorded. UserAccountID is zero once the
+// UserAccount has been deleted, the event is kept until it is purged.
+type LoginEvent struct {
+	ID            int64     `json:"id"`
+	UserAccountID int64     `json:"user_account_id,omitempty"`
+	Email         string    `json:"email"`
+	Method        string    `json:"method"`
+	Outcome       string    `json:"outcome"`
+	IP            string    `json:"ip"`
+	UserAgent     string    `json:"user_agent"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Session is an unexpired login Token of a UserAccount, described by the login that issued
+// it. Current marks the session the request was made with.
+type Session struct {
+	ID        int64      `json:"id"`
+	Audience  string     `json:"audience,omitempty"`
+	MFA       bool       `json:"mfa"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"user_agent"`
+	CreatedAt *time.Time `json:"created_at"`
+	Expiry    time.Time  `json:"expiry"`
+	Current   bool       `json:"current"`
+}
+
+// LoginModel wraps the connection pool
+type LoginModel struct {
+	DB *sql.DB
+}
+
+// Record adds a LoginEvent to the login history. The session started by a successful login
+// is passed as token so it can be listed with where it was started from.
+func (m LoginModel) Record(event *LoginEvent, token *Token) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		insert into login_event(user_account_id, email, method, outcome, ip, user_agent, created_at)
+		values (nullif($1, 0), $2, $3, $4, nullif($5, ''), nullif($6, ''), now())
+		returning id, created_at
+	`
+	args := []interface{}{event.UserAccountID, event.Email, event.Method, event.Outcome, event.IP, truncate(event.UserAgent, 500)}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if token != nil {
+		query = `
+			update 		token
+			set 		login_event_id = $1
+			where 		hash = $2
+		`
+		if _, err = tx.ExecContext(ctx, query, event.ID, token.Hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// History returns the most recent LoginEvents of a UserAccount, most recent first
+func (m LoginModel) History(userID int64) ([]*LoginEvent, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	return loginHistory(ctx, m.DB, userID)
+}
+
+// Sessions returns the unexpired login Tokens of a UserAccount, most recent first. current
+// is the hash of the Token the request was made with.
+func (m LoginModel) Sessions(userID int64, current []byte) ([]*Session, error) {
+	query := `
+		select 		t.id, coalesce(t.audience, ''), t.mfa, coalesce(le.ip, ''), coalesce(le.user_agent, '')
+					, le.created_at, t.expiry, t.hash = $2
+		from 		token as t
+		left join 	login_event as le
+		on 			le.id = t.login_event_id
+		where 		t.user_account_id = $1
+		and 		t.scope = $3
+		and 		t.expiry > now()
+		order by 	le.created_at desc nulls last, t.id desc
+	`
+	if current == nil {
+		current = []byte{}
+	}
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, current, ScopeLogin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.Audience, &s.MFA, &s.IP, &s.UserAgent, &s.CreatedAt, &s.Expiry, &s.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession removes a login Token of a UserAccount, ending the session
+func (m LoginModel) RevokeSession(userID int64, sessionID int64) error {
+	query := `
+		delete from token
+		where 		id = $1
+		and 		user_account_id = $2
+		and 		scope = $3
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	res, err := m.DB.ExecContext(ctx, query, sessionID, userID, ScopeLogin)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no record found: session %d", sessionID)
+	}
+	return nil
+}
+
+func loginHistory(ctx context.Context, q querier, userID int64) ([]*LoginEvent, error) {
+	query := `
+		select 		id, coalesce(user_account_id, 0), email, method, outcome, coalesce(ip, ''), coalesce(user_agent, ''), created_at
+		from 		login_event
+		where 		user_account_id = $1
+		order by 	created_at desc, id desc
+		limit 		500
+	`
+	rows, err := q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*LoginEvent{}
+	for rows.Next() {
+		var e LoginEvent
+		err := rows.Scan(&e.ID, &e.UserAccountID, &e.Email, &e.Method, &e.Outcome, &e.IP, &e.UserAgent, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Purge deletes the LoginEvents older than retention, including those of deleted users,
+// and returns how many were deleted. Sessions started by them are kept.
+func (m LoginModel) Purge(retention time.Duration) (int64, error) {
+	query := `
+		delete from login_event
+		where 		created_at < $1
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	res, err := m.DB.ExecContext(ctx, query, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -19,33 +19,262 @@ type Models struct {
 		GetByEmail(email string) (*UserAccount, error)
 		// GetForToken returns a UserAccount for a given tokenScope
 		GetForToken(tokenScope string, token string) (*UserAccount, error)
+		// GetForAudience returns a UserAccount for a token issued to the server at audience
+		GetForAudience(tokenScope string, token string, audience string) (*UserAccount, error)
 		// Update updates a UserAccount entity 
 		Update(*UserAccount) error
+		// UpdateWithEmailChange updates a UserAccount and issues the token confirming its
+		// pending email
+		UpdateWithEmailChange(user *UserAccount, ttl time.Duration) (*Token, error)
+		// CancelEmailChange drops the pending email of a UserAccount
+		CancelEmailChange(userID int64) error
+		// ConfirmEmail makes the pending email of a UserAccount its email
+		ConfirmEmail(userID int64, token string) error
+		// List returns a page of the UserAccounts matching a UserFilter
+		List(f UserFilter) ([]*UserAccount, Metadata, error)
+		// Suspend blocks a UserAccount from authenticating, optionally until reactivateAt
+		Suspend(userID int64, actorID int64, reason string, reactivateAt *time.Time) error
+		// Reactivate lifts the suspension of a UserAccount
+		Reactivate(userID int64, actorID int64) error
+		// GetSuspensionHistory returns the suspensions and reactivations of a UserAccount
+		GetSuspensionHistory(userID int64) ([]*SuspensionEvent, error)
+		// Export returns everything stored about a UserAccount
+		Export(userID int64) (*UserExport, error)
+		// RequestErasure schedules a UserAccount to be erased once grace has passed
+		RequestErasure(userID int64, grace time.Duration) (*Erasure, error)
+		// CancelErasure cancels a pending erasure of a UserAccount
+		CancelErasure(userID int64) error
+		// Erase pseudonymizes the UserAccounts whose erasure grace period has passed
+		Erase(grace time.Duration) (int64, error)
+		// Import adds UserAccounts in bulk, reporting the outcome of each
+		Import(users []*UserAccount, atomic bool, dryRun bool) ([]*ImportResult, error)
+		// AddImportJob records an import run in the background as running
+		AddImportJob(job *ImportJob) error
+		// FinishImportJob records the outcome of an import run in the background
+		FinishImportJob(job *ImportJob) error
+		// GetImportJob returns an import run in the background with its results
+		GetImportJob(id int64) (*ImportJob, error)
+		// PurgeImportJobs deletes the imports run in the background older than retention
+		PurgeImportJobs(retention time.Duration) (int64, error)
+		// Records returns a UserRecord for every team membership, or those of one Team
+		Records(teamID int64) ([]*UserRecord, error)
 	}
 	Token interface {
 		// New creates a new Token
 		New(userID int64, ttl time.Duration, scope string) (*Token, error)
+		// NewForAudience creates a new Token accepted only by the server at audience
+		NewForAudience(userID int64, ttl time.Duration, scope string, audience string) (*Token, error)
 		// Add inserts a Token into the database
 		Add(token *Token) (error)
 		// DeleteAllForUser removes all tokens for a UserAccount ID
 		DeleteAllForUser(scope string, userID int64) error
+		// DeleteAllForUserExcept removes all tokens for a UserAccount ID apart from one
+		DeleteAllForUserExcept(userID int64, keep []byte) error
 	}
 	Permission interface {
+		// GetForUser loads permissions for a given UserAccount ID
 		GetForUser(userID int64) (Permissions, error)
+		// Can checks whether a UserAccount may take an action on a team or organization
+		Can(userID int64, obj string, act string) (bool, error)
+		// Decide checks whether a UserAccount may take act on obj and returns the matching rule
+		Decide(userID int64, obj string, act string, env *permission.Env) (*Decision, error)
+		// Explain traces the decision for a UserAccount and permission code
+		Explain(userID int64, code string, env *permission.Env) (*Explanation, error)
+		// DryRun evaluates permission codes for UserAccounts before and after proposed changes
+		DryRun(userIDs []int64, codes []string, changes []permission.Change, env *permission.Env) ([]*DryRunResult, error)
+		// Refresh reloads the policy when another replica has changed it
+		Refresh() error
 	}
 	Team interface {
 		Add(team *Team) error
 		Get(id int64) (*Team, error)
 		Update(team *Team) error
+		// Stranded returns the members that do not belong to any other active Team
+		Stranded(teamID int64) ([]*UserAccount, error)
+		// Delete soft deletes a Team, moving stranded members into reassignTo
+		Delete(teamID int64, reassignTo int64) error
+		// Restore brings back a soft deleted Team within its grace period
+		Restore(teamID int64, grace time.Duration) error
+		// Purge permanently removes Teams soft deleted longer ago than grace
+		Purge(grace time.Duration) (int64, error)
+		// TransferOwnership makes a member of the Team its owner
+		TransferOwnership(teamID int64, userID int64) error
+		// AddMember adds a UserAccount to the Team within its seat limits
+		AddMember(teamID int64, user *UserAccount, isAdmin bool) error
+		// RemoveMember removes a UserAccount from the Team
+		RemoveMember(teamID int64, userID int64) error
+	}
+	Quota interface {
+		// Get returns the Quota for a Team
+		Get(teamID int64) (*Quota, error)
+		// Set creates or replaces the Quota for a Team
+		Set(q *Quota) error
+		// Usage returns the Team's usage against each of its limits
+		Usage(teamID int64) (*QuotaUsage, error)
+	}
+	Server interface {
+		// Register enrols a sql-manager server for a Team
+		Register(server *Server) error
+		// GetForTeam returns the Server registered for a Team
+		GetForTeam(teamID int64) (*Server, error)
+		// GetForMember returns the Server registered for a Team the user belongs to
+		GetForMember(teamID int64, userID int64) (*Server, error)
+		// GetForServiceAccount returns the Server a service account acts for
+		GetForServiceAccount(userID int64) (*Server, error)
+	}
+	Secret interface {
+		// Put creates or replaces a Secret for a Team, recording access in the audit trail
+		Put(secret *Secret, access *SecretAccess) error
+		// Get returns a Secret, including its ciphertext
+		Get(teamID int64, name string) (*Secret, error)
+		// List returns the Secrets for a Team without their ciphertext
+		List(teamID int64) ([]*Secret, error)
+		// Delete removes a Secret from a Team, recording access in the audit trail
+		Delete(teamID int64, name string, access *SecretAccess) error
+		// LogAccess records an access in the secret audit trail
+		LogAccess(access *SecretAccess) error
+		// GetAccessLog returns the secret audit trail for a Team
+		GetAccessLog(teamID int64) ([]*SecretAccess, error)
+	}
+	Role interface {
+		// Add adds a Role to the database
+		Add(role *Role) error
+		// Get returns a Role and its permissions
+		Get(name string) (*Role, error)
+		// List returns every Role and its permissions
+		List() ([]*Role, error)
+		// Delete removes a Role, its policies and its assignments
+		Delete(name string) error
+		// Grant allows a Role to take act on obj when the condition holds
+		Grant(name string, obj string, act string, cond string) error
+		// Revoke removes the policy allowing a Role to take act on obj
+		Revoke(name string, obj string, act string) error
+		// Inherit makes a Role inherit the permissions of parent
+		Inherit(name string, parent string) error
+		// Disinherit stops a Role inheriting the permissions of parent
+		Disinherit(name string, parent string) error
+		// Assign gives a UserAccount a Role on top of its primary role
+		Assign(userID int64, name string) error
+		// Unassign takes an assigned Role away from a UserAccount
+		Unassign(userID int64, name string) error
+		// GetForUser returns the roles held by a UserAccount
+		GetForUser(userID int64) ([]string, error)
+	}
+	Resource interface {
+		// Add registers a Resource for a Team
+		Add(resource *Resource) error
+		// Get returns a Resource from a given ID
+		Get(id int64) (*Resource, error)
+		// GetByPath returns the Resource registered at a path
+		GetByPath(path string) (*Resource, error)
+		// List returns the registered Resources of a kind, or of every kind
+		List(kind string) ([]*Resource, error)
+		// Delete removes a Resource and the policies on its path
+		Delete(id int64) error
+		// Grant allows a user or team to take an action on matching resources
+		Grant(grant *ResourceGrant) error
+		// Revoke removes a ResourceGrant
+		Revoke(grant *ResourceGrant) error
+		// Grants returns the ResourceGrants that apply to a Resource
+		Grants(resource *Resource) ([]*ResourceGrant, error)
+	}
+	Policy interface {
+		// Export returns the roles, policies, teams and role assignments as a document
+		Export() (*PolicyDocument, error)
+		// Import applies the diff between the database and a document in one transaction
+		Import(doc *PolicyDocument, prune bool, dryRun bool) ([]*PolicyChange, error)
+	}
+	Organization interface {
+		// Add adds an Organization to the database
+		Add(org *Organization) error
+		// Get returns an Organization from a given ID
+		Get(id int64) (*Organization, error)
+		// AddAdmin makes a UserAccount an admin of the Organization
+		AddAdmin(orgID int64, userID int64) error
+		// MoveTeam moves a Team into the Organization
+		MoveTeam(teamID int64, orgID int64) error
+		// Tree returns the organization -> team -> user hierarchy visible to a UserAccount
+		Tree(userID int64, all bool) (*OrganizationTree, error)
+	}
+	Attribute interface {
+		// Define creates or replaces an AttributeDefinition
+		Define(def *AttributeDefinition) error
+		// List returns the AttributeDefinitions for UserAccounts or Teams
+		List(kind string) ([]*AttributeDefinition, error)
+		// Delete removes an AttributeDefinition and the values stored for it
+		Delete(kind string, name string) error
+		// SetForUser replaces the attributes of a UserAccount
+		SetForUser(userID int64, attrs Attributes) error
+		// SetForTeam replaces the attributes of a Team
+		SetForTeam(teamID int64, attrs Attributes) error
+		// Claims returns the attributes of a UserAccount and of its Teams
+		Claims(userID int64) (*AttributeClaims, error)
+	}
+	Impersonation interface {
+		// Start issues a token for an admin to act as a UserAccount
+		Start(actorID int64, userID int64, ttl time.Duration, start *ImpersonationEvent) (*Token, error)
+		// Log records a request made under impersonation
+		Log(event *ImpersonationEvent) error
+		// History returns the impersonations a UserAccount took part in
+		History(userID int64) ([]*ImpersonationEvent, error)
+	}
+	SCIM interface {
+		// RegisterClient enrols a SCIM provisioning client and its service account
+		RegisterClient(client *SCIMClient) error
+		// GetClient returns the SCIMClient a service account acts for
+		GetClient(serviceAccountID int64) (*SCIMClient, error)
+		// ListUsers returns a page of the client's users matching a SCIM filter and their total
+		ListUsers(client *SCIMClient, filter string, startIndex int, count int) ([]*ProvisionedUser, int, error)
+		// GetUser returns a user the client provisioned
+		GetUser(client *SCIMClient, id int64) (*ProvisionedUser, error)
+		// CreateUser adds a user to the client's default team
+		CreateUser(client *SCIMClient, user *ProvisionedUser, plaintext string) error
+		// ReplaceUser replaces the attributes of a user at its version
+		ReplaceUser(client *SCIMClient, user *ProvisionedUser, plaintext string) error
+		// DeleteUser suspends a user and requests its erasure
+		DeleteUser(client *SCIMClient, id int64) error
+		// ListGroups returns a page of the client's teams matching a SCIM filter and their total
+		ListGroups(client *SCIMClient, filter string, startIndex int, count int) ([]*ProvisionedGroup, int, error)
+		// GetGroup returns a team of the client and its members
+		GetGroup(client *SCIMClient, id int64) (*ProvisionedGroup, error)
+		// CreateGroup adds a team with its members
+		CreateGroup(client *SCIMClient, group *ProvisionedGroup) error
+		// ReplaceGroup replaces the name and members of a team at its version
+		ReplaceGroup(client *SCIMClient, group *ProvisionedGroup) error
+		// DeleteGroup soft deletes a team
+		DeleteGroup(client *SCIMClient, id int64) error
+	}
+	Login interface {
+		// Record adds an authentication attempt to the login history
+		Record(event *LoginEvent, token *Token) error
+		// History returns the recent authentication attempts of a UserAccount
+		History(userID int64) ([]*LoginEvent, error)
+		// Sessions returns the unexpired login Tokens of a UserAccount
+		Sessions(userID int64, current []byte) ([]*Session, error)
+		// RevokeSession ends a session of a UserAccount
+		RevokeSession(userID int64, sessionID int64) error
+		// Purge deletes the authentication attempts older than the retention
+		Purge(retention time.Duration) (int64, error)
 	}
 }
 
 func NewModels(db *sql.DB) Models {
-	manager := permission.PermissionManager{}
+	manager := permission.New(db)
 	return Models{
 		UserAccountModel{DB: db},
 		TokenModel{DB:db},
 		PermissionModel{Manager: manager, DB: db},
 		TeamModel{DB: db},
+		QuotaModel{DB: db},
+		ServerModel{DB: db},
+		SecretModel{DB: db},
+		RoleModel{Manager: manager, DB: db},
+		ResourceModel{Manager: manager, DB: db},
+		PolicyModel{Manager: manager, DB: db},
+		OrganizationModel{DB: db},
+		AttributeModel{DB: db},
+		ImpersonationModel{DB: db},
+		SCIMModel{DB: db},
+		LoginModel{DB: db},
 	}
 }
@@ -0,0 +1,248 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+// Organization represents the domain for our organization entity, which owns teams
+type Organization struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int       `json:"version"`
+	Teams     []*Team   `json:"teams"`
+}
+
+// OrganizationTree is the full organization -> team -> user hierarchy
+type OrganizationTree struct {
+	Organizations []*Organization `json:"organizations"`
+	Unassigned    []*Team         `json:"unassigned"`
+}
+
+// OrganizationModel wraps the connection pool
+type OrganizationModel struct {
+	DB *sql.DB
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "must be provided")
+	v.Check(len(org.Name) <= 255, "name", "must be less than 255 bytes (chars) long")
+}
+
+// Add adds an Organization into the database
+func (m OrganizationModel) Add(org *Organization) error {
+	query := `
+		insert into organization(name, created_at)
+		values ($1, now())
+		returning id, created_at, version
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, org.Name).Scan(&org.ID, &org.CreatedAt, &org.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate organization: %w", err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the Organization for a given ID
+func (m OrganizationModel) Get(id int64) (*Organization, error) {
+	query := `
+		select 	id, name, created_at, version
+		from 	organization
+		where 	id = $1
+	`
+	var org Organization
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&org.ID, &org.Name, &org.CreatedAt, &org.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	return &org, nil
+}
+
+// AddAdmin makes a UserAccount an admin of the Organization
+func (m OrganizationModel) AddAdmin(orgID int64, userID int64) error {
+	query := `
+		insert into organization_admin(organization_id, user_account_id, created_at)
+		values ($1, $2, now())
+		on conflict (organization_id, user_account_id)
+		do nothing
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	_, err := m.DB.ExecContext(ctx, query, orgID, userID)
+	if err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// MoveTeam moves a Team into the Organization
+func (m OrganizationModel) MoveTeam(teamID int64, orgID int64) error {
+	query := `
+		update 		team
+		set 		organization_id = $1
+					, updated_at = now()
+					, version = version + 1
+		where 		id = $2 and deleted_at is null
+		returning 	version
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	var version int
+	err := m.DB.QueryRowContext(ctx, query, orgID, teamID).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// Tree returns the Organizations a UserAccount administers or has a team in, with their
+// teams and members, along with the user's teams that do not yet belong to an Organization.
+// When all is set every Organization and unassigned team is returned.
+func (m OrganizationModel) Tree(userID int64, all bool) (*OrganizationTree, error) {
+	query := `
+		select 		o.id, o.name, o.created_at, o.version
+					, t.id, t.name, t.created_at, t.version
+					, ua.id, ua.email, ua.role
+		from 		organization as o
+		left join 	team as t
+		on 			t.organization_id = o.id
+		and 		t.deleted_at is null
+		left join 	users_teams as ut
+		on 			ut.team_id = t.id
+		left join 	user_account as ua
+		on 			ua.id = ut.user_account_id
+		where 		$2
+		or 			o.id in (
+						select 		oa.organization_id
+						from 		organization_admin as oa
+						where 		oa.user_account_id = $1
+						union
+						select 		mt.organization_id
+						from 		team as mt
+						inner join 	users_teams as mut
+						on 			mut.team_id = mt.id
+						where 		mut.user_account_id = $1
+						and 		mt.deleted_at is null
+					)
+		union all
+		select 		null, null, null, null
+					, t.id, t.name, t.created_at, t.version
+					, ua.id, ua.email, ua.role
+		from 		team as t
+		left join 	users_teams as ut
+		on 			ut.team_id = t.id
+		left join 	user_account as ua
+		on 			ua.id = ut.user_account_id
+		where 		t.organization_id is null
+		and 		t.deleted_at is null
+		and 		($2 or t.id in (select team_id from users_teams where user_account_id = $1))
+		order by 	1, 5, 9
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tree := &OrganizationTree{Organizations: []*Organization{}, Unassigned: []*Team{}}
+	orgs := map[int64]*Organization{}
+	teams := map[int64]*Team{}
+
+	for rows.Next() {
+		var orgID, orgVersion, teamID, teamVersion, userID sql.NullInt64
+		var orgName, teamName, email, role sql.NullString
+		var orgCreated, teamCreated sql.NullTime
+
+		err = rows.Scan(
+			&orgID, &orgName, &orgCreated, &orgVersion,
+			&teamID, &teamName, &teamCreated, &teamVersion,
+			&userID, &email, &role,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var org *Organization
+		if orgID.Valid {
+			org = orgs[orgID.Int64]
+			if org == nil {
+				org = &Organization{
+					ID:        orgID.Int64,
+					Name:      orgName.String,
+					CreatedAt: orgCreated.Time,
+					Version:   int(orgVersion.Int64),
+					Teams:     []*Team{},
+				}
+				orgs[org.ID] = org
+				tree.Organizations = append(tree.Organizations, org)
+			}
+		}
+
+		if !teamID.Valid {
+			continue
+		}
+		team := teams[teamID.Int64]
+		if team == nil {
+			team = &Team{
+				ID:           teamID.Int64,
+				Name:         teamName.String,
+				CreatedAt:    teamCreated.Time,
+				Version:      int(teamVersion.Int64),
+				UserAccounts: []*UserAccount{},
+			}
+			teams[team.ID] = team
+			if org != nil {
+				team.OrganizationID = org.ID
+				org.Teams = append(org.Teams, team)
+			} else {
+				tree.Unassigned = append(tree.Unassigned, team)
+			}
+		}
+
+		if userID.Valid {
+			team.UserAccounts = append(team.UserAccounts, &UserAccount{ID: userID.Int64, Email: email.String, Role: role.String})
+			team.NumMembers++
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
@@ -1,20 +1,32 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	_ "embed"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	pmanager "github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
 )
 // Permissions contains all permissions for a given role
 type Permissions []string
+// Decision is the outcome of checking whether a subject may take an action on an object
+type Decision struct {
+	Subject string   `json:"subject"`
+	Object  string   `json:"object"`
+	Action  string   `json:"action"`
+	Allow   bool     `json:"allow"`
+	Rule    []string `json:"rule"`
+}
 // PermissionModel wraps our connection pool
 type PermissionModel struct {
-	Manager pmanager.PermissionManager
+	Manager *pmanager.PermissionManager
 	DB      *sql.DB
 }
-// Include checks for a permission code 
+// Include checks for a permission code
 func (p Permissions) Include(code string) bool {
 	for i := range p {
 		if code == p[i] {
@@ -24,25 +36,335 @@ func (p Permissions) Include(code string) bool {
 	return false
 
 }
-// GetForUser loads permissions for a given UserAccount ID
+// GetForUser loads permissions for a given UserAccount ID, including those inherited
+// through the user's teams and organizations
 func (app PermissionModel) GetForUser(userID int64) (Permissions, error) {
 
-	userMod := UserAccountModel{DB: app.DB}
-	user, err := userMod.Get(userID)
+	perm, err := app.Manager.GetForSubject(subject(userID), app.rules(userID))
 	if err != nil {
 		return nil, err
 	}
+	var permissions Permissions
+	for _, p := range perm {
+		permissions = append(permissions, p)
+	}
+	return permissions, nil
+}
+
+// Can checks whether a UserAccount may take an action on an object such as a team or an
+// organization, resolving org -> team -> user inheritance
+func (app PermissionModel) Can(userID int64, obj string, act string) (bool, error) {
+
+	env := &pmanager.Env{Time: time.Now()}
+	return app.Manager.Enforce(subject(userID), obj, act, env, app.rules(userID))
+}
 
-	if user.Role == "" {
-		return nil, fmt.Errorf("user has no role")
+// Decide checks whether a UserAccount may take an action on an object, evaluating policy
+// conditions against the request attributes in env, and returns the policy that allowed it.
+// It is the check made by Middleware.Authorize.
+func (app PermissionModel) Decide(userID int64, obj string, act string, env *pmanager.Env) (*Decision, error) {
+	if env.OwnerTeamID == 0 {
+		owner, err := app.ownerTeam(obj)
+		if err != nil {
+			return nil, err
+		}
+		env.OwnerTeamID = owner
 	}
-	perm, err := app.Manager.GetForRole(user.Role)
+	app.withAttributes(userID, env)
+
+	sub := subject(userID)
+	allow, rule, err := app.Manager.Explain(sub, obj, act, env, app.rules(userID))
 	if err != nil {
 		return nil, err
 	}
-	var permissions Permissions
-	for _, p := range perm {
-		permissions = append(permissions, p)
+	if rule == nil {
+		rule = []string{}
 	}
-	return permissions, nil
+	return &Decision{Subject: sub, Object: obj, Action: act, Allow: allow, Rule: rule}, nil
+}
+
+// Explanation is the trace of a decision for a UserAccount and permission code
+type Explanation struct {
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"`
+	Code   string `json:"code"`
+	*pmanager.Trace
+}
+
+// DryRunResult is the decision for a UserAccount and permission code before and after a
+// proposed policy change
+type DryRunResult struct {
+	UserID  int64  `json:"user_id"`
+	Code    string `json:"code"`
+	Before  bool   `json:"before"`
+	After   bool   `json:"after"`
+	Changed bool   `json:"changed"`
+}
+
+// Explain shows the UserAccount's role, its inheritance chain, the rules evaluated for the
+// permission code and the rule that matched
+func (app PermissionModel) Explain(userID int64, code string, env *pmanager.Env) (*Explanation, error) {
+	user := NewAnonUser()
+	if userID != AnonUserID {
+		var err error
+		userMod := UserAccountModel{DB: app.DB}
+		if user, err = userMod.Get(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	obj, act := pmanager.SplitCode(code)
+	if env.OwnerTeamID == 0 {
+		var err error
+		if env.OwnerTeamID, err = app.ownerTeam(obj); err != nil {
+			return nil, err
+		}
+	}
+	app.withAttributes(userID, env)
+
+	trace, err := app.Manager.Trace(subject(userID), obj, act, env, app.rules(userID))
+	if err != nil {
+		return nil, err
+	}
+	return &Explanation{UserID: userID, Role: user.Role, Code: code, Trace: trace}, nil
+}
+
+// DryRun evaluates the permission codes for each UserAccount before and after the proposed
+// changes, without applying them
+func (app PermissionModel) DryRun(userIDs []int64, codes []string, changes []pmanager.Change, env *pmanager.Env) ([]*DryRunResult, error) {
+	for _, change := range changes {
+		if err := app.Manager.ValidateChange(change); err != nil {
+			return nil, err
+		}
+	}
+
+	checks := make([][]string, len(codes))
+	for i, code := range codes {
+		obj, act := pmanager.SplitCode(code)
+		checks[i] = []string{obj, act}
+	}
+
+	results := []*DryRunResult{}
+	for _, userID := range userIDs {
+		// each user is evaluated against their own attributes
+		userEnv := *env
+		app.withAttributes(userID, &userEnv)
+		before, after, err := app.Manager.DryRun(subject(userID), checks, &userEnv, changes, app.rules(userID))
+		if err != nil {
+			return nil, err
+		}
+		for i, code := range codes {
+			results = append(results, &DryRunResult{
+				UserID:  userID,
+				Code:    code,
+				Before:  before[i],
+				After:   after[i],
+				Changed: before[i] != after[i],
+			})
+		}
+	}
+	return results, nil
+}
+
+// privilegedUser is a condition on user_account as ua that holds for users who administer
+// something: admins and principals by their primary role, organization and team admins, and
+// users assigned a role that is, or inherits from, one of the privileged roles
+const privilegedUser = `(
+	ua.role in ('admin', 'service', 'scim')
+	or exists (select 1 from organization_admin as pa where pa.user_account_id = ua.id)
+	or exists (select 1 from users_teams as pt where pt.user_account_id = ua.id and pt.is_admin = 1)
+	or exists (
+		with recursive assigned(role) as (
+			select 		pr.v1
+			from 		casbin_rule as pr
+			where 		pr.ptype = 'g' and pr.v0 = 'user:' || ua.id
+			union
+			select 		pr.v1
+			from 		casbin_rule as pr
+			inner join 	assigned as a
+			on 			pr.ptype = 'g' and pr.v0 = a.role
+		)
+		select 1 from assigned where role in ('admin', 'org-admin', 'service', 'scim')
+	))`
+
+// subject returns the casbin subject for a UserAccount ID, requests without a token are
+// evaluated as the anon role
+func subject(userID int64) string {
+	if userID == AnonUserID {
+		return pmanager.AnonRole
+	}
+	return pmanager.UserSubject(userID)
+}
+
+// withAttributes has env load the attributes of a UserAccount and its Teams when a policy
+// condition first needs them, unless the caller has set them or their loader already
+func (app PermissionModel) withAttributes(userID int64, env *pmanager.Env) {
+	if env.Attributes != nil || env.LoadAttributes != nil {
+		return
+	}
+	if userID == AnonUserID {
+		env.Attributes = map[string][]string{}
+		return
+	}
+	env.LoadAttributes = func() (map[string][]string, error) {
+		claims, err := AttributeModel{DB: app.DB}.Claims(userID)
+		if err != nil {
+			return nil, err
+		}
+		return claims.Flatten(), nil
+	}
+}
+
+// ownerTeam returns the Team owning a team or resource object, 0 for other objects
+func (app PermissionModel) ownerTeam(obj string) (int64, error) {
+	var teamID int64
+	if n, _ := fmt.Sscanf(obj, "team:%d", &teamID); n == 1 {
+		return teamID, nil
+	}
+	if !strings.HasPrefix(obj, pmanager.SQLM+"/") {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := app.DB.QueryRowContext(ctx, `select team_id from resource where path = $1`, obj).Scan(&teamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return teamID, nil
+}
+
+// Refresh reloads the policy when it has been changed by another replica
+func (app PermissionModel) Refresh() error {
+	return app.Manager.Refresh()
+}
+
+// rules loads the UserAccount and its hierarchy, only called when the user's permissions are
+// not already cached
+func (app PermissionModel) rules(userID int64) pmanager.Rules {
+	return func() ([][]string, [][]string, error) {
+		// the anonymous principal is the anon role itself, it has no hierarchy
+		if userID == AnonUserID {
+			return nil, nil, nil
+		}
+
+		userMod := UserAccountModel{DB: app.DB}
+		user, err := userMod.Get(userID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if user.Role == "" {
+			return nil, nil, fmt.Errorf("user has no role")
+		}
+
+		return app.hierarchy(user)
+	}
+}
+
+// hierarchy builds the casbin policies and grouping rules for the org -> team -> user tree
+// the UserAccount sits in
+func (app PermissionModel) hierarchy(user *UserAccount) ([][]string, [][]string, error) {
+	sub := pmanager.UserSubject(user.ID)
+	links := [][]string{{sub, user.Role}}
+	var policies [][]string
+
+	query := `
+		select 		ut.team_id, coalesce(ut.is_admin, 0), t.organization_id
+		from 		users_teams as ut
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		where 		ut.user_account_id = $1
+		and 		t.deleted_at is null
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, query, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var teamID int64
+		var isAdmin int
+		var orgID sql.NullInt64
+		if err := rows.Scan(&teamID, &isAdmin, &orgID); err != nil {
+			return nil, nil, err
+		}
+		team := pmanager.TeamSubject(teamID)
+		links = append(links, []string{sub, team})
+		if orgID.Valid {
+			links = append(links, []string{team, pmanager.OrgSubject(orgID.Int64)})
+		}
+		if isAdmin == 1 {
+			admin := pmanager.TeamAdminSubject(teamID)
+			links = append(links, []string{sub, admin})
+			policies = append(policies, []string{admin, team, pmanager.Admin, ""})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// org admins inherit the admin subject of every team below their organization
+	query = `
+		select 		oa.organization_id, t.id
+		from 		organization_admin as oa
+		left join 	team as t
+		on 			t.organization_id = oa.organization_id
+		and 		t.deleted_at is null
+		where 		oa.user_account_id = $1
+	`
+	rows, err = app.DB.QueryContext(ctx, query, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID int64
+		var teamID sql.NullInt64
+		if err := rows.Scan(&orgID, &teamID); err != nil {
+			return nil, nil, err
+		}
+		org := pmanager.OrgAdminSubject(orgID)
+		links = append(links,
+			[]string{sub, org},
+			[]string{org, pmanager.OrgAdminRole},
+		)
+		policies = append(policies, []string{org, pmanager.OrgSubject(orgID), pmanager.Admin, ""})
+		if teamID.Valid {
+			team := pmanager.TeamAdminSubject(teamID.Int64)
+			links = append(links, []string{org, team})
+			policies = append(policies, []string{team, pmanager.TeamSubject(teamID.Int64), pmanager.Admin, ""})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return dedupe(policies), dedupe(links), nil
+}
+
+// permissionsChanged drops the cached permissions after a change to the org -> team -> user
+// hierarchy, other replicas pick the change up from the policy version
+func permissionsChanged(db *sql.DB) {
+	pmanager.New(db).Invalidate()
+}
+
+func dedupe(rules [][]string) [][]string {
+	seen := map[string]bool{}
+	var out [][]string
+	for _, r := range rules {
+		key := fmt.Sprint(r)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, r)
+	}
+	return out
 }
@@ -0,0 +1,758 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	pmanager "github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/lib/pq"
+)
+
+// PolicyDocumentVersion is the version of the PolicyDocument format written by Export
+const PolicyDocumentVersion = 1
+
+// The kinds of object a PolicyChange applies to
+const (
+	PolicyKindRole       = "role"
+	PolicyKindPolicy     = "policy"
+	PolicyKindInherit    = "inherit"
+	PolicyKindTeam       = "team"
+	PolicyKindMember     = "member"
+	PolicyKindPrimary    = "primary-role"
+	PolicyKindAssignment = "assignment"
+)
+
+// PolicyDocument is the declarative form of the roles, their policies, the teams and the
+// role assignments, so they can be kept in git and synced with Import
+type PolicyDocument struct {
+	Version     int                 `json:"version" yaml:"version"`
+	Roles       []*PolicyRole       `json:"roles" yaml:"roles"`
+	Teams       []*PolicyTeam       `json:"teams" yaml:"teams"`
+	Assignments []*PolicyAssignment `json:"assignments" yaml:"assignments"`
+}
+
+// PolicyRole is a Role, the roles it inherits and the policies granted to it
+type PolicyRole struct {
+	Name        string        `json:"name" yaml:"name"`
+	Description string        `json:"description,omitempty" yaml:"description,omitempty"`
+	Inherits    []string      `json:"inherits,omitempty" yaml:"inherits,omitempty"`
+	Policies    []*PolicyRule `json:"policies" yaml:"policies"`
+}
+
+// PolicyRule allows a Role to take an action on an object when the condition holds
+type PolicyRule struct {
+	Object    string `json:"object" yaml:"object"`
+	Action    string `json:"action" yaml:"action"`
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+// PolicyTeam is a Team and its members
+type PolicyTeam struct {
+	Name      string          `json:"name" yaml:"name"`
+	GitURL    string          `json:"git_url,omitempty" yaml:"git_url,omitempty"`
+	ServerURL string          `json:"server_url,omitempty" yaml:"server_url,omitempty"`
+	Members   []*PolicyMember `json:"members" yaml:"members"`
+}
+
+// PolicyMember is a UserAccount belonging to a PolicyTeam
+type PolicyMember struct {
+	Email string `json:"email" yaml:"email"`
+	Admin bool   `json:"admin,omitempty" yaml:"admin,omitempty"`
+}
+
+// PolicyAssignment is the primary role of a UserAccount and the roles assigned on top of it
+type PolicyAssignment struct {
+	Email string   `json:"email" yaml:"email"`
+	Role  string   `json:"role" yaml:"role"`
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+// PolicyChange is one step of the diff between the database and a PolicyDocument
+type PolicyChange struct {
+	Op     string      `json:"op"`
+	Kind   string      `json:"kind"`
+	Target string      `json:"target"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// PolicyModel wraps the connection pool
+type PolicyModel struct {
+	Manager *pmanager.PermissionManager
+	DB      *sql.DB
+}
+
+func ValidatePolicyDocument(v *validator.Validator, doc *PolicyDocument) {
+	v.Check(doc.Version == PolicyDocumentVersion, "version", fmt.Sprintf("must be %d", PolicyDocumentVersion))
+
+	roles := map[string]bool{}
+	for _, role := range doc.Roles {
+		ValidateRoleName(v, role.Name)
+		v.Check(!roles[role.Name], "roles", "must not contain "+role.Name+" more than once")
+		roles[role.Name] = true
+		for _, p := range role.Policies {
+			v.Check(p.Object != "" && p.Action != "", "roles", "policies of "+role.Name+" must have an object and action")
+		}
+	}
+	v.Check(!inheritanceCycle(doc.Roles), "roles", "must not inherit each other in a cycle")
+
+	teams := map[string]bool{}
+	for _, team := range doc.Teams {
+		v.Check(team.Name != "", "teams", "must have a name")
+		v.Check(!teams[team.Name], "teams", "must not contain "+team.Name+" more than once")
+		teams[team.Name] = true
+		for _, member := range team.Members {
+			v.Check(member.Email != "", "teams", "members of "+team.Name+" must have an email")
+		}
+	}
+
+	users := map[string]bool{}
+	for _, a := range doc.Assignments {
+		v.Check(a.Email != "", "assignments", "must have an email")
+		v.Check(a.Role != "", "assignments", "must have a primary role for "+a.Email)
+		v.Check(!users[a.Email], "assignments", "must not contain "+a.Email+" more than once")
+		users[a.Email] = true
+	}
+}
+
+// Export returns the roles, policies, teams and role assignments as a PolicyDocument
+func (m PolicyModel) Export() (*PolicyDocument, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return exportPolicy(ctx, tx)
+}
+
+// Import brings the database in line with doc. The diff is applied in one transaction, or
+// only returned when dryRun is set. Without prune, objects missing from doc are left alone;
+// with prune, custom roles, policies, team members and assigned roles that are not in doc
+// are removed. Teams are never deleted by Import.
+func (m PolicyModel) Import(doc *PolicyDocument, prune bool, dryRun bool) ([]*PolicyChange, error) {
+	for _, role := range doc.Roles {
+		for _, p := range role.Policies {
+			if err := m.Manager.ValidateRule("p", []string{role.Name, p.Object, p.Action, p.Condition}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = lockPolicy(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	current, err := exportPolicy(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := diffPolicy(current, doc, prune)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	for _, change := range changes {
+		if err := applyPolicyChange(ctx, tx, change); err != nil {
+			return nil, fmt.Errorf("%s %s %s: %w", change.Op, change.Kind, change.Target, err)
+		}
+	}
+
+	// pruning members must not leave a user without a team
+	var stranded []string
+	query := `
+		select 		u.email
+		from 		user_account as u
+		where 		u.email = any($1)
+		and 		not exists (
+						select 		1
+						from 		users_teams as ut
+						inner join 	team as t
+						on 			t.id = ut.team_id
+						where 		ut.user_account_id = u.id
+						and 		t.deleted_at is null
+					)
+	`
+	rows, err := tx.QueryContext(ctx, query, pq.Array(removedMembers(changes)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		stranded = append(stranded, email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(stranded) > 0 {
+		return nil, fmt.Errorf("conflict: users would have no team: %s", strings.Join(stranded, ", "))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, m.Manager.Refresh()
+}
+
+func exportPolicy(ctx context.Context, tx *sql.Tx) (*PolicyDocument, error) {
+	doc := &PolicyDocument{
+		Version:     PolicyDocumentVersion,
+		Roles:       []*PolicyRole{},
+		Teams:       []*PolicyTeam{},
+		Assignments: []*PolicyAssignment{},
+	}
+
+	roles := map[string]*PolicyRole{}
+	err := queryRows(ctx, tx, `select name, description from role order by name`, func(rows *sql.Rows) error {
+		role := &PolicyRole{Policies: []*PolicyRule{}}
+		if err := rows.Scan(&role.Name, &role.Description); err != nil {
+			return err
+		}
+		roles[role.Name] = role
+		doc.Roles = append(doc.Roles, role)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		select 		v0, v1, v2, v3
+		from 		casbin_rule
+		where 		ptype = 'p'
+		and 		v0 in (select name from role)
+		order by 	v0, v1, v2, v3
+	`
+	err = queryRows(ctx, tx, query, func(rows *sql.Rows) error {
+		var name string
+		p := &PolicyRule{}
+		if err := rows.Scan(&name, &p.Object, &p.Action, &p.Condition); err != nil {
+			return err
+		}
+		roles[name].Policies = append(roles[name].Policies, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		v0, v1
+		from 		casbin_rule
+		where 		ptype = 'g'
+		and 		v0 in (select name from role)
+		and 		v1 in (select name from role)
+		order by 	v0, v1
+	`
+	err = queryRows(ctx, tx, query, func(rows *sql.Rows) error {
+		var name, parent string
+		if err := rows.Scan(&name, &parent); err != nil {
+			return err
+		}
+		roles[name].Inherits = append(roles[name].Inherits, parent)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	teams := map[string]*PolicyTeam{}
+	query = `
+		select 		t.name, coalesce(tm.git_url, ''), coalesce(tm.server_url, '')
+		from 		team as t
+		left join	team_meta as tm
+		on			t.team_meta_id = tm.id
+		where 		t.deleted_at is null
+		order by 	t.name
+	`
+	err = queryRows(ctx, tx, query, func(rows *sql.Rows) error {
+		team := &PolicyTeam{Members: []*PolicyMember{}}
+		if err := rows.Scan(&team.Name, &team.GitURL, &team.ServerURL); err != nil {
+			return err
+		}
+		teams[team.Name] = team
+		doc.Teams = append(doc.Teams, team)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		t.name, u.email, coalesce(ut.is_admin, 0) = 1
+		from 		users_teams as ut
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		inner join 	user_account as u
+		on 			u.id = ut.user_account_id
+		where 		t.deleted_at is null
+		order by 	t.name, u.email
+	`
+	err = queryRows(ctx, tx, query, func(rows *sql.Rows) error {
+		var name string
+		member := &PolicyMember{}
+		if err := rows.Scan(&name, &member.Email, &member.Admin); err != nil {
+			return err
+		}
+		teams[name].Members = append(teams[name].Members, member)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		u.email, u.role, coalesce(array_agg(c.v1 order by c.v1) filter (where c.v1 is not null), '{}')
+		from 		user_account as u
+		left join 	casbin_rule as c
+		on 			c.ptype = 'g'
+		and 		c.v0 = 'user:' || u.id
+		and 		c.v1 in (select name from role)
+		group by 	u.id, u.email, u.role
+		order by 	u.email
+	`
+	err = queryRows(ctx, tx, query, func(rows *sql.Rows) error {
+		a := &PolicyAssignment{}
+		if err := rows.Scan(&a.Email, &a.Role, pq.Array(&a.Roles)); err != nil {
+			return err
+		}
+		doc.Assignments = append(doc.Assignments, a)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// diffPolicy returns the changes that turn current into doc. Additions and updates come
+// before removals so a role is never removed while it is still referenced.
+func diffPolicy(current *PolicyDocument, doc *PolicyDocument, prune bool) ([]*PolicyChange, error) {
+	changes := []*PolicyChange{}
+	var removals []*PolicyChange
+	add := func(op, kind, target string, value interface{}) {
+		c := &PolicyChange{Op: op, Kind: kind, Target: target, Value: value}
+		if op == "remove" {
+			removals = append(removals, c)
+		} else {
+			changes = append(changes, c)
+		}
+	}
+
+	roles := map[string]*PolicyRole{}
+	for _, role := range current.Roles {
+		roles[role.Name] = role
+	}
+	known := map[string]bool{}
+	for _, role := range doc.Roles {
+		known[role.Name] = true
+		have, ok := roles[role.Name]
+		switch {
+		case !ok:
+			add("add", PolicyKindRole, role.Name, role.Description)
+			have = &PolicyRole{}
+		case have.Description != role.Description:
+			add("update", PolicyKindRole, role.Name, role.Description)
+		}
+		existing := map[PolicyRule]bool{}
+		for _, p := range have.Policies {
+			existing[*p] = true
+		}
+		wanted := map[PolicyRule]bool{}
+		for _, p := range role.Policies {
+			wanted[*p] = true
+			if !existing[*p] {
+				add("add", PolicyKindPolicy, role.Name, p)
+			}
+		}
+		for _, p := range have.Policies {
+			if prune && !wanted[*p] {
+				add("remove", PolicyKindPolicy, role.Name, p)
+			}
+		}
+		for _, parent := range role.Inherits {
+			if !validator.In(parent, have.Inherits...) {
+				add("add", PolicyKindInherit, role.Name, parent)
+			}
+		}
+		for _, parent := range have.Inherits {
+			if prune && !validator.In(parent, role.Inherits...) {
+				add("remove", PolicyKindInherit, role.Name, parent)
+			}
+		}
+	}
+	for _, role := range current.Roles {
+		if known[role.Name] {
+			continue
+		}
+		// built in roles are referenced by the code, their policies are only pruned when the
+		// role is in the document
+		if prune && !validator.In(role.Name, builtinRoles...) {
+			add("remove", PolicyKindRole, role.Name, nil)
+		} else {
+			known[role.Name] = true
+		}
+	}
+
+	for _, role := range doc.Roles {
+		for _, parent := range role.Inherits {
+			if !known[parent] {
+				return nil, fmt.Errorf("no record found: role %s inherited by %s", parent, role.Name)
+			}
+		}
+	}
+
+	users := map[string]*PolicyAssignment{}
+	for _, a := range current.Assignments {
+		users[a.Email] = a
+	}
+
+	teams := map[string]*PolicyTeam{}
+	for _, team := range current.Teams {
+		teams[team.Name] = team
+	}
+	for _, team := range doc.Teams {
+		have, ok := teams[team.Name]
+		switch {
+		case !ok:
+			add("add", PolicyKindTeam, team.Name, &PolicyTeam{Name: team.Name, GitURL: team.GitURL, ServerURL: team.ServerURL})
+			have = &PolicyTeam{}
+		case have.GitURL != team.GitURL || have.ServerURL != team.ServerURL:
+			add("update", PolicyKindTeam, team.Name, &PolicyTeam{Name: team.Name, GitURL: team.GitURL, ServerURL: team.ServerURL})
+		}
+		existing := map[string]*PolicyMember{}
+		for _, member := range have.Members {
+			existing[member.Email] = member
+		}
+		wanted := map[string]bool{}
+		for _, member := range team.Members {
+			if _, ok := users[member.Email]; !ok {
+				return nil, fmt.Errorf("no record found: user %s of team %s", member.Email, team.Name)
+			}
+			wanted[member.Email] = true
+			m, ok := existing[member.Email]
+			switch {
+			case !ok:
+				add("add", PolicyKindMember, team.Name, member)
+			case m.Admin != member.Admin:
+				add("update", PolicyKindMember, team.Name, member)
+			}
+		}
+		for _, member := range have.Members {
+			if prune && !wanted[member.Email] {
+				add("remove", PolicyKindMember, team.Name, member)
+			}
+		}
+	}
+
+	listed := map[string]bool{}
+	for _, a := range doc.Assignments {
+		have, ok := users[a.Email]
+		if !ok {
+			return nil, fmt.Errorf("no record found: user %s", a.Email)
+		}
+		listed[a.Email] = true
+		for _, role := range append([]string{a.Role}, a.Roles...) {
+			if !known[role] {
+				return nil, fmt.Errorf("no record found: role %s assigned to %s", role, a.Email)
+			}
+		}
+		if a.Role != have.Role {
+			add("update", PolicyKindPrimary, a.Email, a.Role)
+		}
+		wanted := map[string]bool{}
+		for _, role := range a.Roles {
+			wanted[role] = true
+			if !validator.In(role, have.Roles...) {
+				add("add", PolicyKindAssignment, a.Email, role)
+			}
+		}
+		for _, role := range have.Roles {
+			if prune && !wanted[role] {
+				add("remove", PolicyKindAssignment, a.Email, role)
+			}
+		}
+	}
+	for _, a := range current.Assignments {
+		if listed[a.Email] {
+			continue
+		}
+		if !known[a.Role] {
+			return nil, fmt.Errorf("conflict: role %s is the primary role of %s", a.Role, a.Email)
+		}
+		for _, role := range a.Roles {
+			if prune {
+				add("remove", PolicyKindAssignment, a.Email, role)
+			}
+		}
+	}
+
+	// removals run in reverse, so assignments go before the roles they refer to
+	for i := len(removals) - 1; i >= 0; i-- {
+		changes = append(changes, removals[i])
+	}
+	return changes, nil
+}
+
+func applyPolicyChange(ctx context.Context, tx *sql.Tx, change *PolicyChange) error {
+	var query string
+	var args []interface{}
+
+	switch change.Kind + "/" + change.Op {
+	case PolicyKindRole + "/add":
+		query = `insert into role(name, description, created_at) values ($1, $2, now())`
+		args = []interface{}{change.Target, change.Value}
+	case PolicyKindRole + "/update":
+		query = `update role set description = $2, version = version + 1 where name = $1`
+		args = []interface{}{change.Target, change.Value}
+	case PolicyKindRole + "/remove":
+		query = `
+			with removed as (
+				delete from casbin_rule
+				where 		(ptype = 'p' and v0 = $1)
+				or 			(ptype = 'g' and (v0 = $1 or v1 = $1))
+			)
+			delete from role where name = $1
+		`
+		args = []interface{}{change.Target}
+	case PolicyKindPolicy + "/add":
+		p := change.Value.(*PolicyRule)
+		query = `
+			insert into casbin_rule(ptype, v0, v1, v2, v3)
+			values ('p', $1, $2, $3, $4)
+			on conflict do nothing
+		`
+		args = []interface{}{change.Target, p.Object, p.Action, p.Condition}
+	case PolicyKindPolicy + "/remove":
+		p := change.Value.(*PolicyRule)
+		query = `delete from casbin_rule where ptype = 'p' and v0 = $1 and v1 = $2 and v2 = $3 and v3 = $4`
+		args = []interface{}{change.Target, p.Object, p.Action, p.Condition}
+	case PolicyKindInherit + "/add":
+		query = `
+			insert into casbin_rule(ptype, v0, v1)
+			values ('g', $1, $2)
+			on conflict do nothing
+		`
+		args = []interface{}{change.Target, change.Value}
+	case PolicyKindInherit + "/remove":
+		query = `delete from casbin_rule where ptype = 'g' and v0 = $1 and v1 = $2`
+		args = []interface{}{change.Target, change.Value}
+	case PolicyKindTeam + "/add":
+		team := change.Value.(*PolicyTeam)
+		query = `
+			with meta as (
+				insert into team_meta(git_url, server_url, created_at)
+				values ($2, $3, now())
+				returning id
+			)
+			insert into team(name, team_meta_id, created_at)
+			select 		$1, id, now()
+			from 		meta
+		`
+		args = []interface{}{team.Name, team.GitURL, team.ServerURL}
+	case PolicyKindTeam + "/update":
+		team := change.Value.(*PolicyTeam)
+		var teamID int64
+		err := tx.QueryRowContext(ctx, `select id from team where name = $1 and deleted_at is null`, team.Name).Scan(&teamID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return fmt.Errorf("no record found: team %s: %w", team.Name, err)
+			default:
+				return err
+			}
+		}
+		metaID, err := ensureTeamMeta(ctx, tx, teamID)
+		if err != nil {
+			return err
+		}
+		query = `
+			update 		team_meta
+			set 		git_url = $2
+						, server_url = $3
+						, updated_at = now()
+						, version = version + 1
+			where 		id = $1
+		`
+		args = []interface{}{metaID, team.GitURL, team.ServerURL}
+	case PolicyKindMember + "/add":
+		member := change.Value.(*PolicyMember)
+		var teamID int64
+		var role string
+		query = `
+			select 		t.id, u.role
+			from 		team as t, user_account as u
+			where 		t.name = $1 and t.deleted_at is null
+			and 		u.email = $2
+		`
+		err := tx.QueryRowContext(ctx, query, change.Target, member.Email).Scan(&teamID, &role)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return fmt.Errorf("no record found: user %s of team %s: %w", member.Email, change.Target, err)
+			default:
+				return err
+			}
+		}
+		if err = checkMemberQuota(ctx, tx, teamID, role, 1); err != nil {
+			return err
+		}
+		query = `
+			insert into users_teams(user_account_id, team_id, is_admin, created_at)
+			select 		id, $1, $3, now()
+			from 		user_account
+			where 		email = $2
+		`
+		args = []interface{}{teamID, member.Email, adminFlag(member.Admin)}
+	case PolicyKindMember + "/update":
+		member := change.Value.(*PolicyMember)
+		query = `
+			update 		users_teams
+			set 		is_admin = $3
+						, version = version + 1
+			where 		team_id = (select id from team where name = $1 and deleted_at is null)
+			and 		user_account_id = (select id from user_account where email = $2)
+		`
+		args = []interface{}{change.Target, member.Email, adminFlag(member.Admin)}
+	case PolicyKindMember + "/remove":
+		member := change.Value.(*PolicyMember)
+		query = `
+			delete from users_teams
+			where 		team_id = (select id from team where name = $1 and deleted_at is null)
+			and 		user_account_id = (select id from user_account where email = $2)
+		`
+		args = []interface{}{change.Target, member.Email}
+	case PolicyKindPrimary + "/update":
+		query = `update user_account set role = $2, version = version + 1 where email = $1`
+		args = []interface{}{change.Target, change.Value}
+	case PolicyKindAssignment + "/add":
+		query = `
+			insert into casbin_rule(ptype, v0, v1)
+			select 		'g', 'user:' || id, $2
+			from 		user_account
+			where 		email = $1
+			on conflict do nothing
+		`
+		args = []interface{}{change.Target, change.Value}
+	case PolicyKindAssignment + "/remove":
+		query = `
+			delete from casbin_rule
+			where 		ptype = 'g'
+			and 		v0 = (select 'user:' || id from user_account where email = $1)
+			and 		v1 = $2
+		`
+		args = []interface{}{change.Target, change.Value}
+	default:
+		return fmt.Errorf("unknown change %s %s", change.Op, change.Kind)
+	}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "violates foreign key constraint"):
+			return fmt.Errorf("conflict: %w", err)
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("conflict: %w", err)
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// inheritanceCycle reports whether the roles inherit each other in a cycle
+func inheritanceCycle(roles []*PolicyRole) bool {
+	parents := map[string][]string{}
+	for _, role := range roles {
+		parents[role.Name] = role.Inherits
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return true
+		case done:
+			return false
+		}
+		state[name] = visiting
+		for _, parent := range parents[name] {
+			if visit(parent) {
+				return true
+			}
+		}
+		state[name] = done
+		return false
+	}
+
+	for _, role := range roles {
+		if visit(role.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryRows runs query and calls scan for each row
+func queryRows(ctx context.Context, tx *sql.Tx, query string, scan func(rows *sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func removedMembers(changes []*PolicyChange) []string {
+	emails := []string{}
+	for _, change := range changes {
+		if change.Kind == PolicyKindMember && change.Op == "remove" {
+			emails = append(emails, change.Value.(*PolicyMember).Email)
+		}
+	}
+	return emails
+}
+
+func adminFlag(admin bool) int {
+	if admin {
+		return 1
+	}
+	return 0
+}
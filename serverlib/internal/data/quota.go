@@ -0,0 +1,236 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+const (
+	QuotaMembers         = "max_members"
+	QuotaTokens          = "max_tokens"
+	QuotaServiceAccounts = "max_service_accounts"
+)
+
+// Quota holds the seat limits for a Team, a nil limit is unlimited
+type Quota struct {
+	TeamID             int64 `json:"team_id"`
+	MaxMembers         *int  `json:"max_members"`
+	MaxTokens          *int  `json:"max_tokens"`
+	MaxServiceAccounts *int  `json:"max_service_accounts"`
+	Version            int   `json:"version"`
+}
+
+// Usage is the current use of a single limit
+type Usage struct {
+	Limit *int `json:"limit"`
+	Used  int  `json:"used"`
+}
+
+// QuotaUsage reports a Team's usage against each of its limits
+type QuotaUsage struct {
+	TeamID          int64 `json:"team_id"`
+	Members         Usage `json:"members"`
+	Tokens          Usage `json:"tokens"`
+	ServiceAccounts Usage `json:"service_accounts"`
+}
+
+// QuotaModel wraps the connection pool
+type QuotaModel struct {
+	DB *sql.DB
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func ValidateQuota(v *validator.Validator, q *Quota) {
+	v.Check(q.MaxMembers == nil || *q.MaxMembers >= 0, QuotaMembers, "must not be negative")
+	v.Check(q.MaxTokens == nil || *q.MaxTokens >= 0, QuotaTokens, "must not be negative")
+	v.Check(q.MaxServiceAccounts == nil || *q.MaxServiceAccounts >= 0, QuotaServiceAccounts, "must not be negative")
+}
+
+// Get returns the Quota for a Team, a Team without a row has no limits
+func (m QuotaModel) Get(teamID int64) (*Quota, error) {
+	query := `
+		select 	max_members, max_tokens, max_service_accounts, version
+		from 	team_quota
+		where 	team_id = $1
+	`
+	q := Quota{TeamID: teamID}
+	var members, tokens, services sql.NullInt64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, teamID).Scan(&members, &tokens, &services, &q.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &q, nil
+		default:
+			return nil, err
+		}
+	}
+	q.MaxMembers = nullInt(members)
+	q.MaxTokens = nullInt(tokens)
+	q.MaxServiceAccounts = nullInt(services)
+	return &q, nil
+}
+
+// Set creates or replaces the Quota for a Team
+func (m QuotaModel) Set(q *Quota) error {
+	query := `
+		insert into team_quota(team_id, max_members, max_tokens, max_service_accounts, created_at)
+		values ($1, $2, $3, $4, now())
+		on conflict (team_id)
+		do update set 	max_members = excluded.max_members
+						, max_tokens = excluded.max_tokens
+						, max_service_accounts = excluded.max_service_accounts
+						, updated_at = now()
+						, version = team_quota.version + 1
+		returning version
+	`
+	args := []interface{}{q.TeamID, q.MaxMembers, q.MaxTokens, q.MaxServiceAccounts}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&q.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns the Team's usage against each of its limits
+func (m QuotaModel) Usage(teamID int64) (*QuotaUsage, error) {
+	q, err := m.Get(teamID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	usage := &QuotaUsage{TeamID: teamID}
+	usage.Members.Limit = q.MaxMembers
+	usage.Tokens.Limit = q.MaxTokens
+	usage.ServiceAccounts.Limit = q.MaxServiceAccounts
+
+	for kind, u := range map[string]*Usage{
+		QuotaMembers:         &usage.Members,
+		QuotaTokens:          &usage.Tokens,
+		QuotaServiceAccounts: &usage.ServiceAccounts,
+	} {
+		u.Used, err = quotaUsed(ctx, m.DB, teamID, kind)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+func nullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	i := int(n.Int64)
+	return &i
+}
+
+func quotaUsed(ctx context.Context, q querier, teamID int64, kind string) (int, error) {
+	var query string
+	switch kind {
+	case QuotaMembers:
+		query = `
+			select 	count(*)
+			from 	users_teams
+			where 	team_id = $1
+		`
+	case QuotaServiceAccounts:
+		query = `
+			select 		count(*)
+			from 		users_teams as ut
+			inner join 	user_account as ua
+			on 			ua.id = ut.user_account_id
+			where 		ut.team_id = $1
+			and 		ua.role = '` + RoleService + `'
+		`
+	case QuotaTokens:
+		query = `
+			select 		count(*)
+			from 		token as tk
+			inner join 	users_teams as ut
+			on 			ut.user_account_id = tk.user_account_id
+			where 		ut.team_id = $1
+			and 		tk.scope = '` + ScopeRO + `'
+			and 		tk.expiry > now()
+		`
+	default:
+		return 0, fmt.Errorf("unknown quota %s", kind)
+	}
+
+	var used int
+	err := q.QueryRowContext(ctx, query, teamID).Scan(&used)
+	return used, err
+}
+
+// checkQuota returns a quota exceeded error when adding n more of kind to the Team would
+// go over its limit. The quota row stays locked until q's transaction ends, so concurrent
+// additions to the Team are counted one after the other.
+func checkQuota(ctx context.Context, q querier, teamID int64, kind string, n int) error {
+	query := `
+		select 	` + kind + `
+		from 	team_quota
+		where 	team_id = $1
+		for update
+	`
+	var limit sql.NullInt64
+	err := q.QueryRowContext(ctx, query, teamID).Scan(&limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+	if !limit.Valid {
+		return nil
+	}
+
+	used, err := quotaUsed(ctx, q, teamID, kind)
+	if err != nil {
+		return err
+	}
+	if used+n > int(limit.Int64) {
+		return fmt.Errorf("quota exceeded: %s is %d for team %d", kind, limit.Int64, teamID)
+	}
+	return nil
+}
+
+// checkMemberQuota checks the seat limits for a UserAccount joining a Team, q must be the
+// transaction that adds the member
+func checkMemberQuota(ctx context.Context, q querier, teamID int64, role string, n int) error {
+	err := checkQuota(ctx, q, teamID, QuotaMembers, n)
+	if err != nil {
+		return err
+	}
+	if role == RoleService {
+		return checkQuota(ctx, q, teamID, QuotaServiceAccounts, n)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	pmanager "github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+const (
+	ResourceRepo   = "repo"
+	ResourceSchema = "schema"
+)
+
+// resourceNameRX allows nested names such as analytics/public for a schema in a repo
+var resourceNameRX = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*(/[a-z0-9][a-z0-9_.-]*)*$`)
+
+// Resource is a sql-manager object, such as a repo or a schema, owned by a Team that
+// policies can grant access to
+type Resource struct {
+	ID          int64     `json:"id"`
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	TeamID      int64     `json:"team_id"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	Version     int       `json:"version"`
+}
+
+// ResourceGrant allows a user or team subject to take an action on the resources matching
+// Object, which is a resource path or a pattern ending in *, when the Condition holds
+type ResourceGrant struct {
+	Subject   string `json:"subject"`
+	Object    string `json:"object"`
+	Action    string `json:"action"`
+	Condition string `json:"condition"`
+}
+
+// ResourceModel wraps the connection pool
+type ResourceModel struct {
+	Manager *pmanager.PermissionManager
+	DB      *sql.DB
+}
+
+func ValidateResource(v *validator.Validator, resource *Resource) {
+	v.Check(validator.In(resource.Kind, ResourceRepo, ResourceSchema), "kind", "must be one of repo or schema")
+	v.Check(resource.Name != "", "name", "must be provided")
+	v.Check(len(resource.Name) <= 200, "name", "must be less than 200 bytes (chars) long")
+	v.Check(resourceNameRX.MatchString(resource.Name), "name", "must only contain lower case letters, numbers, ., -, _ and /")
+	v.Check(resource.TeamID > 0, "team_id", "must be provided")
+	v.Check(len(resource.Description) <= 1000, "description", "must be less than 1000 bytes (chars) long")
+}
+
+func ValidateResourceGrant(v *validator.Validator, grant *ResourceGrant) {
+	prefix := pmanager.SQLM + "/"
+	v.Check(strings.HasPrefix(grant.Object, prefix), "object", "must be a resource path starting with "+prefix)
+	v.Check(!strings.Contains(strings.TrimSuffix(grant.Object, "*"), "*"), "object", "may only contain * at the end")
+	v.Check(validator.In(grant.Action, pmanager.Read, pmanager.Write), "action", "must be one of read or write")
+	if _, err := pmanager.ParseCondition(grant.Condition); err != nil {
+		v.AddError("condition", err.Error())
+	}
+}
+
+// Add registers a Resource for a Team
+func (m ResourceModel) Add(resource *Resource) error {
+	resource.Path = pmanager.ResourceObject(resource.Kind, resource.Name)
+
+	query := `
+		insert into resource(kind, name, path, team_id, description, created_at)
+		select 	$1, $2, $3, id, $5, now()
+		from 	team
+		where 	id = $4 and deleted_at is null
+		returning id, created_at, version
+	`
+	args := []interface{}{resource.Kind, resource.Name, resource.Path, resource.TeamID, resource.Description}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&resource.ID, &resource.CreatedAt, &resource.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: team %d: %w", resource.TeamID, err)
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate resource: %w", err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the Resource for a given ID
+func (m ResourceModel) Get(id int64) (*Resource, error) {
+	query := `
+		select 	id, kind, name, path, team_id, description, created_at, version
+		from 	resource
+		where 	id = $1
+	`
+	var resource Resource
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&resource.ID,
+		&resource.Kind,
+		&resource.Name,
+		&resource.Path,
+		&resource.TeamID,
+		&resource.Description,
+		&resource.CreatedAt,
+		&resource.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	return &resource, nil
+}
+
+// GetByPath returns the Resource registered at a path
+func (m ResourceModel) GetByPath(path string) (*Resource, error) {
+	query := `
+		select 	id, kind, name, path, team_id, description, created_at, version
+		from 	resource
+		where 	path = $1
+	`
+	var resource Resource
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, path).Scan(
+		&resource.ID,
+		&resource.Kind,
+		&resource.Name,
+		&resource.Path,
+		&resource.TeamID,
+		&resource.Description,
+		&resource.CreatedAt,
+		&resource.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	return &resource, nil
+}
+
+// List returns the registered Resources, all kinds when kind is empty
+func (m ResourceModel) List(kind string) ([]*Resource, error) {
+	query := `
+		select 		id, kind, name, path, team_id, description, created_at, version
+		from 		resource
+		where 		(kind = $1 or $1 = '')
+		order by 	path
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resources := []*Resource{}
+	for rows.Next() {
+		var resource Resource
+		err := rows.Scan(
+			&resource.ID,
+			&resource.Kind,
+			&resource.Name,
+			&resource.Path,
+			&resource.TeamID,
+			&resource.Description,
+			&resource.CreatedAt,
+			&resource.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, &resource)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// Delete removes a Resource and the policies granted on its exact path
+func (m ResourceModel) Delete(id int64) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var path string
+	err = tx.QueryRowContext(ctx, `delete from resource where id = $1 returning path`, id).Scan(&path)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from casbin_rule where ptype = 'p' and v1 = $1`, path)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return m.Manager.Refresh()
+}
+
+// Grant stores a ResourceGrant as a casbin policy
+func (m ResourceModel) Grant(grant *ResourceGrant) error {
+	_, err := m.Manager.AddRule("p", []string{grant.Subject, grant.Object, grant.Action, grant.Condition})
+	return err
+}
+
+// Revoke removes the casbin policies for a ResourceGrant, whatever their conditions
+func (m ResourceModel) Revoke(grant *ResourceGrant) error {
+	ok, err := m.Manager.RemoveFilteredRule("p", grant.Subject, grant.Object, grant.Action)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no record found: %s may not %s %s", grant.Subject, grant.Action, grant.Object)
+	}
+	return nil
+}
+
+// Grants returns the ResourceGrants that apply to a Resource, including those made through
+// patterns
+func (m ResourceModel) Grants(resource *Resource) ([]*ResourceGrant, error) {
+	policies, err := m.Manager.GetPoliciesForObject(resource.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []*ResourceGrant{}
+	for _, p := range policies {
+		grants = append(grants, &ResourceGrant{Subject: p[0], Object: p[1], Action: p[2], Condition: p[3]})
+	}
+	return grants, nil
+}
@@ -0,0 +1,363 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	pmanager "github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+var roleNameRX = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// builtinRoles are referenced by the code and can not be deleted
+var builtinRoles = []string{"admin", "user", pmanager.AnonRole, RoleService, RoleSCIM, pmanager.OrgAdminRole}
+
+// Role is a named set of casbin policies that can be assigned to a UserAccount. A Role holds
+// the permissions granted to it and those of the roles it inherits.
+type Role struct {
+	ID                   int64       `json:"id"`
+	Name                 string      `json:"name"`
+	Description          string      `json:"description"`
+	CreatedAt            time.Time   `json:"created_at"`
+	Version              int         `json:"version"`
+	Inherits             []string    `json:"inherits"`
+	Permissions          Permissions `json:"permissions"`
+	EffectivePermissions Permissions `json:"effective_permissions"`
+}
+
+// RoleModel wraps the connection pool
+type RoleModel struct {
+	Manager *pmanager.PermissionManager
+	DB      *sql.DB
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	ValidateRoleName(v, role.Name)
+	v.Check(len(role.Description) <= 1000, "description", "must be less than 1000 bytes (chars) long")
+}
+
+func ValidateRoleName(v *validator.Validator, name string) {
+	v.Check(name != "", "name", "must be provided")
+	// a role can be a UserAccount's primary role, user_account.role is varchar(20)
+	v.Check(len(name) <= 20, "name", "must be less than 20 bytes (chars) long")
+	v.Check(roleNameRX.MatchString(name), "name", "must start with a letter and only contain lower case letters, numbers and -")
+}
+
+// Add adds a Role into the database
+func (m RoleModel) Add(role *Role) error {
+	query := `
+		insert into role(name, description, created_at)
+		values ($1, $2, now())
+		returning id, created_at, version
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate role: %w", err)
+		default:
+			return err
+		}
+	}
+	role.Inherits = []string{}
+	role.Permissions = Permissions{}
+	role.EffectivePermissions = Permissions{}
+	return nil
+}
+
+// Get returns a Role and the permissions granted to it
+func (m RoleModel) Get(name string) (*Role, error) {
+	query := `
+		select 	id, name, description, created_at, version
+		from 	role
+		where 	name = $1
+	`
+	var role Role
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+
+	if err = m.permissions(&role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// List returns every Role and the permissions granted to it
+func (m RoleModel) List() ([]*Role, error) {
+	query := `
+		select 		id, name, description, created_at, version
+		from 		role
+		order by 	name
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.Version)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if err = m.permissions(role); err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
+
+// permissions sets the inherited roles, the granted permissions and the effective
+// permissions of a Role
+func (m RoleModel) permissions(role *Role) error {
+	inherits, err := m.Manager.GetRolesForSubject(role.Name)
+	if err != nil {
+		return err
+	}
+	role.Inherits = append([]string{}, inherits...)
+
+	perm, err := m.Manager.GetGrantsForRole(role.Name)
+	if err != nil {
+		return err
+	}
+	role.Permissions = append(Permissions{}, perm...)
+
+	perm, err = m.Manager.GetForRole(role.Name)
+	if err != nil {
+		return err
+	}
+	role.EffectivePermissions = append(Permissions{}, perm...)
+	return nil
+}
+
+// Delete removes a Role along with its policies and assignments, a Role still held by a
+// UserAccount as its primary role can not be deleted
+func (m RoleModel) Delete(name string) error {
+	if validator.In(name, builtinRoles...) {
+		return fmt.Errorf("conflict: %s is a built in role", name)
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var held int
+	err = tx.QueryRowContext(ctx, `select count(*) from user_account where role = $1`, name).Scan(&held)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if held > 0 {
+		tx.Rollback()
+		return fmt.Errorf("conflict: role %s is held by %d users", name, held)
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `delete from role where name = $1 returning id`, name).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	query := `
+		delete from casbin_rule
+		where 		(ptype = 'p' and v0 = $1)
+		or 			(ptype = 'g' and (v0 = $1 or v1 = $1))
+	`
+	_, err = tx.ExecContext(ctx, query, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return m.Manager.Refresh()
+}
+
+// Grant allows a Role to take act on obj, limited to the requests matching cond when it is
+// not empty
+func (m RoleModel) Grant(name string, obj string, act string, cond string) error {
+	if _, err := m.Get(name); err != nil {
+		return err
+	}
+	_, err := m.Manager.AddRule("p", []string{name, obj, act, cond})
+	return err
+}
+
+// Revoke removes the policies allowing a Role to take act on obj, whatever their conditions
+func (m RoleModel) Revoke(name string, obj string, act string) error {
+	ok, err := m.Manager.RemoveFilteredRule("p", name, obj, act)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no record found: %s may not %s %s", name, act, obj)
+	}
+	return nil
+}
+
+// Inherit makes a Role inherit the permissions of parent, a Role can not inherit itself
+// through a chain of roles. The cycle check and the insert run under a lock on casbin_rule
+// so two inherits can not each pass the check and form a cycle together.
+func (m RoleModel) Inherit(name string, parent string) error {
+	if err := m.Manager.ValidateRule("g", []string{name, parent}); err != nil {
+		return err
+	}
+	if _, err := m.Get(name); err != nil {
+		return err
+	}
+	if _, err := m.Get(parent); err != nil {
+		return err
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockPolicy(ctx, tx); err != nil {
+		return err
+	}
+
+	query := `
+		with recursive inherited(name) as (
+			select 		$1::text
+			union
+			select 		r.v1
+			from 		casbin_rule as r
+			inner join 	inherited as i
+			on 			r.v0 = i.name
+			where 		r.ptype = 'g'
+		)
+		select exists (select 1 from inherited where name = $2)
+	`
+	var cycle bool
+	if err = tx.QueryRowContext(ctx, query, parent, name).Scan(&cycle); err != nil {
+		return err
+	}
+	if cycle {
+		return fmt.Errorf("invalid rule: %s inheriting %s would create a cycle", name, parent)
+	}
+
+	query = `
+		insert into casbin_rule(ptype, v0, v1)
+		values ('g', $1, $2)
+		on conflict do nothing
+	`
+	if _, err = tx.ExecContext(ctx, query, name, parent); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return m.Manager.Refresh()
+}
+
+// lockPolicy serializes the changes to casbin_rule that check the existing rules first
+func lockPolicy(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `lock table casbin_rule in share row exclusive mode`)
+	return err
+}
+
+// Disinherit stops a Role inheriting the permissions of parent
+func (m RoleModel) Disinherit(name string, parent string) error {
+	ok, err := m.Manager.RemoveRule("g", []string{name, parent})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no record found: role %s does not inherit %s", name, parent)
+	}
+	return nil
+}
+
+// Assign gives a UserAccount a Role on top of its primary role
+func (m RoleModel) Assign(userID int64, name string) error {
+	if _, err := m.Get(name); err != nil {
+		return err
+	}
+	_, err := m.Manager.AddRule("g", []string{pmanager.UserSubject(userID), name})
+	return err
+}
+
+// Unassign takes a Role assigned through Assign away from a UserAccount
+func (m RoleModel) Unassign(userID int64, name string) error {
+	ok, err := m.Manager.RemoveRule("g", []string{pmanager.UserSubject(userID), name})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no record found: role %s is not assigned to user %d", name, userID)
+	}
+	return nil
+}
+
+// GetForUser returns the primary role of a UserAccount followed by the roles assigned to it
+func (m RoleModel) GetForUser(userID int64) ([]string, error) {
+	userMod := UserAccountModel{DB: m.DB}
+	user, err := userMod.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned, err := m.Manager.GetRolesForSubject(pmanager.UserSubject(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{user.Role}
+	for _, r := range assigned {
+		if r != user.Role {
+			roles = append(roles, r)
+		}
+	}
+	return roles, nil
+}
@@ -0,0 +1,814 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+	"github.com/lib/pq"
+)
+
+// RoleSCIM is the role held by the service accounts of SCIM provisioning clients
+const RoleSCIM = "scim"
+
+// SCIMClient is an identity provider that provisions users and teams over SCIM. It acts
+// through a service account holding the scim role, users it creates join DefaultTeamID.
+type SCIMClient struct {
+	ID               int64     `json:"id"`
+	Name             string    `json:"name"`
+	DefaultTeamID    int64     `json:"default_team_id"`
+	ServiceAccountID int64     `json:"service_account_id"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// ProvisionedRef refers to a UserAccount or Team from another SCIM resource
+type ProvisionedRef struct {
+	ID      int64
+	Display string
+}
+
+// ProvisionedUser is a UserAccount as seen by a SCIM client. UserName is the email of the
+// UserAccount and an inactive user is a suspended one.
+type ProvisionedUser struct {
+	ID         int64
+	UserName   string
+	Name       string
+	ExternalID string
+	Active     bool
+	Version    int
+	CreatedAt  time.Time
+	Groups     []*ProvisionedRef
+}
+
+// ProvisionedGroup is a Team as seen by a SCIM client
+type ProvisionedGroup struct {
+	ID         int64
+	Name       string
+	ExternalID string
+	Version    int
+	CreatedAt  time.Time
+	Members    []*ProvisionedRef
+}
+
+// SCIMModel wraps the connection pool
+type SCIMModel struct {
+	DB *sql.DB
+}
+
+// scimUserColumns are the User attributes that can be filtered on
+var scimUserColumns = map[string]scimColumn{
+	"id":             {"ua.id::text", "string"},
+	"username":       {"ua.email::text", "string"},
+	"externalid":     {"ua.scim_external_id", "string"},
+	"displayname":    {"ua.name", "string"},
+	"name.formatted": {"ua.name", "string"},
+	"emails":         {"ua.email::text", "string"},
+	"emails.value":   {"ua.email::text", "string"},
+	"active":         {"(ua.suspended_at is null or ua.reactivate_at <= now())", "bool"},
+	"meta.created":   {"ua.created_at", "time"},
+}
+
+// scimGroupColumns are the Group attributes that can be filtered on
+var scimGroupColumns = map[string]scimColumn{
+	"id":           {"t.id::text", "string"},
+	"displayname":  {"t.name", "string"},
+	"externalid":   {"t.scim_external_id", "string"},
+	"meta.created": {"t.created_at", "time"},
+}
+
+// scimUserVisible limits a SCIM client to the users it provisioned. Privileged users, by
+// their role, an organization or team they administer or a role assigned to them, are hidden
+// even then, so a client can not take over an admin account, and users that have been
+// deleted or are being erased are hidden too.
+func scimUserVisible(client *SCIMClient) string {
+	return fmt.Sprintf(`ua.scim_client_id = %d and not %s
+		and ua.erasure_requested_at is null and ua.erased_at is null`, client.ID, privilegedUser)
+}
+
+// scimGroupVisible limits a SCIM client to the teams it provisioned and its default team
+func scimGroupVisible(client *SCIMClient) string {
+	return fmt.Sprintf(`(t.scim_client_id = %d or t.id = %d) and t.deleted_at is null`, client.ID, client.DefaultTeamID)
+}
+
+func ValidateSCIMClient(v *validator.Validator, client *SCIMClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must be less than 100 bytes (chars) long")
+	v.Check(strings.Trim(client.Name, "abcdefghijklmnopqrstuvwxyz0123456789-") == "", "name", "must only contain a-z, 0-9 and -")
+	v.Check(client.DefaultTeamID > 0, "default_team_id", "must be provided")
+}
+
+// RegisterClient enrols a SCIM client and its service account. Registering an existing
+// name again only changes its default team.
+func (m SCIMModel) RegisterClient(client *SCIMClient) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select 		id
+		from 		team
+		where 		id = $1 and deleted_at is null
+		for share
+	`
+	var teamID int64
+	err = tx.QueryRowContext(ctx, query, client.DefaultTeamID).Scan(&teamID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	query = `
+		update 		scim_client
+		set 		default_team_id = $1
+		where 		name = $2
+		returning 	id, service_account_id, created_at
+	`
+	err = tx.QueryRowContext(ctx, query, client.DefaultTeamID, client.Name).Scan(&client.ID, &client.ServiceAccountID, &client.CreatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		// provisioning clients never log in with a password
+		var pw password
+		if err = pw.SetUnusable(); err != nil {
+			return err
+		}
+
+		query = `
+			insert into user_account(name, email, password_hash, activated, role, created_at)
+			values ($1, $2, $3, true, $4, now())
+			returning id
+		`
+		args := []interface{}{"scim client " + client.Name, fmt.Sprintf("scim-%s@service.sqlm", client.Name), pw.hash, RoleSCIM}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&client.ServiceAccountID)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			insert into scim_client(name, service_account_id, default_team_id, created_at)
+			values ($1, $2, $3, now())
+			returning id, created_at
+		`
+		err = tx.QueryRowContext(ctx, query, client.Name, client.ServiceAccountID, client.DefaultTeamID).Scan(&client.ID, &client.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetClient returns the SCIMClient acting through a service account
+func (m SCIMModel) GetClient(serviceAccountID int64) (*SCIMClient, error) {
+	query := `
+		select 		id, name, service_account_id, default_team_id, created_at
+		from 		scim_client
+		where 		service_account_id = $1
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	var client SCIMClient
+	err := m.DB.QueryRowContext(ctx, query, serviceAccountID).Scan(&client.ID, &client.Name, &client.ServiceAccountID, &client.DefaultTeamID, &client.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	return &client, nil
+}
+
+// ListUsers returns the users matching a SCIM filter, count of them starting from the
+// 1-based startIndex, and the number of users matching the filter
+func (m SCIMModel) ListUsers(client *SCIMClient, filter string, startIndex int, count int) ([]*ProvisionedUser, int, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := scimUserVisible(client)
+	if filter != "" {
+		cond, err := parseSCIMFilter(filter, scimUserColumns, arg)
+		if err != nil {
+			return nil, 0, err
+		}
+		where += " and " + cond
+	}
+
+	var total int
+	err := m.DB.QueryRowContext(ctx, "select count(*) from user_account as ua where "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users, err := queryProvisionedUsers(ctx, m.DB, client, where+" order by ua.id limit "+arg(count)+" offset "+arg(startIndex-1), args)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// GetUser returns a user visible to a SCIM client
+func (m SCIMModel) GetUser(client *SCIMClient, id int64) (*ProvisionedUser, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	users, err := queryProvisionedUsers(ctx, m.DB, client, scimUserVisible(client)+" and ua.id = $1", []interface{}{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no record found: user %d", id)
+	}
+	return users[0], nil
+}
+
+func queryProvisionedUsers(ctx context.Context, db *sql.DB, client *SCIMClient, where string, args []interface{}) ([]*ProvisionedUser, error) {
+	query := `
+		select 		ua.id, ua.email, coalesce(ua.name, ''), coalesce(ua.scim_external_id, '')
+					, ` + scimUserColumns["active"].expr + `, ua.version, ua.created_at
+		from 		user_account as ua
+		where 		` + where
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*ProvisionedUser{}
+	byID := map[int64]*ProvisionedUser{}
+	var ids []int64
+	for rows.Next() {
+		u := &ProvisionedUser{Groups: []*ProvisionedRef{}}
+		err := rows.Scan(&u.ID, &u.UserName, &u.Name, &u.ExternalID, &u.Active, &u.Version, &u.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+		byID[u.ID] = u
+		ids = append(ids, u.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	query = `
+		select 		ut.user_account_id, t.id, t.name
+		from 		users_teams as ut
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		where 		ut.user_account_id = any($1)
+		and 		` + scimGroupVisible(client) + `
+		order by 	t.id
+	`
+	groups, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer groups.Close()
+
+	for groups.Next() {
+		var userID int64
+		var ref ProvisionedRef
+		if err := groups.Scan(&userID, &ref.ID, &ref.Display); err != nil {
+			return nil, err
+		}
+		byID[userID].Groups = append(byID[userID].Groups, &ref)
+	}
+	return users, groups.Err()
+}
+
+// CreateUser adds a user to the default team of the client. Without a password the user can
+// not log in until one is set.
+func (m SCIMModel) CreateUser(client *SCIMClient, user *ProvisionedUser, plaintext string) error {
+	var pw password
+	var err error
+	if plaintext != "" {
+		err = pw.Set(plaintext)
+	} else {
+		err = pw.SetUnusable()
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role := "user"
+	err = checkMemberQuota(ctx, tx, client.DefaultTeamID, role, 1)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		insert into user_account(name, email, password_hash, activated, role, scim_external_id, scim_client_id, created_at)
+		values (nullif($1, ''), $2, $3, true, $4, nullif($5, ''), $6, now())
+		returning id, version, created_at
+	`
+	args := []interface{}{user.Name, user.UserName, pw.hash, role, user.ExternalID, client.ID}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.Version, &user.CreatedAt)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate email: %w", err)
+		default:
+			return err
+		}
+	}
+
+	query = `
+		insert into users_teams(user_account_id, team_id, is_admin, created_at)
+		values ($1, $2, 0, now())
+	`
+	_, err = tx.ExecContext(ctx, query, user.ID, client.DefaultTeamID)
+	if err != nil {
+		return err
+	}
+
+	if !user.Active {
+		err = setProvisionedActive(ctx, tx, client, user.ID, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// ReplaceUser replaces the attributes of a user if it is still at user.Version. The
+// password is only changed when plaintext is set.
+func (m SCIMModel) ReplaceUser(client *SCIMClient, user *ProvisionedUser, plaintext string) error {
+	var hash interface{}
+	if plaintext != "" {
+		var pw password
+		if err := pw.Set(plaintext); err != nil {
+			return err
+		}
+		hash = pw.hash
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select 		ua.version, ` + scimUserColumns["active"].expr + `
+		from 		user_account as ua
+		where 		` + scimUserVisible(client) + ` and ua.id = $1
+		for update
+	`
+	var version int
+	var active bool
+	err = tx.QueryRowContext(ctx, query, user.ID).Scan(&version, &active)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	if version != user.Version {
+		return fmt.Errorf("precondition failed: user %d is at version %d", user.ID, version)
+	}
+
+	query = `
+		update 		user_account
+		set 		email = $1
+					, name = nullif($2, '')
+					, scim_external_id = nullif($3, '')
+					, password_hash = coalesce($4, password_hash)
+					, version = version + 1
+		where 		id = $5
+		returning 	version
+	`
+	args := []interface{}{user.UserName, user.Name, user.ExternalID, hash, user.ID}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate email: %w", err)
+		default:
+			return err
+		}
+	}
+
+	if user.Active != active {
+		err = setProvisionedActive(ctx, tx, client, user.ID, user.Active)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteUser deprovisions a user. It is suspended, its tokens are revoked and its erasure is
+// requested, so it is hidden from SCIM clients straight away but only erased once the
+// erasure grace period has passed.
+func (m SCIMModel) DeleteUser(client *SCIMClient, id int64) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	reason := "deleted by scim client " + client.Name
+	query := `
+		update 		user_account as ua
+		set 		suspended_at = now()
+					, suspended_reason = $1
+					, suspended_by = $2
+					, reactivate_at = null
+					, erasure_requested_at = now()
+					, version = ua.version + 1
+		where 		` + scimUserVisible(client) + ` and ua.id = $3
+		returning 	ua.id
+	`
+	err = tx.QueryRowContext(ctx, query, reason, client.ServiceAccountID, id).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from token where user_account_id = $1`, id); err != nil {
+		return err
+	}
+	if err = logSuspension(ctx, tx, id, "suspend", reason, client.ServiceAccountID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setProvisionedActive suspends or reactivates a user on behalf of a SCIM client
+func setProvisionedActive(ctx context.Context, tx *sql.Tx, client *SCIMClient, userID int64, active bool) error {
+	reason := "deactivated by scim client " + client.Name
+	query := `
+		update 		user_account
+		set 		suspended_at = now(), suspended_reason = $1, suspended_by = $2, reactivate_at = null
+		where 		id = $3
+	`
+	args := []interface{}{reason, client.ServiceAccountID, userID}
+	action := "suspend"
+	if active {
+		reason = ""
+		query = `
+			update 		user_account
+			set 		suspended_at = null, suspended_reason = null, suspended_by = null, reactivate_at = null
+			where 		id = $1
+		`
+		args = []interface{}{userID}
+		action = "reactivate"
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	return logSuspension(ctx, tx, userID, action, reason, client.ServiceAccountID, nil)
+}
+
+// ListGroups returns the teams matching a SCIM filter, count of them starting from the
+// 1-based startIndex, and the number of teams matching the filter
+func (m SCIMModel) ListGroups(client *SCIMClient, filter string, startIndex int, count int) ([]*ProvisionedGroup, int, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := scimGroupVisible(client)
+	if filter != "" {
+		cond, err := parseSCIMFilter(filter, scimGroupColumns, arg)
+		if err != nil {
+			return nil, 0, err
+		}
+		where += " and " + cond
+	}
+
+	var total int
+	err := m.DB.QueryRowContext(ctx, "select count(*) from team as t where "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groups, err := queryProvisionedGroups(ctx, m.DB, client, where+" order by t.id limit "+arg(count)+" offset "+arg(startIndex-1), args)
+	if err != nil {
+		return nil, 0, err
+	}
+	return groups, total, nil
+}
+
+// GetGroup returns a team visible to a SCIM client
+func (m SCIMModel) GetGroup(client *SCIMClient, id int64) (*ProvisionedGroup, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	groups, err := queryProvisionedGroups(ctx, m.DB, client, scimGroupVisible(client)+" and t.id = $1", []interface{}{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no record found: group %d", id)
+	}
+	return groups[0], nil
+}
+
+func queryProvisionedGroups(ctx context.Context, db *sql.DB, client *SCIMClient, where string, args []interface{}) ([]*ProvisionedGroup, error) {
+	query := `
+		select 		t.id, t.name, coalesce(t.scim_external_id, ''), t.version, t.created_at
+		from 		team as t
+		where 		` + where
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*ProvisionedGroup{}
+	byID := map[int64]*ProvisionedGroup{}
+	var ids []int64
+	for rows.Next() {
+		g := &ProvisionedGroup{Members: []*ProvisionedRef{}}
+		if err := rows.Scan(&g.ID, &g.Name, &g.ExternalID, &g.Version, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+		byID[g.ID] = g
+		ids = append(ids, g.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return groups, nil
+	}
+
+	query = `
+		select 		ut.team_id, ua.id, ua.email
+		from 		users_teams as ut
+		inner join 	user_account as ua
+		on 			ua.id = ut.user_account_id
+		where 		ut.team_id = any($1)
+		and 		` + scimUserVisible(client) + `
+		order by 	ua.id
+	`
+	members, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer members.Close()
+
+	for members.Next() {
+		var teamID int64
+		var ref ProvisionedRef
+		if err := members.Scan(&teamID, &ref.ID, &ref.Display); err != nil {
+			return nil, err
+		}
+		byID[teamID].Members = append(byID[teamID].Members, &ref)
+	}
+	return groups, members.Err()
+}
+
+// CreateGroup adds a team with its members
+func (m SCIMModel) CreateGroup(client *SCIMClient, group *ProvisionedGroup) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		insert into team(name, scim_external_id, scim_client_id, created_at)
+		values ($1, nullif($2, ''), $3, now())
+		returning id, version, created_at
+	`
+	err = tx.QueryRowContext(ctx, query, group.Name, group.ExternalID, client.ID).Scan(&group.ID, &group.Version, &group.CreatedAt)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate name: %w", err)
+		default:
+			return err
+		}
+	}
+
+	if err = setGroupMembers(ctx, tx, client, group); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// ReplaceGroup replaces the name and members of a team if it is still at group.Version
+func (m SCIMModel) ReplaceGroup(client *SCIMClient, group *ProvisionedGroup) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select 		t.version
+		from 		team as t
+		where 		` + scimGroupVisible(client) + ` and t.id = $1
+		for update
+	`
+	var version int
+	err = tx.QueryRowContext(ctx, query, group.ID).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	if version != group.Version {
+		return fmt.Errorf("precondition failed: group %d is at version %d", group.ID, version)
+	}
+
+	query = `
+		update 		team
+		set 		name = $1, scim_external_id = nullif($2, ''), version = version + 1
+		where 		id = $3
+		returning 	version
+	`
+	err = tx.QueryRowContext(ctx, query, group.Name, group.ExternalID, group.ID).Scan(&group.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate name: %w", err)
+		default:
+			return err
+		}
+	}
+
+	if err = setGroupMembers(ctx, tx, client, group); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// DeleteGroup soft deletes a team the client provisioned, members left without a team move
+// to the client's default team, which itself can not be deleted over SCIM
+func (m SCIMModel) DeleteGroup(client *SCIMClient, id int64) error {
+	if id == client.DefaultTeamID {
+		return fmt.Errorf("conflict: group %d is the default team of the scim client", id)
+	}
+	if _, err := m.GetGroup(client, id); err != nil {
+		return err
+	}
+	return TeamModel{DB: m.DB}.Delete(id, client.DefaultTeamID)
+}
+
+// setGroupMembers makes the visible members of a team exactly group.Members. A user removed
+// from their last team is moved to the client's default team, users are never left without
+// a team.
+func setGroupMembers(ctx context.Context, tx *sql.Tx, client *SCIMClient, group *ProvisionedGroup) error {
+	want := map[int64]bool{}
+	for _, member := range group.Members {
+		want[member.ID] = true
+	}
+
+	query := `
+		select 		ua.id
+		from 		users_teams as ut
+		inner join 	user_account as ua
+		on 			ua.id = ut.user_account_id
+		where 		ut.team_id = $1
+		and 		` + scimUserVisible(client)
+	have := map[int64]bool{}
+	rows, err := tx.QueryContext(ctx, query, group.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		have[id] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id := range want {
+		if have[id] {
+			continue
+		}
+		var role string
+		query = `select ua.role from user_account as ua where ` + scimUserVisible(client) + ` and ua.id = $1`
+		err = tx.QueryRowContext(ctx, query, id).Scan(&role)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return fmt.Errorf("invalid member: user %d does not exist", id)
+			default:
+				return err
+			}
+		}
+		if err = checkMemberQuota(ctx, tx, group.ID, role, 1); err != nil {
+			return err
+		}
+		query = `
+			insert into users_teams(user_account_id, team_id, is_admin, created_at)
+			values ($1, $2, 0, now())
+		`
+		if _, err = tx.ExecContext(ctx, query, id, group.ID); err != nil {
+			return err
+		}
+	}
+
+	for id := range have {
+		if want[id] {
+			continue
+		}
+		query = `delete from users_teams where team_id = $1 and user_account_id = $2`
+		if _, err = tx.ExecContext(ctx, query, group.ID, id); err != nil {
+			return err
+		}
+		query = `
+			insert into users_teams(user_account_id, team_id, is_admin, created_at)
+			select 		$1, $2, 0, now()
+			where 		not exists (
+							select 		1
+							from 		users_teams as ut
+							inner join 	team as t
+							on 			t.id = ut.team_id
+							where 		ut.user_account_id = $1
+							and 		t.deleted_at is null
+						)
+		`
+		if _, err = tx.ExecContext(ctx, query, id, client.DefaultTeamID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// scimColumn is the sql expression a SCIM attribute is filtered on and the kind of value
+// it holds, one of string, bool or time
+type scimColumn struct {
+	expr string
+	kind string
+}
+
+// scimFilter translates a SCIM filter (RFC 7644 section 3.4.2.2) into a sql condition.
+// Attribute names are case insensitive and may carry their schema urn, string comparisons
+// are case insensitive. Values are passed to the query through arg.
+type scimFilter struct {
+	tokens  []string
+	pos     int
+	columns map[string]scimColumn
+	arg     func(v interface{}) string
+}
+
+// parseSCIMFilter returns the sql condition for filter over columns
+func parseSCIMFilter(filter string, columns map[string]scimColumn, arg func(v interface{}) string) (string, error) {
+	tokens, err := scimTokens(filter)
+	if err != nil {
+		return "", err
+	}
+	f := &scimFilter{tokens: tokens, columns: columns, arg: arg}
+	cond, err := f.or()
+	if err != nil {
+		return "", err
+	}
+	if f.pos != len(f.tokens) {
+		return "", fmt.Errorf("invalid filter: unexpected %q", f.tokens[f.pos])
+	}
+	return cond, nil
+}
+
+// scimTokens splits a filter into parentheses, quoted strings and words. Quoted strings
+// keep their quotes so they can be told apart from words.
+func scimTokens(filter string) ([]string, error) {
+	var tokens []string
+	rs := []rune(filter)
+	for i := 0; i < len(rs); {
+		switch r := rs[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '"':
+			j := i + 1
+			for ; j < len(rs) && rs[j] != '"'; j++ {
+				if rs[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("invalid filter: unterminated string")
+			}
+			tokens = append(tokens, string(rs[i:j+1]))
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(rs) && !unicode.IsSpace(rs[j]) && rs[j] != '(' && rs[j] != ')'; j++ {
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("invalid filter: it is empty")
+	}
+	return tokens, nil
+}
+
+func (f *scimFilter) peek() string {
+	if f.pos < len(f.tokens) {
+		return f.tokens[f.pos]
+	}
+	return ""
+}
+
+func (f *scimFilter) next() (string, error) {
+	if f.pos >= len(f.tokens) {
+		return "", fmt.Errorf("invalid filter: it ends too early")
+	}
+	f.pos++
+	return f.tokens[f.pos-1], nil
+}
+
+func (f *scimFilter) or() (string, error) {
+	cond, err := f.and()
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(f.peek(), "or") {
+		f.pos++
+		right, err := f.and()
+		if err != nil {
+			return "", err
+		}
+		cond = "(" + cond + " or " + right + ")"
+	}
+	return cond, nil
+}
+
+func (f *scimFilter) and() (string, error) {
+	cond, err := f.unary()
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(f.peek(), "and") {
+		f.pos++
+		right, err := f.unary()
+		if err != nil {
+			return "", err
+		}
+		cond = "(" + cond + " and " + right + ")"
+	}
+	return cond, nil
+}
+
+func (f *scimFilter) unary() (string, error) {
+	tok, err := f.next()
+	if err != nil {
+		return "", err
+	}
+
+	negate := false
+	if strings.EqualFold(tok, "not") {
+		negate = true
+		if tok, err = f.next(); err != nil {
+			return "", err
+		}
+		if tok != "(" {
+			return "", fmt.Errorf("invalid filter: not must be followed by (")
+		}
+	}
+
+	if tok == "(" {
+		cond, err := f.or()
+		if err != nil {
+			return "", err
+		}
+		if tok, err = f.next(); err != nil || tok != ")" {
+			return "", fmt.Errorf("invalid filter: missing )")
+		}
+		if negate {
+			return "not (" + cond + ")", nil
+		}
+		return "(" + cond + ")", nil
+	}
+
+	return f.comparison(tok)
+}
+
+func (f *scimFilter) comparison(attr string) (string, error) {
+	name := strings.ToLower(attr)
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	col, ok := f.columns[name]
+	if !ok {
+		return "", fmt.Errorf("invalid filter: %s can not be filtered on", attr)
+	}
+
+	op, err := f.next()
+	if err != nil {
+		return "", err
+	}
+	op = strings.ToLower(op)
+	if op == "pr" {
+		if col.kind == "string" {
+			return fmt.Sprintf("coalesce(%s, '') <> ''", col.expr), nil
+		}
+		return fmt.Sprintf("%s is not null", col.expr), nil
+	}
+
+	raw, err := f.next()
+	if err != nil {
+		return "", err
+	}
+
+	switch col.kind {
+	case "bool":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid filter: %s must be compared with true or false", attr)
+		}
+		switch op {
+		case "eq":
+			return fmt.Sprintf("%s = %s", col.expr, f.arg(b)), nil
+		case "ne":
+			return fmt.Sprintf("%s <> %s", col.expr, f.arg(b)), nil
+		}
+	case "time":
+		s, err := unquote(raw)
+		if err != nil {
+			return "", err
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return "", fmt.Errorf("invalid filter: %s must be compared with an RFC 3339 time", attr)
+		}
+		if sqlOp, ok := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}[op]; ok {
+			return fmt.Sprintf("%s %s %s", col.expr, sqlOp, f.arg(t)), nil
+		}
+	default:
+		s, err := unquote(raw)
+		if err != nil {
+			return "", err
+		}
+		expr := fmt.Sprintf("lower(coalesce(%s, ''))", col.expr)
+		s = strings.ToLower(s)
+		switch op {
+		case "eq":
+			return fmt.Sprintf("%s = %s", expr, f.arg(s)), nil
+		case "ne":
+			return fmt.Sprintf("%s <> %s", expr, f.arg(s)), nil
+		case "co":
+			return fmt.Sprintf("%s like %s", expr, f.arg("%"+escapeLike(s)+"%")), nil
+		case "sw":
+			return fmt.Sprintf("%s like %s", expr, f.arg(escapeLike(s)+"%")), nil
+		case "ew":
+			return fmt.Sprintf("%s like %s", expr, f.arg("%"+escapeLike(s))), nil
+		case "gt", "ge", "lt", "le":
+			sqlOp := map[string]string{"gt": ">", "ge": ">=", "lt": "<", "le": "<="}[op]
+			return fmt.Sprintf("%s %s %s", expr, sqlOp, f.arg(s)), nil
+		}
+	}
+	return "", fmt.Errorf("invalid filter: %s does not support %s", attr, op)
+}
+
+// unquote returns the value of a quoted string token
+func unquote(tok string) (string, error) {
+	if len(tok) < 2 || tok[0] != '"' {
+		return "", fmt.Errorf("invalid filter: %s must be a quoted string", tok)
+	}
+	s, err := strconv.Unquote(tok)
+	if err != nil {
+		return "", fmt.Errorf("invalid filter: %s is not a valid string", tok)
+	}
+	return s, nil
+}
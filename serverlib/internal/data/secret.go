@@ -0,0 +1,290 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+const (
+	SecretSSHKey     = "ssh_key"
+	SecretHTTPSToken = "https_token"
+)
+
+// the actions recorded in the secret audit trail, reads that were refused or could not be
+// completed are recorded as read_denied and read_failed
+const (
+	SecretActionWrite      = "write"
+	SecretActionRead       = "read"
+	SecretActionDelete     = "delete"
+	SecretActionReadDenied = "read_denied"
+	SecretActionReadFailed = "read_failed"
+)
+
+var secretNameRX = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Secret is a git credential for a Team's repository, encrypted at rest
+type Secret struct {
+	ID         int64     `json:"id"`
+	TeamID     int64     `json:"team_id"`
+	Name       string    `json:"name"`
+	Kind       string    `json:"kind"`
+	Ciphertext []byte    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Version    int       `json:"version"`
+}
+
+// SecretAccess is an audit entry for a write, read or delete of a Secret
+type SecretAccess struct {
+	TeamID        int64     `json:"team_id"`
+	Name          string    `json:"name"`
+	UserAccountID int64     `json:"user_account_id"`
+	Action        string    `json:"action"`
+	IP            string    `json:"ip"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SecretModel wraps the connection pool
+type SecretModel struct {
+	DB *sql.DB
+}
+
+func ValidateSecret(v *validator.Validator, secret *Secret, value string) {
+	v.Check(secret.Name != "", "name", "must be provided")
+	v.Check(len(secret.Name) <= 100, "name", "must be less than 100 bytes (chars) long")
+	v.Check(secretNameRX.MatchString(secret.Name), "name", "must only contain lower case letters, numbers, - and _")
+	v.Check(validator.In(secret.Kind, SecretSSHKey, SecretHTTPSToken), "kind", "must be one of ssh_key or https_token")
+	v.Check(value != "", "value", "must be provided")
+	v.Check(len(value) <= 16384, "value", "must be less than 16KB")
+	if secret.Kind == SecretSSHKey {
+		v.Check(strings.Contains(value, "PRIVATE KEY"), "value", "must be a PEM encoded private key")
+	}
+}
+
+// Put creates or replaces a Secret against the Team's team_meta, access is recorded in the
+// audit trail in the same transaction
+func (m SecretModel) Put(secret *Secret, access *SecretAccess) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	metaID, err := ensureTeamMeta(ctx, tx, secret.TeamID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `
+		insert into team_secret(team_meta_id, name, kind, ciphertext, created_at, updated_at)
+		values ($1, $2, $3, $4, now(), now())
+		on conflict (team_meta_id, name)
+		do update set 	kind = excluded.kind
+						, ciphertext = excluded.ciphertext
+						, updated_at = now()
+						, version = team_secret.version + 1
+		returning id, created_at, updated_at, version
+	`
+	args := []interface{}{metaID, secret.Name, secret.Kind, secret.Ciphertext}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&secret.ID, &secret.CreatedAt, &secret.UpdatedAt, &secret.Version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = logAccess(ctx, tx, access)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get returns a Secret, including its ciphertext, for a Team
+func (m SecretModel) Get(teamID int64, name string) (*Secret, error) {
+	query := `
+		select 		s.id, t.id, s.name, s.kind, s.ciphertext, s.created_at, s.updated_at, s.version
+		from 		team_secret as s
+		inner join 	team as t
+		on 			t.team_meta_id = s.team_meta_id
+		where 		t.id = $1 and s.name = $2
+		and 		t.deleted_at is null
+	`
+	var secret Secret
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, teamID, name).Scan(
+		&secret.ID,
+		&secret.TeamID,
+		&secret.Name,
+		&secret.Kind,
+		&secret.Ciphertext,
+		&secret.CreatedAt,
+		&secret.UpdatedAt,
+		&secret.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	return &secret, nil
+}
+
+// List returns the Secrets for a Team without their ciphertext
+func (m SecretModel) List(teamID int64) ([]*Secret, error) {
+	query := `
+		select 		s.id, t.id, s.name, s.kind, s.created_at, s.updated_at, s.version
+		from 		team_secret as s
+		inner join 	team as t
+		on 			t.team_meta_id = s.team_meta_id
+		where 		t.id = $1
+		order by 	s.name
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []*Secret{}
+	for rows.Next() {
+		var secret Secret
+		err := rows.Scan(
+			&secret.ID,
+			&secret.TeamID,
+			&secret.Name,
+			&secret.Kind,
+			&secret.CreatedAt,
+			&secret.UpdatedAt,
+			&secret.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, &secret)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// Delete removes a Secret from a Team, access is recorded in the audit trail in the same
+// transaction
+func (m SecretModel) Delete(teamID int64, name string, access *SecretAccess) error {
+	query := `
+		delete from team_secret as s
+		using 		team as t
+		where 		t.team_meta_id = s.team_meta_id
+		and 		t.id = $1 and s.name = $2
+		returning 	s.id
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, query, teamID, name).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	err = logAccess(ctx, tx, access)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LogAccess records a SecretAccess in the audit trail. TeamID is zero for a denied read by
+// a caller that has no team.
+func (m SecretModel) LogAccess(access *SecretAccess) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	return logAccess(ctx, m.DB, access)
+}
+
+func logAccess(ctx context.Context, q querier, access *SecretAccess) error {
+	query := `
+		insert into team_secret_audit(team_id, name, user_account_id, action, ip, created_at)
+		values (nullif($1, 0), $2, nullif($3, 0), $4, $5, now())
+		returning created_at
+	`
+	args := []interface{}{access.TeamID, access.Name, access.UserAccountID, access.Action, access.IP}
+
+	return q.QueryRowContext(ctx, query, args...).Scan(&access.CreatedAt)
+}
+
+// GetAccessLog returns the audit trail of a Team's Secrets, most recent first
+func (m SecretModel) GetAccessLog(teamID int64) ([]*SecretAccess, error) {
+	query := `
+		select 		coalesce(team_id, 0), name, coalesce(user_account_id, 0), action, coalesce(ip, ''), created_at
+		from 		team_secret_audit
+		where 		team_id = $1
+		order by 	created_at desc, id desc
+		limit 		500
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	log := []*SecretAccess{}
+	for rows.Next() {
+		var access SecretAccess
+		err := rows.Scan(
+			&access.TeamID,
+			&access.Name,
+			&access.UserAccountID,
+			&access.Action,
+			&access.IP,
+			&access.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		log = append(log, &access)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
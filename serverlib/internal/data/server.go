@@ -0,0 +1,200 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+// Server is a sql-manager server enrolled with auth-manager on behalf of a Team
+type Server struct {
+	ID               int64     `json:"id"`
+	TeamID           int64     `json:"team_id"`
+	ServerURL        string    `json:"server_url"`
+	ServiceAccountID int64     `json:"service_account_id"`
+	CreatedAt        time.Time `json:"created_at"`
+	Version          int       `json:"version"`
+}
+
+// ServerModel wraps the connection pool
+type ServerModel struct {
+	DB *sql.DB
+}
+
+func ValidateServer(v *validator.Validator, server *Server) {
+	v.Check(server.ServerURL != "", "server_url", "must be provided")
+	v.Check(len(server.ServerURL) <= 500, "server_url", "must be less than 500 bytes (chars) long")
+	u, err := url.Parse(server.ServerURL)
+	v.Check(err == nil && u.Host != "" && validator.In(u.Scheme, "http", "https"), "server_url", "must be a valid http(s) url")
+}
+
+// Register enrols a sql-manager server for a Team. The server acts through a service account
+// that is a member of the Team, registering again replaces the team's server_url
+func (m ServerModel) Register(server *Server) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	metaID, err := ensureTeamMeta(ctx, tx, server.TeamID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `
+		select 	service_account_id
+		from 	team_server
+		where 	team_id = $1
+	`
+	err = tx.QueryRowContext(ctx, query, server.TeamID).Scan(&server.ServiceAccountID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return err
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		err = checkMemberQuota(ctx, tx, server.TeamID, RoleService, 1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// service accounts never log in with a password
+		var pw password
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := pw.Set(fmt.Sprintf("%x", secret)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		query = `
+			insert into user_account(name, email, password_hash, activated, role, created_at)
+			values ($1, $2, $3, true, $4, now())
+			returning id
+		`
+		args := []interface{}{
+			"sql-manager server",
+			fmt.Sprintf("server-%d@service.sqlm", server.TeamID),
+			pw.hash,
+			RoleService,
+		}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&server.ServiceAccountID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		query = `
+			insert into users_teams(user_account_id, team_id, is_admin, created_at)
+			values ($1, $2, 0, now())
+		`
+		_, err = tx.ExecContext(ctx, query, server.ServiceAccountID, server.TeamID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	query = `
+		insert into team_server(team_id, server_url, service_account_id, created_at)
+		values ($1, $2, $3, now())
+		on conflict (team_id)
+		do update set 	server_url = excluded.server_url
+						, updated_at = now()
+						, version = team_server.version + 1
+		returning id, created_at, version
+	`
+	args := []interface{}{server.TeamID, server.ServerURL, server.ServiceAccountID}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&server.ID, &server.CreatedAt, &server.Version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query = `
+		update 		team_meta
+		set 		server_url = $1
+					, updated_at = now()
+					, version = version + 1
+		where 		id = $2
+	`
+	_, err = tx.ExecContext(ctx, query, server.ServerURL, metaID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetForTeam returns the Server registered for a Team
+func (m ServerModel) GetForTeam(teamID int64) (*Server, error) {
+	query := `
+		select 	id, team_id, server_url, service_account_id, created_at, version
+		from 	team_server
+		where 	team_id = $1
+	`
+	return m.get(query, teamID)
+}
+
+// GetForMember returns the Server registered for a Team the user belongs to
+func (m ServerModel) GetForMember(teamID int64, userID int64) (*Server, error) {
+	query := `
+		select 	s.id, s.team_id, s.server_url, s.service_account_id, s.created_at, s.version
+		from 	team_server as s
+		inner 	join users_teams as ut
+		on 		ut.team_id = s.team_id
+		where 	s.team_id = $1
+		and 	ut.user_account_id = $2
+	`
+	return m.get(query, teamID, userID)
+}
+
+// GetForServiceAccount returns the Server that a service account acts for
+func (m ServerModel) GetForServiceAccount(userID int64) (*Server, error) {
+	query := `
+		select 	id, team_id, server_url, service_account_id, created_at, version
+		from 	team_server
+		where 	service_account_id = $1
+	`
+	return m.get(query, userID)
+}
+
+func (m ServerModel) get(query string, args ...interface{}) (*Server, error) {
+	var server Server
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&server.ID,
+		&server.TeamID,
+		&server.ServerURL,
+		&server.ServiceAccountID,
+		&server.CreatedAt,
+		&server.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	return &server, nil
+}
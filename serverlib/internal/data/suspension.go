@@ -0,0 +1,197 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+// Suspension describes why and by whom a UserAccount was suspended. A suspension with a
+// ReactivateAt ends by itself at that time.
+type Suspension struct {
+	Reason       string     `json:"reason"`
+	SuspendedBy  *int64     `json:"suspended_by"`
+	SuspendedAt  time.Time  `json:"suspended_at"`
+	ReactivateAt *time.Time `json:"reactivate_at,omitempty"`
+}
+
+// SuspensionEvent is an entry in the suspension history of a UserAccount
+type SuspensionEvent struct {
+	ID            int64      `json:"id"`
+	UserAccountID int64      `json:"user_account_id"`
+	Action        string     `json:"action"`
+	Reason        string     `json:"reason,omitempty"`
+	ActorID       *int64     `json:"actor_id"`
+	ReactivateAt  *time.Time `json:"reactivate_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// suspensionColumns are the suspension columns of a user_account row
+type suspensionColumns struct {
+	at     *time.Time
+	reason string
+	by     *int64
+	until  *time.Time
+}
+
+// suspension returns the Suspension in force, nil once it has been lifted or has expired
+func (s suspensionColumns) suspension() *Suspension {
+	if s.at == nil || (s.until != nil && !s.until.After(time.Now())) {
+		return nil
+	}
+	return &Suspension{Reason: s.reason, SuspendedBy: s.by, SuspendedAt: *s.at, ReactivateAt: s.until}
+}
+
+// IsSuspended returns true if the UserAccount is suspended
+func (m *UserAccount) IsSuspended() bool {
+	return m.Suspension != nil
+}
+
+func ValidateSuspension(v *validator.Validator, reason string, until *time.Time) {
+	v.Check(reason != "", "reason", "must be provided")
+	v.Check(len(reason) <= 500, "reason", "must be less than 500 bytes (chars) long")
+	if until != nil {
+		v.Check(until.After(time.Now()), "reactivate_at", "must be in the future")
+	}
+}
+
+// Suspend suspends a UserAccount, until it is reactivated or until reactivateAt when it is
+// set. Its team memberships and tokens are kept, but it can no longer authenticate.
+func (m UserAccountModel) Suspend(userID int64, actorID int64, reason string, reactivateAt *time.Time) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		update 		user_account
+		set 		suspended_at = now(), suspended_reason = $1, suspended_by = $2
+					, reactivate_at = $3, version = version + 1
+		where 		id = $4
+		returning 	id
+	`
+	var id int64
+	err = tx.QueryRowContext(ctx, query, reason, actorID, reactivateAt, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	err = logSuspension(ctx, tx, userID, "suspend", reason, actorID, reactivateAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reactivate lifts the suspension of a UserAccount
+func (m UserAccountModel) Reactivate(userID int64, actorID int64) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		update 		user_account
+		set 		suspended_at = null, suspended_reason = null, suspended_by = null
+					, reactivate_at = null, version = version + 1
+		where 		id = $1
+		and 		suspended_at is not null
+		and 		(reactivate_at is null or reactivate_at > now())
+		returning 	id
+	`
+	var id int64
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: user %d is not suspended", userID)
+		default:
+			return err
+		}
+	}
+
+	err = logSuspension(ctx, tx, userID, "reactivate", "", actorID, nil)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSuspensionHistory returns the suspensions and reactivations of a UserAccount, most
+// recent first
+func (m UserAccountModel) GetSuspensionHistory(userID int64) ([]*SuspensionEvent, error) {
+	query := `
+		select 		id, user_account_id, action, coalesce(reason, ''), actor_id, reactivate_at, created_at
+		from 		user_account_suspension
+		where 		user_account_id = $1
+		order by 	created_at desc, id desc
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*SuspensionEvent{}
+	for rows.Next() {
+		var e SuspensionEvent
+		err := rows.Scan(&e.ID, &e.UserAccountID, &e.Action, &e.Reason, &e.ActorID, &e.ReactivateAt, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func logSuspension(ctx context.Context, tx *sql.Tx, userID int64, action string, reason string, actorID int64, reactivateAt *time.Time) error {
+	query := `
+		insert into user_account_suspension(user_account_id, action, reason, actor_id, reactivate_at, created_at)
+		values ($1, $2, nullif($3, ''), nullif($4, 0), $5, now())
+	`
+	_, err := tx.ExecContext(ctx, query, userID, action, reason, actorID, reactivateAt)
+	return err
+}
+
+// checkSuspended returns an error if the UserAccount is suspended
+func checkSuspended(ctx context.Context, db *sql.DB, userID int64) error {
+	query := `
+		select 		coalesce(suspended_reason, '')
+		from 		user_account
+		where 		id = $1
+		and 		suspended_at is not null
+		and 		(reactivate_at is null or reactivate_at > now())
+	`
+	var reason string
+	err := db.QueryRowContext(ctx, query, userID).Scan(&reason)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	}
+	return fmt.Errorf("account suspended: %s", reason)
+}
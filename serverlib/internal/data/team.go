@@ -5,24 +5,29 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 // Team represents the domain for our team entity
 type Team struct {
-	ID           int64          `json:"id"`
-	Name         string         `json:"name"`
-	CreatedAt    time.Time      `json:"created_at"`
-	Version      int            `json:"version"`
-	NumMembers   int            `json:"num_members"`
-	Meta         meta           `json:"meta"`
-	UserAccounts []*UserAccount `json:"user_accounts"`
+	ID             int64          `json:"id"`
+	Name           string         `json:"name"`
+	CreatedAt      time.Time      `json:"created_at"`
+	Version        int            `json:"version"`
+	NumMembers     int            `json:"num_members"`
+	OrganizationID int64          `json:"organization_id"`
+	OwnerID        int64          `json:"owner_id"`
+	DeletedAt      *time.Time     `json:"deleted_at,omitempty"`
+	Meta           meta           `json:"meta"`
+	UserAccounts   []*UserAccount `json:"user_accounts"`
 }
 
 type meta struct {
-	GitURL    string `json:"git_url"`
-	ServerURL string `json:"server_url"`
-	Version   int64  `json:"version"`
-	ID        int64  `json:"id"`
+	GitURL     string     `json:"git_url"`
+	ServerURL  string     `json:"server_url"`
+	Attributes Attributes `json:"attributes"`
+	Version    int64      `json:"version"`
+	ID         int64      `json:"id"`
 }
 // TeamModel wraps the connection pool
 type TeamModel struct {
@@ -31,47 +36,54 @@ type TeamModel struct {
 
 // Add adds a Team into the database
 func (m TeamModel) Add(team *Team) error {
-	query := `
-		insert into team(name, created_at)
-		values ($1 , now())
-		returning id, created_at, version
-	`
-	args := []interface{}{team.Name}
 	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
-
 	defer cancle()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&team.ID, &team.CreatedAt, &team.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	query = `
+	query := `
 		insert into team_meta(git_url, server_url, created_at)
 		values ($1, $2, now())
 		returning id
 	`
-	args = []interface{}{team.Meta.GitURL, team.Meta.ServerURL}
-	ctx, cancle = context.WithTimeout(context.Background(), 3*time.Second)
+	args := []interface{}{team.Meta.GitURL, team.Meta.ServerURL}
 
-	defer cancle()
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&team.Meta.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&team.Meta.ID)
+	query = `
+		insert into team(name, team_meta_id, created_at)
+		values ($1 , $2, now())
+		returning id, created_at, version
+	`
+	args = []interface{}{team.Name, team.Meta.ID}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&team.ID, &team.CreatedAt, &team.Version)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 // Get returns the Team for a given Team ID
 func (m TeamModel) Get(id int64) (*Team, error) {
 	query := `
-		select 		t.id, t.created_at, t.name, t.version, tm.id, tm.git_url, tm.server_url
+		select 		t.id, t.created_at, t.name, t.version
+					, coalesce(t.organization_id, 0), coalesce(t.owner_id, 0), t.deleted_at
+					, coalesce(tm.id, 0), coalesce(tm.git_url, ''), coalesce(tm.server_url, '')
+					, coalesce(tm.attributes, '{}')
 		from 		team as t
-		inner join	team_meta as tm
+		left join	team_meta as tm
 		on			t.team_meta_id = tm.id
-		where		id = $1
+		where		t.id = $1
 	`
 
 	var team Team
@@ -84,9 +96,13 @@ func (m TeamModel) Get(id int64) (*Team, error) {
 		&team.CreatedAt,
 		&team.Name,
 		&team.Version,
+		&team.OrganizationID,
+		&team.OwnerID,
+		&team.DeletedAt,
 		&team.Meta.ID,
 		&team.Meta.GitURL,
 		&team.Meta.ServerURL,
+		&team.Meta.Attributes,
 	)
 
 	if err != nil {
@@ -167,3 +183,435 @@ func (m TeamModel) Update(team *Team) error {
 
 	return nil
 }
+
+// Stranded returns the members of a Team that do not belong to any other active Team
+func (m TeamModel) Stranded(teamID int64) ([]*UserAccount, error) {
+	query := `
+		select 		ua.id, ua.email, ua.role
+		from 		users_teams as ut
+		inner join 	user_account as ua
+		on 			ua.id = ut.user_account_id
+		where 		ut.team_id = $1
+		and 		not exists (
+						select 		1
+						from 		users_teams as ut2
+						inner join 	team as t2
+						on 			t2.id = ut2.team_id
+						where 		ut2.user_account_id = ut.user_account_id
+						and 		ut2.team_id <> $1
+						and 		t2.deleted_at is null
+					)
+		order by 	ua.id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*UserAccount{}
+	for rows.Next() {
+		var user UserAccount
+		if err := rows.Scan(&user.ID, &user.Email, &user.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Delete soft deletes a Team. Members left without another team are moved into the
+// reassignTo Team, when reassignTo is 0 the delete is blocked if any such members exist
+func (m TeamModel) Delete(teamID int64, reassignTo int64) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to delete %w", err)
+	}
+
+	query := `
+		select 		id
+		from 		team
+		where 		id = $1 and deleted_at is null
+		for update
+	`
+	var id int64
+	err = tx.QueryRowContext(ctx, query, teamID).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	// scim clients add the users they provision to their default team
+	query = `
+		select 		exists (select 1 from scim_client where default_team_id = $1)
+	`
+	var isDefault bool
+	err = tx.QueryRowContext(ctx, query, teamID).Scan(&isDefault)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if isDefault {
+		tx.Rollback()
+		return fmt.Errorf("conflict: team %d is the default team of a scim client", teamID)
+	}
+
+	if reassignTo != 0 {
+		query = `
+			select 		id
+			from 		team
+			where 		id = $1 and id <> $2 and deleted_at is null
+		`
+		err = tx.QueryRowContext(ctx, query, reassignTo, teamID).Scan(&id)
+		if err != nil {
+			tx.Rollback()
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return fmt.Errorf("no record found for reassignment team: %w", err)
+			default:
+				return err
+			}
+		}
+	}
+
+	query = `
+		with stranded as (
+			select 		ut.user_account_id
+			from 		users_teams as ut
+			where 		ut.team_id = $1
+			and 		not exists (
+							select 		1
+							from 		users_teams as ut2
+							inner join 	team as t2
+							on 			t2.id = ut2.team_id
+							where 		ut2.user_account_id = ut.user_account_id
+							and 		ut2.team_id <> $1
+							and 		t2.deleted_at is null
+						)
+		)
+		select count(*) from stranded
+	`
+	var stranded int
+	err = tx.QueryRowContext(ctx, query, teamID).Scan(&stranded)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if stranded > 0 && reassignTo == 0 {
+		tx.Rollback()
+		return fmt.Errorf("conflict: %d members have no other team", stranded)
+	}
+
+	if stranded > 0 {
+		err = checkQuota(ctx, tx, reassignTo, QuotaMembers, stranded)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		query = `
+			insert into users_teams(user_account_id, team_id, is_admin, created_at)
+			select 		ut.user_account_id, $2, 0, now()
+			from 		users_teams as ut
+			where 		ut.team_id = $1
+			and 		not exists (
+							select 		1
+							from 		users_teams as ut2
+							inner join 	team as t2
+							on 			t2.id = ut2.team_id
+							where 		ut2.user_account_id = ut.user_account_id
+							and 		ut2.team_id <> $1
+							and 		t2.deleted_at is null
+						)
+		`
+		_, err = tx.ExecContext(ctx, query, teamID, reassignTo)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	query = `
+		update 		team
+		set 		deleted_at = now()
+					, updated_at = now()
+					, version = version + 1
+		where 		id = $1
+	`
+	_, err = tx.ExecContext(ctx, query, teamID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// Restore brings back a soft deleted Team that is still within its grace period
+func (m TeamModel) Restore(teamID int64, grace time.Duration) error {
+	query := `
+		update 		team
+		set 		deleted_at = null
+					, updated_at = now()
+					, version = version + 1
+		where 		id = $1
+		and 		deleted_at is not null
+		and 		deleted_at > $2
+		returning 	version
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	var version int
+	err := m.DB.QueryRowContext(ctx, query, teamID, time.Now().Add(-grace)).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// Purge permanently removes Teams, and their team_meta, soft deleted longer ago than grace
+func (m TeamModel) Purge(grace time.Duration) (int64, error) {
+	query := `
+		with purged as (
+			delete from team
+			where 		deleted_at is not null
+			and 		deleted_at <= $1
+			and 		id not in (select default_team_id from scim_client)
+			returning 	team_meta_id
+		), meta as (
+			delete from team_meta
+			where 		id in (select team_meta_id from purged)
+		)
+		select count(*) from purged
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	var n int64
+	err := m.DB.QueryRowContext(ctx, query, time.Now().Add(-grace)).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		permissionsChanged(m.DB)
+	}
+	return n, nil
+}
+
+// TransferOwnership makes a member of the Team its owner and a team admin. The previous owner
+// stays a team admin.
+func (m TeamModel) TransferOwnership(teamID int64, userID int64) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to transfer %w", err)
+	}
+
+	query := `
+		update 		users_teams
+		set 		is_admin = 1
+					, version = version + 1
+		where 		team_id = $1 and user_account_id = $2
+	`
+	res, err := tx.ExecContext(ctx, query, teamID, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("user is not a member of the team: %w", sql.ErrNoRows)
+	}
+
+	query = `
+		update 		team
+		set 		owner_id = $1
+					, updated_at = now()
+					, version = version + 1
+		where 		id = $2 and deleted_at is null
+		returning 	version
+	`
+	var version int
+	err = tx.QueryRowContext(ctx, query, userID, teamID).Scan(&version)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// AddMember adds a UserAccount to the Team, within the Team's seat limits
+func (m TeamModel) AddMember(teamID int64, user *UserAccount, isAdmin bool) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		select 		id
+		from 		team
+		where 		id = $1 and deleted_at is null
+		for update
+	`
+	var id int64
+	err = tx.QueryRowContext(ctx, query, teamID).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+
+	err = checkMemberQuota(ctx, tx, teamID, user.Role, 1)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	admin := 0
+	if isAdmin {
+		admin = 1
+	}
+
+	query = `
+		insert into users_teams(user_account_id, team_id, is_admin, created_at)
+		values ($1, $2, $3, now())
+	`
+	_, err = tx.ExecContext(ctx, query, user.ID, teamID, admin)
+	if err != nil {
+		tx.Rollback()
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate member: %w", err)
+		default:
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// RemoveMember removes a UserAccount from the Team, a user is never left without a team
+func (m TeamModel) RemoveMember(teamID int64, userID int64) error {
+	query := `
+		delete from users_teams as ut
+		where 		ut.team_id = $1
+		and 		ut.user_account_id = $2
+		and 		exists (
+						select 		1
+						from 		users_teams as ut2
+						inner join 	team as t2
+						on 			t2.id = ut2.team_id
+						where 		ut2.user_account_id = ut.user_account_id
+						and 		ut2.team_id <> $1
+						and 		t2.deleted_at is null
+					)
+		returning 	ut.id
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	var id int64
+	err := m.DB.QueryRowContext(ctx, query, teamID, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("conflict: user is not a member or has no other team: %w", err)
+		default:
+			return err
+		}
+	}
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// ensureTeamMeta returns the team_meta ID for a Team, creating the row for teams that were
+// created without one
+func ensureTeamMeta(ctx context.Context, tx *sql.Tx, teamID int64) (int64, error) {
+	query := `
+		select 		coalesce(team_meta_id, 0)
+		from 		team
+		where 		id = $1 and deleted_at is null
+		for update
+	`
+	var metaID int64
+	err := tx.QueryRowContext(ctx, query, teamID).Scan(&metaID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, fmt.Errorf("no record found: %w", err)
+		default:
+			return 0, err
+		}
+	}
+	if metaID != 0 {
+		return metaID, nil
+	}
+
+	query = `
+		with meta as (
+			insert into team_meta(created_at)
+			values (now())
+			returning id
+		)
+		update 		team
+		set 		team_meta_id = (select id from meta)
+		where 		id = $1
+		returning 	team_meta_id
+	`
+	err = tx.QueryRowContext(ctx, query, teamID).Scan(&metaID)
+	return metaID, err
+}
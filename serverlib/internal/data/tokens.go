@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"strings"
 
 	// "hash"
 	"time"
@@ -14,8 +15,17 @@ import (
 )
 
 const (
-	ScopeLogin = "login"
-	ScopeRO    = "ro"
+	ScopeLogin   = "login"
+	ScopeRO      = "ro"
+	ScopeService = "service"
+	// ScopeEmailChange tokens confirm the pending email of a UserAccount
+	ScopeEmailChange = "email-change"
+	// ScopeInvite tokens let an invited UserAccount choose its password
+	ScopeInvite = "invite"
+	// ScopeSCIM tokens authenticate a SCIM provisioning client
+	ScopeSCIM = "scim"
+	// ScopeImpersonation tokens let an admin, the token's actor, act as another UserAccount
+	ScopeImpersonation = "impersonation"
 )
 // Token defines the domain for the Token entity
 type Token struct {
@@ -24,6 +34,10 @@ type Token struct {
 	UserAccountID int64     `json:"user_account_id"`
 	Expiry        time.Time `json:"expiry"`
 	Scope         string    `json:"scope"`
+	Audience      string    `json:"audience,omitempty"`
+	MFA           bool      `json:"mfa"`
+	// ActorID is the admin acting through an impersonation token
+	ActorID int64 `json:"actor_id,omitempty"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -42,12 +56,38 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 		token.Plaintext = "smt_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 	} else if scope == ScopeRO {
 		token.Plaintext = "smr_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	} else if scope == ScopeService {
+		token.Plaintext = "sms_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	} else if scope == ScopeEmailChange {
+		token.Plaintext = "sme_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	} else if scope == ScopeInvite {
+		token.Plaintext = "smi_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	} else if scope == ScopeSCIM {
+		token.Plaintext = "smp_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	} else if scope == ScopeImpersonation {
+		token.Plaintext = "smx_" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 	}
 	hash := sha256.Sum256([]byte(token.Plaintext))
 	token.Hash = hash[:]
 	return token, nil
 }
 
+// ScopeForToken returns the scope a token was issued for from its prefix
+func ScopeForToken(tokenPlainText string) string {
+	switch {
+	case strings.HasPrefix(tokenPlainText, "smr_"):
+		return ScopeRO
+	case strings.HasPrefix(tokenPlainText, "sms_"):
+		return ScopeService
+	case strings.HasPrefix(tokenPlainText, "smp_"):
+		return ScopeSCIM
+	case strings.HasPrefix(tokenPlainText, "smx_"):
+		return ScopeImpersonation
+	default:
+		return ScopeLogin
+	}
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlainText string) {
 	v.Check(tokenPlainText != "", "token", "must be provided")
 	v.Check(len(tokenPlainText) == 26+4, "token", "must be 30 bytes (chars) long")
@@ -59,26 +99,67 @@ type TokenModel struct {
 
 // New creates a new Token
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewForAudience(userID, ttl, scope, "")
+}
+
+// NewForAudience creates a new Token that is only accepted by the sql-manager server at audience
+func (m TokenModel) NewForAudience(userID int64, ttl time.Duration, scope string, audience string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
+	token.Audience = audience
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	// suspended accounts can not be issued tokens of any scope
+	err = checkSuspended(ctx, m.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// only personal access tokens count against the team token quota, the quota is checked
+	// in the transaction that adds the token so concurrent tokens are counted one after the
+	// other
+	if scope != ScopeRO {
+		err = addToken(ctx, m.DB, token)
+		return token, err
+	}
 
-	err = m.Add(token)
-	return token, err
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTokenQuota(ctx, tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = addToken(ctx, tx, token)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return token, tx.Commit()
 }
 
 // Add inserts a Token into the database
 func (m TokenModel) Add(token *Token) error {
-	query := `
-		insert into token(hash, user_account_id, expiry, scope)
-		values ($1, $2, $3, $4)
-	`
-	args := []interface{}{token.Hash, token.UserAccountID, token.Expiry, token.Scope}
 	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancle()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return addToken(ctx, m.DB, token)
+}
+
+func addToken(ctx context.Context, q querier, token *Token) error {
+	query := `
+		insert into token(hash, user_account_id, expiry, scope, audience, mfa, actor_id)
+		values ($1, $2, $3, $4, nullif($5, ''), $6, nullif($7, 0))
+	`
+	args := []interface{}{token.Hash, token.UserAccountID, token.Expiry, token.Scope, token.Audience, token.MFA, token.ActorID}
+
+	_, err := q.ExecContext(ctx, query, args...)
 
 	return err
 }
@@ -86,7 +167,7 @@ func (m TokenModel) Add(token *Token) error {
 // DeleteAllForUser removes all tokens for a UserAccount ID
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `
-		delete from token where scope = $1 and user_account_id = $1
+		delete from token where scope = $1 and user_account_id = $2
 	`
 	args := []interface{}{scope, userID}
 	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
@@ -96,3 +177,59 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 
 	return err
 }
+
+// checkTokenQuota checks the token quota of every Team of a UserAccount, q must be the
+// transaction that adds the token
+func checkTokenQuota(ctx context.Context, q querier, userID int64) error {
+	query := `
+		select 		ut.team_id
+		from 		users_teams as ut
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		where 		ut.user_account_id = $1
+		and 		t.deleted_at is null
+		order 		by ut.team_id
+	`
+	rows, err := q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var teams []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		teams = append(teams, id)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range teams {
+		if err := checkQuota(ctx, q, id, QuotaTokens, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteAllForUserExcept removes every token for a UserAccount ID, of any scope, apart from
+// the token with hash keep
+func (m TokenModel) DeleteAllForUserExcept(userID int64, keep []byte) error {
+	query := `
+		delete from token where user_account_id = $1 and hash <> $2
+	`
+	if keep == nil {
+		keep = []byte{}
+	}
+	args := []interface{}{userID, keep}
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+
+	return err
+}
@@ -2,6 +2,7 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
@@ -9,23 +10,40 @@ import (
 	"strings"
 	"time"
 
+	pmanager "github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
 	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var AnonUser = &UserAccount{}
-// UserAccount defines the domain for the user entity
+// AnonUserID is the ID of the principal of requests made without a token
+const AnonUserID int64 = 0
+
+// NewAnonUser returns the principal of a request made without a token, it holds the anon
+// role. Each request gets its own so a handler can not change another's.
+func NewAnonUser() *UserAccount {
+	return &UserAccount{ID: AnonUserID, Role: pmanager.AnonRole}
+}
+
+// RoleService is the role held by service accounts
+const RoleService = "service"
+// UserAccount defines the domain for the user entity. PendingEmail is the address it is
+// changing to, until the change is confirmed. Suspension is set while the UserAccount is
+// suspended.
 type UserAccount struct {
-	ID          int64             `json:"id"`
-	Name        string            `json:"name"`
-	Email       string            `json:"email"`
-	Password    password          `json:"-"`
-	Activated   bool              `json:"activated"`
-	CreatedAt   time.Time         `json:"created_at"`
-	Version     int               `json:"-"`
-	Team        *Team             `json:"team"`
-	Role        string            `json:"role"`
-	Permissions map[string]string `json:"permissions"`
+	ID           int64       `json:"id"`
+	Name         string      `json:"name"`
+	Email        string      `json:"email"`
+	PendingEmail string      `json:"pending_email,omitempty"`
+	Password     password    `json:"-"`
+	Activated    bool        `json:"activated"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Version      int         `json:"-"`
+	Team         *Team       `json:"team"`
+	Role         string      `json:"role"`
+	Attributes   Attributes  `json:"attributes"`
+	Suspension   *Suspension `json:"suspension,omitempty"`
+	// Token is the token the UserAccount authenticated with, set by GetForToken
+	Token *Token `json:"-"`
 }
 type password struct {
 	plaintext *string
@@ -37,45 +55,63 @@ type UserAccountModel struct {
 }
 // IsAnon returns true if the UserAccount is anonymous
 func (m *UserAccount) IsAnon() bool {
-	return (m == AnonUser)
+	return m.ID == AnonUserID && m.Role == pmanager.AnonRole
 }
 // Add adds a UserAccount to the database
 func (m UserAccountModel) Add(user *UserAccount) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = addUser(ctx, tx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addUser adds a UserAccount and its team membership, creating the team if it is new
+func addUser(ctx context.Context, q querier, user *UserAccount) error {
 	query := `
 		with ins as (
 			insert into team(name, created_at)
 			values ($1, now())
 			on conflict (name)
 			do nothing
-			returning id, created_at
+			returning id, created_at, deleted_at
 		)
 		select * from ins
 		union
-		select id, created_at
+		select id, created_at, deleted_at
 		from team where name = $1
 	`
 
 	args := []interface{}{user.Team.Name}
-	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.Team.ID, &user.Team.CreatedAt, &user.Team.DeletedAt)
+	if err != nil {
+		return err
+	}
 
-	defer cancle()
+	if user.Team.DeletedAt != nil {
+		return fmt.Errorf("team %s has been deleted", user.Team.Name)
+	}
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Team.ID, &user.Team.CreatedAt)
+	err = checkMemberQuota(ctx, q, user.Team.ID, user.Role, 1)
 	if err != nil {
 		return err
 	}
 
 	query = `
-		insert into user_account(email, password_hash, activated, role, created_at)
-		values ($1, $2, $3, $4, now())
+		insert into user_account(name, email, password_hash, activated, role, created_at)
+		values (nullif($1, ''), $2, $3, $4, $5, now())
 		returning id, created_at, version
 	`
-	args = []interface{}{user.Email, user.Password.hash, user.Activated, user.Role}
-	ctx, cancle = context.WithTimeout(context.Background(), 3*time.Second)
-
-	defer cancle()
-
-	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	args = []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.Role}
+	err = q.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
@@ -90,15 +126,35 @@ func (m UserAccountModel) Add(user *UserAccount) error {
 	`
 
 	args = []interface{}{user.ID, user.Team.ID}
-	ctx, cancle = context.WithTimeout(context.Background(), 3*time.Second)
-
-	defer cancle()
-
-	_, err = m.DB.ExecContext(ctx, query, args...)
+	_, err = q.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
 
+	// the first member of a team becomes its owner
+	query = `
+		update 		team
+		set 		owner_id = $1
+		where 		id = $2 and owner_id is null
+		returning 	owner_id
+	`
+	err = q.QueryRowContext(ctx, query, args...).Scan(&user.Team.OwnerID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if user.Team.OwnerID == user.ID {
+		query = `
+			update 		users_teams
+			set 		is_admin = 1
+			where 		user_account_id = $1 and team_id = $2
+		`
+		_, err = q.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 // GetByEmail returns as UserAccount for a given email
@@ -106,11 +162,18 @@ func (m UserAccountModel) GetByEmail(email string) (*UserAccount, error) {
 	query := `
 		select 	ua.id
 				, ua.created_at
+				, coalesce(ua.name, '')
 				, ua.email
+				, coalesce(ua.pending_email::text, '')
 				, ua.password_hash
 				, ua.activated
 				, ua.version
 				, ua.role
+				, ua.suspended_at
+				, coalesce(ua.suspended_reason, '')
+				, ua.suspended_by
+				, ua.reactivate_at
+				, ua.attributes
 				, t.id
 				, t.name
 				, t.created_at
@@ -120,9 +183,13 @@ func (m UserAccountModel) GetByEmail(email string) (*UserAccount, error) {
 		inner 	join team as t
 		on 		t.id = ut.team_id
 		where 	ua.email = $1
+		and 	t.deleted_at is null
+		order 	by t.id
+		limit 	1
 	`
 
 	var user UserAccount
+	var sus suspensionColumns
 	var team Team
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -131,17 +198,25 @@ func (m UserAccountModel) GetByEmail(email string) (*UserAccount, error) {
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
 		&user.Role,
+		&sus.at,
+		&sus.reason,
+		&sus.by,
+		&sus.until,
+		&user.Attributes,
 		&team.ID,
 		&team.Name,
 		&team.CreatedAt,
 	)
 
 	user.Team = &team
+	user.Suspension = sus.suspension()
 
 	if err != nil {
 		switch {
@@ -156,14 +231,28 @@ func (m UserAccountModel) GetByEmail(email string) (*UserAccount, error) {
 
 // Get returns a UserAccount from a given ID
 func (m UserAccountModel) Get(userID int64) (*UserAccount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return getUser(ctx, m.DB, userID)
+}
+
+func getUser(ctx context.Context, q querier, userID int64) (*UserAccount, error) {
 	query := `
 		select 	ua.id
 				, ua.created_at
+				, coalesce(ua.name, '')
 				, ua.email
+				, coalesce(ua.pending_email::text, '')
 				, ua.password_hash
 				, ua.activated
 				, ua.version
 				, ua.role
+				, ua.suspended_at
+				, coalesce(ua.suspended_reason, '')
+				, ua.suspended_by
+				, ua.reactivate_at
+				, ua.attributes
 				, t.id
 				, t.name
 				, t.created_at
@@ -173,28 +262,37 @@ func (m UserAccountModel) Get(userID int64) (*UserAccount, error) {
 		inner 	join team as t
 		on 		t.id = ut.team_id
 		where 	ua.id = $1
+		and 	t.deleted_at is null
+		order 	by t.id
+		limit 	1
 	`
 
 	var user UserAccount
+	var sus suspensionColumns
 	var team Team
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+	err := q.QueryRowContext(ctx, query, userID).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
 		&user.Role,
+		&sus.at,
+		&sus.reason,
+		&sus.by,
+		&sus.until,
+		&user.Attributes,
 		&team.ID,
 		&team.Name,
 		&team.CreatedAt,
 	)
 
 	user.Team = &team
+	user.Suspension = sus.suspension()
 
 	if err != nil {
 		switch {
@@ -209,10 +307,96 @@ func (m UserAccountModel) Get(userID int64) (*UserAccount, error) {
 
 // Update updates a UserAccount entity 
 func (m UserAccountModel) Update(user *UserAccount) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	if err := updateUser(ctx, m.DB, user); err != nil {
+		return err
+	}
+
+	permissionsChanged(m.DB)
+	return nil
+}
+
+// UpdateWithEmailChange updates a UserAccount whose PendingEmail is set and issues the token
+// confirming it in the same transaction, replacing any earlier confirmation token
+func (m UserAccountModel) UpdateWithEmailChange(user *UserAccount, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(user.ID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	// suspended accounts can not be issued tokens of any scope
+	if err = checkSuspended(ctx, m.DB, user.ID); err != nil {
+		return nil, err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = updateUser(ctx, tx, user); err != nil {
+		return nil, err
+	}
+
+	query := `delete from token where scope = $1 and user_account_id = $2`
+	if _, err = tx.ExecContext(ctx, query, ScopeEmailChange, user.ID); err != nil {
+		return nil, err
+	}
+	query = `
+		insert into token(hash, user_account_id, expiry, scope)
+		values ($1, $2, $3, $4)
+	`
+	if _, err = tx.ExecContext(ctx, query, token.Hash, user.ID, token.Expiry, ScopeEmailChange); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	permissionsChanged(m.DB)
+	return token, nil
+}
+
+// CancelEmailChange drops the pending email of a UserAccount and its confirmation tokens
+func (m UserAccountModel) CancelEmailChange(userID int64) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		update 		user_account
+		set 		pending_email = null
+					, version = version + 1
+		where 		id = $1 and pending_email is not null
+	`
+	if _, err = tx.ExecContext(ctx, query, userID); err != nil {
+		return err
+	}
+	query = `delete from token where scope = $1 and user_account_id = $2`
+	if _, err = tx.ExecContext(ctx, query, ScopeEmailChange, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateUser(ctx context.Context, q querier, user *UserAccount) error {
 	query := `
 		update 		user_account 
-		set 		email = $1, password_hash = $2, activated = $3, role = $4, version = version + 1
-		where 		id = $5 and version = $6
+		set 		email = $1, password_hash = $2, activated = $3, role = $4
+					, name = nullif($5, ''), pending_email = nullif($6, ''), version = version + 1
+		where 		id = $7 and version = $8
 		returning 	version
 	`
 	args := []interface{}{
@@ -220,15 +404,13 @@ func (m UserAccountModel) Update(user *UserAccount) error {
 		user.Password.hash,
 		user.Activated,
 		user.Role,
+		user.Name,
+		user.PendingEmail,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancle()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
-
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
@@ -239,7 +421,6 @@ func (m UserAccountModel) Update(user *UserAccount) error {
 			return err
 		}
 	}
-
 	return nil
 }
 
@@ -269,10 +450,12 @@ func (m UserAccountModel) Delete(user *UserAccount) error {
 		}
 	}
 
+	permissionsChanged(m.DB)
 	return nil
 }
 
-// GetForToken returns a UserAccount for a given tokenScope
+// GetForToken returns a UserAccount for a given tokenScope. An impersonation token is only
+// returned while its actor is neither suspended nor deleted.
 func (m UserAccountModel) GetForToken(tokenScope, tokenPlainText string) (*UserAccount, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlainText))
 
@@ -280,21 +463,114 @@ func (m UserAccountModel) GetForToken(tokenScope, tokenPlainText string) (*UserA
 		select
 				u.id
 				, u.created_at
+				, coalesce(u.name, '')
 				, u.email
+				, coalesce(u.pending_email::text, '')
 				, u.password_hash
 				, u.activated
 				, u.version
 				, u.role
+				, u.suspended_at
+				, coalesce(u.suspended_reason, '')
+				, u.suspended_by
+				, u.reactivate_at
+				, u.attributes
+				, t.scope
+				, t.expiry
+				, t.mfa
+				, coalesce(t.actor_id, 0)
+				, coalesce(t.audience, '')
 		from 	user_account as u
 		inner join token as t
 		on u.id = t.user_account_id
 		where t.hash = $1
 		and t.scope = $2
 		and t.expiry > $3
+		and (t.actor_id is null or exists (
+				select 	1
+				from 	user_account as a
+				where 	a.id = t.actor_id
+				and 	a.erased_at is null
+				and 	a.erasure_requested_at is null
+				and 	(a.suspended_at is null or a.reactivate_at <= now())
+			))
 	`
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 
 	var user UserAccount
+	var sus suspensionColumns
+	user.Token = &Token{}
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.Role,
+		&sus.at,
+		&sus.reason,
+		&sus.by,
+		&sus.until,
+		&user.Attributes,
+		&user.Token.Scope,
+		&user.Token.Expiry,
+		&user.Token.MFA,
+		&user.Token.ActorID,
+		&user.Token.Audience,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no records %w", err)
+		default:
+			return nil, err
+		}
+	}
+	user.Suspension = sus.suspension()
+	user.Token.UserAccountID = user.ID
+	user.Token.Hash = tokenHash[:]
+	return &user, nil
+}
+// GetForAudience returns the UserAccount for a token that was issued for the sql-manager
+// server at audience
+func (m UserAccountModel) GetForAudience(tokenScope, tokenPlainText, audience string) (*UserAccount, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	query := `
+		select
+				u.id
+				, u.created_at
+				, coalesce(u.name, '')
+				, u.email
+				, coalesce(u.pending_email::text, '')
+				, u.password_hash
+				, u.activated
+				, u.version
+				, u.role
+				, u.suspended_at
+				, coalesce(u.suspended_reason, '')
+				, u.suspended_by
+				, u.reactivate_at
+				, u.attributes
+		from 	user_account as u
+		inner join token as t
+		on u.id = t.user_account_id
+		where t.hash = $1
+		and t.scope = $2
+		and t.expiry > $3
+		and t.audience = $4
+	`
+	args := []interface{}{tokenHash[:], tokenScope, time.Now(), audience}
+
+	var user UserAccount
+	var sus suspensionColumns
 	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
 
 	defer cancle()
@@ -302,11 +578,18 @@ func (m UserAccountModel) GetForToken(tokenScope, tokenPlainText string) (*UserA
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
 		&user.Role,
+		&sus.at,
+		&sus.reason,
+		&sus.by,
+		&sus.until,
+		&user.Attributes,
 	)
 	if err != nil {
 		switch {
@@ -316,8 +599,76 @@ func (m UserAccountModel) GetForToken(tokenScope, tokenPlainText string) (*UserA
 			return nil, err
 		}
 	}
+	user.Suspension = sus.suspension()
 	return &user, nil
 }
+// ConfirmEmail makes the pending email of a UserAccount its email, given the email change
+// token sent to the pending address
+func (m UserAccountModel) ConfirmEmail(userID int64, tokenPlainText string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		delete from token
+		where 		user_account_id = $1
+		and 		scope = $2
+		returning 	hash, expiry
+	`
+	rows, err := tx.QueryContext(ctx, query, userID, ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var hash []byte
+		var expiry time.Time
+		if err := rows.Scan(&hash, &expiry); err != nil {
+			rows.Close()
+			return err
+		}
+		if string(hash) == string(tokenHash[:]) && expiry.After(time.Now()) {
+			found = true
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no records: invalid or expired email change token")
+	}
+
+	query = `
+		update 		user_account
+		set 		email = pending_email
+					, pending_email = null
+					, version = version + 1
+		where 		id = $1 and pending_email is not null
+		returning 	version
+	`
+	var version int
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
+			return fmt.Errorf("duplicate email: %w", err)
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no records: no email change is pending")
+		default:
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // Set adds a password to the password struct
 func (p *password) Set(ptpassword string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(ptpassword), 13)
@@ -329,18 +680,35 @@ func (p *password) Set(ptpassword string) error {
 	p.hash = hash
 	return nil
 }
-// Matches compares a plaintext password with the database
+// SetUnusable sets a hash no password will match, for accounts that choose their password
+// later. The random secret is never disclosed, so the minimum bcrypt cost is enough.
+func (p *password) SetUnusable() error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword(secret, bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+
+	p.plaintext = nil
+	p.hash = hash
+	return nil
+}
+// Matches compares a plaintext password with the database, an account without a password
+// matches nothing
 func (p *password) Matches(ptpassword string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword(p.hash, []byte(ptpassword))
 
 	if err != nil {
 		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword), errors.Is(err, bcrypt.ErrHashTooShort):
 			{
 				return false, nil
 			}
 		default:
-			return true, nil
+			return false, err
 		}
 	}
 	return true, nil
@@ -350,6 +718,10 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 }
 
+func ValidateName(v *validator.Validator, name string) {
+	v.Check(len(name) <= 255, "name", "must be less than 255 bytes (chars) long")
+}
+
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 chars long")
@@ -0,0 +1,338 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	pmanager "github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/permission"
+)
+
+// UserExport is everything stored about a UserAccount, in a machine-readable bundle
+type UserExport struct {
+	ExportedAt     time.Time             `json:"exported_at"`
+	Profile        *UserAccount          `json:"profile"`
+	Memberships    []*Membership         `json:"memberships"`
+	Roles          []string              `json:"roles"`
+	Tokens         []*TokenMetadata      `json:"tokens"`
+	Suspensions    []*SuspensionEvent    `json:"suspensions"`
+	Logins         []*LoginEvent         `json:"logins"`
+	SecretAccess   []*SecretAccess       `json:"secret_access"`
+	Impersonations []*ImpersonationEvent `json:"impersonations"`
+	Erasure        *Erasure              `json:"erasure,omitempty"`
+}
+
+// Membership is the membership of a UserAccount in a Team
+type Membership struct {
+	TeamID    int64      `json:"team_id"`
+	TeamName  string     `json:"team_name"`
+	IsAdmin   bool       `json:"is_admin"`
+	IsOwner   bool       `json:"is_owner"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+// TokenMetadata describes a Token without its hash
+type TokenMetadata struct {
+	Scope    string    `json:"scope"`
+	Audience string    `json:"audience,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+	MFA      bool      `json:"mfa"`
+}
+
+// Erasure is a pending request to erase a UserAccount, it becomes final at EraseAfter
+type Erasure struct {
+	RequestedAt time.Time `json:"requested_at"`
+	EraseAfter  time.Time `json:"erase_after"`
+}
+
+// Export returns everything stored about a UserAccount. It is read in a single read only
+// transaction so the sections of the bundle are consistent with each other.
+func (m UserAccountModel) Export(userID int64) (*UserExport, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := getUser(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &UserExport{
+		ExportedAt:   time.Now().UTC(),
+		Profile:      user,
+		Memberships:  []*Membership{},
+		Roles:        []string{user.Role},
+		Tokens:       []*TokenMetadata{},
+		Suspensions:  []*SuspensionEvent{},
+		SecretAccess: []*SecretAccess{},
+	}
+
+	query := `
+		select 		t.id, t.name, coalesce(ut.is_admin, 0) = 1, coalesce(t.owner_id = ut.user_account_id, false), ut.created_at
+		from 		users_teams as ut
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		where 		ut.user_account_id = $1
+		order by 	t.id
+	`
+	rows, err := tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ms Membership
+		if err := rows.Scan(&ms.TeamID, &ms.TeamName, &ms.IsAdmin, &ms.IsOwner, &ms.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Memberships = append(export.Memberships, &ms)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		v1
+		from 		casbin_rule
+		where 		ptype = 'g' and v0 = $1
+		order by 	v1
+	`
+	rows, err = tx.QueryContext(ctx, query, pmanager.UserSubject(userID))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if role != user.Role {
+			export.Roles = append(export.Roles, role)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		scope, coalesce(audience, ''), expiry, mfa
+		from 		token
+		where 		user_account_id = $1
+		order by 	expiry desc
+	`
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t TokenMetadata
+		if err := rows.Scan(&t.Scope, &t.Audience, &t.Expiry, &t.MFA); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Tokens = append(export.Tokens, &t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		id, user_account_id, action, coalesce(reason, ''), actor_id, reactivate_at, created_at
+		from 		user_account_suspension
+		where 		user_account_id = $1
+		order by 	created_at desc, id desc
+	`
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e SuspensionEvent
+		if err := rows.Scan(&e.ID, &e.UserAccountID, &e.Action, &e.Reason, &e.ActorID, &e.ReactivateAt, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Suspensions = append(export.Suspensions, &e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		select 		coalesce(team_id, 0), name, user_account_id, action, coalesce(ip, ''), created_at
+		from 		team_secret_audit
+		where 		user_account_id = $1
+		order by 	created_at desc
+	`
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var a SecretAccess
+		if err := rows.Scan(&a.TeamID, &a.Name, &a.UserAccountID, &a.Action, &a.IP, &a.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.SecretAccess = append(export.SecretAccess, &a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	export.Logins, err = loginHistory(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Impersonations, err = impersonationHistory(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Erasure, err = getErasure(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return export, tx.Commit()
+}
+
+// RequestErasure schedules a UserAccount to be erased once grace has passed. Requesting it
+// again keeps the original schedule.
+func (m UserAccountModel) RequestErasure(userID int64, grace time.Duration) (*Erasure, error) {
+	query := `
+		update 		user_account
+		set 		erasure_requested_at = coalesce(erasure_requested_at, now())
+		where 		id = $1
+		and 		erased_at is null
+		returning 	erasure_requested_at
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	var erasure Erasure
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&erasure.RequestedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	erasure.EraseAfter = erasure.RequestedAt.Add(grace)
+	return &erasure, nil
+}
+
+// CancelErasure cancels a pending erasure of a UserAccount
+func (m UserAccountModel) CancelErasure(userID int64) error {
+	query := `
+		update 		user_account
+		set 		erasure_requested_at = null
+		where 		id = $1
+		and 		erasure_requested_at is not null
+		and 		erased_at is null
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	res, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no record found: no erasure is pending for user %d", userID)
+	}
+	return nil
+}
+
+// Erase pseudonymizes the UserAccounts whose erasure was requested longer ago than grace.
+// The user_account row and its ID are kept so audit entries still refer to it, everything
+// identifying the person is removed along with their tokens, memberships and roles.
+func (m UserAccountModel) Erase(grace time.Duration) (int64, error) {
+	query := `
+		with erased as (
+			update 		user_account
+			set 		email = 'erased-' || id || '@erased.invalid'
+						, name = null
+						, pending_email = null
+						, vendor_id = null
+						, password_hash = ''::bytea
+						, activated = false
+						, attributes = '{}'
+						, scim_external_id = null
+						, scim_client_id = null
+						, erased_at = now()
+						, version = version + 1
+			where 		erasure_requested_at <= $1
+			and 		erased_at is null
+			returning 	id
+		), tokens as (
+			delete from token
+			where 		user_account_id in (select id from erased)
+		), logins as (
+			delete from login_event
+			where 		user_account_id in (select id from erased)
+		), memberships as (
+			delete from users_teams
+			where 		user_account_id in (select id from erased)
+		), owners as (
+			update 		team
+			set 		owner_id = null
+			where 		owner_id in (select id from erased)
+		), rules as (
+			delete from casbin_rule
+			where 		ptype in ('p', 'g')
+			and 		v0 in (select 'user:' || id from erased)
+		)
+		select count(*) from erased
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	var n int64
+	err := m.DB.QueryRowContext(ctx, query, time.Now().Add(-grace)).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		permissionsChanged(m.DB)
+	}
+	return n, nil
+}
+
+func getErasure(ctx context.Context, tx *sql.Tx, userID int64) (*Erasure, error) {
+	query := `
+		select 		erasure_requested_at
+		from 		user_account
+		where 		id = $1
+		and 		erasure_requested_at is not null
+		and 		erased_at is null
+	`
+	var erasure Erasure
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&erasure.RequestedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return &erasure, nil
+}
@@ -0,0 +1,280 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ImportCreated = "created"
+	ImportValid   = "valid"
+	ImportFailed  = "failed"
+	ImportSkipped = "skipped"
+)
+
+// the states of an ImportJob, a job that could not finish is failed with its Error set
+const (
+	ImportJobRunning  = "running"
+	ImportJobFinished = "finished"
+	ImportJobFailed   = "failed"
+)
+
+// ImportResult is the outcome of importing one row. Row is the 1-based position of the row
+// in the import, not counting a CSV header.
+type ImportResult struct {
+	Row    int               `json:"row"`
+	Email  string            `json:"email"`
+	ID     int64             `json:"id,omitempty"`
+	Status string            `json:"status"`
+	Errors map[string]string `json:"errors,omitempty"`
+	Invite bool              `json:"invite,omitempty"`
+}
+
+// ImportJob is an import run in the background, its results are set once it has finished
+type ImportJob struct {
+	ID         int64           `json:"id"`
+	CreatedBy  int64           `json:"created_by"`
+	Status     string          `json:"status"`
+	Mode       string          `json:"mode"`
+	Created    int             `json:"created"`
+	Failed     int             `json:"failed"`
+	Results    []*ImportResult `json:"results"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// UserRecord is a UserAccount's membership of a Team, one row of a bulk export. Its columns
+// are accepted by a bulk import.
+type UserRecord struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Team      string    `json:"team"`
+	Role      string    `json:"role"`
+	Activated bool      `json:"activated"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Import adds UserAccounts in one transaction, each row under its own savepoint so a
+// failing row is reported without losing the others. When atomic is set any failure rolls
+// back every row, otherwise the rows that succeeded are kept. A dry run always rolls back.
+// The results are in the same order as users.
+func (m UserAccountModel) Import(users []*UserAccount, atomic bool, dryRun bool) ([]*ImportResult, error) {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second+time.Duration(len(users))*100*time.Millisecond)
+	defer cancle()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var results []*ImportResult
+	failed := 0
+	for i, user := range users {
+		result := &ImportResult{Row: i + 1, Email: user.Email}
+		results = append(results, result)
+
+		if _, err = tx.ExecContext(ctx, "savepoint import_row"); err != nil {
+			return nil, err
+		}
+		err = addUser(ctx, tx, user)
+		if err != nil {
+			if _, rerr := tx.ExecContext(ctx, "rollback to savepoint import_row"); rerr != nil {
+				return nil, rerr
+			}
+			failed++
+			result.Status = ImportFailed
+			result.Errors = importError(err)
+			if result.Errors == nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, "release savepoint import_row"); err != nil {
+			return nil, err
+		}
+		result.ID = user.ID
+		result.Status = ImportCreated
+	}
+
+	if dryRun || (atomic && failed > 0) {
+		for _, result := range results {
+			if result.Status == ImportCreated {
+				result.ID = 0
+				result.Status = ImportValid
+			}
+		}
+		return results, nil
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	permissionsChanged(m.DB)
+	return results, nil
+}
+
+// AddImportJob records an ImportJob as running
+func (m UserAccountModel) AddImportJob(job *ImportJob) error {
+	query := `
+		insert into user_import_job(created_by, status, mode, created_at)
+		values (nullif($1, 0), $2, $3, now())
+		returning id, created_at
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	job.Status = ImportJobRunning
+	return m.DB.QueryRowContext(ctx, query, job.CreatedBy, job.Status, job.Mode).Scan(&job.ID, &job.CreatedAt)
+}
+
+// FinishImportJob records the outcome of an ImportJob, failed with Error set when it could
+// not finish
+func (m UserAccountModel) FinishImportJob(job *ImportJob) error {
+	results, err := json.Marshal(job.Results)
+	if err != nil {
+		return err
+	}
+	query := `
+		update 		user_import_job
+		set 		status = $2
+					, created = $3
+					, failed = $4
+					, results = $5
+					, error = nullif($6, '')
+					, finished_at = now()
+		where 		id = $1
+		returning 	finished_at
+	`
+	args := []interface{}{job.ID, job.Status, job.Created, job.Failed, results, truncate(job.Error, 500)}
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&job.FinishedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("no record found: %w", err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetImportJob returns an ImportJob with its results
+func (m UserAccountModel) GetImportJob(id int64) (*ImportJob, error) {
+	query := `
+		select 	id, coalesce(created_by, 0), status, mode, created, failed, results
+				, coalesce(error, ''), created_at, finished_at
+		from 	user_import_job
+		where 	id = $1
+	`
+	var job ImportJob
+	var results []byte
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&job.ID,
+		&job.CreatedBy,
+		&job.Status,
+		&job.Mode,
+		&job.Created,
+		&job.Failed,
+		&results,
+		&job.Error,
+		&job.CreatedAt,
+		&job.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("no record found: %w", err)
+		default:
+			return nil, err
+		}
+	}
+	if err = json.Unmarshal(results, &job.Results); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// PurgeImportJobs deletes the ImportJobs started longer ago than retention, with the emails
+// in their results, and returns how many were deleted. A job cut short by a restart is
+// never finished and goes with them.
+func (m UserAccountModel) PurgeImportJobs(retention time.Duration) (int64, error) {
+	query := `
+		delete from user_import_job
+		where 		created_at < $1
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	res, err := m.DB.ExecContext(ctx, query, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// importError describes the errors a row can fail with, nil for any other error
+func importError(err error) map[string]string {
+	switch {
+	case strings.Contains(err.Error(), "duplicate"):
+		return map[string]string{"email": "a user with this email already exists"}
+	case strings.Contains(err.Error(), "quota exceeded"):
+		return map[string]string{"team": err.Error()}
+	case strings.Contains(err.Error(), "has been deleted"):
+		return map[string]string{"team": err.Error()}
+	}
+	return nil
+}
+
+// Records returns a UserRecord for every team membership, limited to a Team when teamID is
+// set, ordered by UserAccount ID
+func (m UserAccountModel) Records(teamID int64) ([]*UserRecord, error) {
+	query := `
+		select 		ua.id, ua.email, coalesce(ua.name, ''), t.name, ua.role, ua.activated, ua.created_at
+		from 		user_account as ua
+		inner join 	users_teams as ut
+		on 			ut.user_account_id = ua.id
+		inner join 	team as t
+		on 			t.id = ut.team_id
+		where 		t.deleted_at is null
+		and 		($1 = 0 or t.id = $1)
+		order by 	ua.id, t.id
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancle()
+
+	rows, err := m.DB.QueryContext(ctx, query, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*UserRecord{}
+	for rows.Next() {
+		var r UserRecord
+		err := rows.Scan(&r.ID, &r.Email, &r.Name, &r.Team, &r.Role, &r.Activated, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
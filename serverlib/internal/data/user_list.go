@@ -0,0 +1,219 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/c-jamie/sql-manager-acc-auth/serverlib/internal/validator"
+)
+
+// userSortColumns maps the sort values accepted by UserFilter to their column and the type a
+// cursor value is cast to. A nullable name is coalesced so every row has a cursor value.
+var userSortColumns = map[string][2]string{
+	"id":         {"ua.id", "bigint"},
+	"email":      {"lower(ua.email::text)", "text"},
+	"name":       {"lower(coalesce(ua.name, ''))", "text"},
+	"created_at": {"ua.created_at", "timestamp"},
+}
+
+// UserFilter selects, sorts and pages the UserAccounts returned by List. A Cursor continues
+// from the last UserAccount of a previous page, otherwise Page is used as an offset.
+type UserFilter struct {
+	TeamID        int64
+	Role          string
+	Activated     *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	EmailPrefix   string
+	Search        string
+	Sort          string
+	Page          int
+	PageSize      int
+	Cursor        string
+}
+
+// Metadata describes the page of results returned by a listing
+type Metadata struct {
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+}
+
+// userCursor is the position after the last UserAccount of a page in a sort order
+type userCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+func ValidateUserFilter(v *validator.Validator, f *UserFilter) {
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10000, "page", "must be a maximum of 10000")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	_, ok := userSortColumns[strings.TrimPrefix(f.Sort, "-")]
+	v.Check(ok, "sort", "must be one of id, email, name, created_at, optionally prefixed with -")
+	v.Check(len(f.Search) <= 100, "q", "must be less than 100 bytes (chars) long")
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(f.CreatedAfter.Before(*f.CreatedBefore), "created_after", "must be before created_before")
+	}
+	if f.Cursor != "" {
+		_, err := decodeUserCursor(f.Cursor)
+		v.Check(err == nil, "cursor", "is invalid")
+	}
+}
+
+// List returns a page of the UserAccounts matching the filter. Search matches anywhere in
+// the email or name and is served by the trigram indexes on both columns.
+func (m UserAccountModel) List(f UserFilter) ([]*UserAccount, Metadata, error) {
+	desc := strings.HasPrefix(f.Sort, "-")
+	sort := userSortColumns[strings.TrimPrefix(f.Sort, "-")]
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.TeamID != 0 {
+		where = append(where, `exists (
+			select 		1
+			from 		users_teams as ut
+			inner join 	team as t
+			on 			t.id = ut.team_id
+			where 		ut.user_account_id = ua.id
+			and 		t.deleted_at is null
+			and 		ut.team_id = `+arg(f.TeamID)+`
+		)`)
+	}
+	if f.Role != "" {
+		where = append(where, "ua.role = "+arg(f.Role))
+	}
+	if f.Activated != nil {
+		where = append(where, "ua.activated = "+arg(*f.Activated))
+	}
+	if f.CreatedAfter != nil {
+		where = append(where, "ua.created_at >= "+arg(*f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		where = append(where, "ua.created_at < "+arg(*f.CreatedBefore))
+	}
+	if f.EmailPrefix != "" {
+		where = append(where, "lower(ua.email::text) like "+arg(escapeLike(strings.ToLower(f.EmailPrefix))+"%"))
+	}
+	if f.Search != "" {
+		pattern := arg("%" + escapeLike(strings.ToLower(f.Search)) + "%")
+		where = append(where, "(lower(ua.email::text) like "+pattern+" or lower(coalesce(ua.name, '')) like "+pattern+")")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "where " + strings.Join(where, " and ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	meta := Metadata{PageSize: f.PageSize}
+	err := m.DB.QueryRowContext(ctx, "select count(*) from user_account as ua "+filter, args...).Scan(&meta.TotalRecords)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	order := "asc"
+	cmp := ">"
+	if desc {
+		order = "desc"
+		cmp = "<"
+	}
+
+	offset := 0
+	if f.Cursor != "" {
+		cursor, err := decodeUserCursor(f.Cursor)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if cursor.Sort != f.Sort {
+			return nil, Metadata{}, fmt.Errorf("invalid cursor: it was issued for sort %q", cursor.Sort)
+		}
+		after := fmt.Sprintf("(%s, ua.id) %s (cast(%s as %s), %s)", sort[0], cmp, arg(cursor.Value), sort[1], arg(cursor.ID))
+		if filter == "" {
+			filter = "where " + after
+		} else {
+			filter += " and " + after
+		}
+	} else {
+		offset = (f.Page - 1) * f.PageSize
+		meta.CurrentPage = f.Page
+		meta.FirstPage = 1
+		meta.LastPage = (meta.TotalRecords + f.PageSize - 1) / f.PageSize
+	}
+
+	query := fmt.Sprintf(`
+		select 		ua.id, coalesce(ua.name, ''), ua.email, ua.activated, ua.role
+					, ua.created_at, ua.version
+					, %s::text
+		from 		user_account as ua
+		%s
+		order by 	%s %s, ua.id %s
+		limit 		%s offset %s
+	`, sort[0], filter, sort[0], order, order, arg(f.PageSize+1), arg(offset))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	users := []*UserAccount{}
+	var last userCursor
+	for rows.Next() {
+		var user UserAccount
+		var value string
+		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Activated, &user.Role, &user.CreatedAt, &user.Version, &value)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		// the extra row only tells us there is another page
+		if len(users) == f.PageSize {
+			meta.NextCursor = encodeUserCursor(last)
+			break
+		}
+		users = append(users, &user)
+		last = userCursor{Sort: f.Sort, Value: value, ID: user.ID}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return users, meta, nil
+}
+
+func encodeUserCursor(c userCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s string) (userCursor, error) {
+	var c userCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return c, nil
+}
+
+// escapeLike escapes the wildcards of a like pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,41 @@
+-- +migrate Up
+create table organization (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, name text unique not null
+	, updated_at timestamp
+	, created_at timestamp
+	, version bigint not null default 1
+	);
+
+-- +migrate Down
+alter table if exists team drop constraint if exists fk_organization;
+alter table if exists organization_admin drop constraint if exists fk_organization;
+drop table if exists organization;
+
+-- +migrate Up
+alter table team add column organization_id int;
+
+-- +migrate Down
+alter table if exists team drop column if exists organization_id;
+
+-- +migrate Up
+create table organization_admin (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, organization_id int not null
+	, user_account_id int not null
+	, created_at timestamp
+	, version bigint not null default 1
+	, unique (organization_id, user_account_id)
+	);
+
+-- +migrate Down
+drop table if exists organization_admin;
+
+-- +migrate Up
+alter table team add constraint fk_organization foreign key(organization_id) references organization(id) on delete set null;
+
+-- +migrate Up
+alter table organization_admin add constraint fk_organization foreign key(organization_id) references organization(id) on delete cascade;
+
+-- +migrate Up
+alter table organization_admin add constraint fk_user foreign key(user_account_id) references user_account(id) on delete cascade;
@@ -0,0 +1,26 @@
+-- +migrate Up
+alter table team add column owner_id int;
+
+-- +migrate Down
+alter table if exists team drop constraint if exists fk_owner;
+alter table if exists team drop column if exists owner_id;
+
+-- +migrate Up
+alter table team add column deleted_at timestamp;
+
+-- +migrate Down
+alter table if exists team drop column if exists deleted_at;
+
+-- +migrate Up
+alter table team add constraint fk_owner foreign key(owner_id) references user_account(id) on delete set null;
+
+-- +migrate Up
+update team as t
+set owner_id = (
+	select 		ut.user_account_id
+	from 		users_teams as ut
+	where 		ut.team_id = t.id
+	order by 	ut.is_admin desc nulls last, ut.id
+	limit 		1
+	)
+where owner_id is null;
@@ -0,0 +1,22 @@
+-- +migrate Up
+create table team_quota (
+	team_id int PRIMARY KEY
+	, max_members int
+	, max_tokens int
+	, max_service_accounts int
+	, updated_at timestamp
+	, created_at timestamp
+	, version bigint not null default 1
+	);
+
+-- +migrate Down
+drop table if exists team_quota;
+
+-- +migrate Up
+alter table team_quota add constraint fk_team foreign key(team_id) references team(id) on delete cascade;
+
+-- +migrate Up
+create unique index if not exists users_teams_member_idx on users_teams(user_account_id, team_id);
+
+-- +migrate Down
+drop index if exists users_teams_member_idx;
@@ -0,0 +1,25 @@
+-- +migrate Up
+create table team_server (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, team_id int unique not null
+	, server_url varchar(500) not null
+	, service_account_id int not null
+	, updated_at timestamp
+	, created_at timestamp
+	, version bigint not null default 1
+	);
+
+-- +migrate Down
+drop table if exists team_server;
+
+-- +migrate Up
+alter table team_server add constraint fk_team foreign key(team_id) references team(id) on delete cascade;
+
+-- +migrate Up
+alter table team_server add constraint fk_service_account foreign key(service_account_id) references user_account(id) on delete cascade;
+
+-- +migrate Up
+alter table token add column audience varchar(500);
+
+-- +migrate Down
+alter table if exists token drop column if exists audience;
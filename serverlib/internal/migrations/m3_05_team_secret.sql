@@ -0,0 +1,32 @@
+-- +migrate Up
+create table team_secret (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, team_meta_id int not null
+	, name varchar(100) not null
+	, kind varchar(20) not null
+	, ciphertext bytea not null
+	, updated_at timestamp
+	, created_at timestamp
+	, version bigint not null default 1
+	, unique (team_meta_id, name)
+	);
+
+-- +migrate Down
+drop table if exists team_secret;
+
+-- +migrate Up
+alter table team_secret add constraint fk_team_meta foreign key(team_meta_id) references team_meta(id) on delete cascade;
+
+-- +migrate Up
+create table team_secret_audit (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, team_id int
+	, name varchar(100) not null
+	, user_account_id int
+	, action varchar(20) not null
+	, ip varchar(100)
+	, created_at timestamp
+	);
+
+-- +migrate Down
+drop table if exists team_secret_audit;
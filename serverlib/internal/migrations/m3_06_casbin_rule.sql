@@ -0,0 +1,42 @@
+-- +migrate Up
+create table casbin_rule (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, ptype varchar(100) not null check (ptype <> '')
+	, v0 varchar(255) not null default ''
+	, v1 varchar(255) not null default ''
+	, v2 varchar(255) not null default ''
+	, v3 varchar(255) not null default ''
+	, v4 varchar(255) not null default ''
+	, v5 varchar(255) not null default ''
+	, unique (ptype, v0, v1, v2, v3, v4, v5)
+	);
+
+-- +migrate Down
+drop table if exists casbin_rule;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/users', 'write'),
+	('p', 'admin', '/orgs', 'read'),
+	('p', 'admin', '/orgs', 'write'),
+	('p', 'admin', '/teams', 'write'),
+	('p', 'admin', '/quotas', 'read'),
+	('p', 'admin', '/quotas', 'write'),
+	('p', 'admin', '/tokens', 'write'),
+	('p', 'admin', '/servers', 'write'),
+	('p', 'admin', '/secrets', 'read'),
+	('p', 'admin', '/secrets', 'write'),
+	('p', 'admin', '*', 'admin'),
+	('p', 'org-admin', '/orgs', 'read'),
+	('p', 'org-admin', '/teams', 'write'),
+	('p', 'anon', '/ping', 'read'),
+	('p', 'user', '/users', 'read'),
+	('p', 'user', '/teams', 'write'),
+	('p', 'user', '/tokens', 'write'),
+	('p', 'user', '/servers', 'write'),
+	('p', 'user', '/secrets', 'read'),
+	('p', 'user', '/secrets', 'write'),
+	('p', 'service', '/introspect', 'read'),
+	('p', 'service', '/server-secrets', 'read')
+on conflict do nothing;
@@ -0,0 +1,34 @@
+-- +migrate Up
+create table role (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, name varchar(100) not null unique
+	, description text not null default ''
+	, created_at timestamp
+	, version bigint not null default 1
+	);
+
+-- +migrate Down
+drop table if exists role;
+
+-- +migrate Up
+insert into role(name, description, created_at)
+values
+	('admin', 'administers the whole installation', now()),
+	('user', 'a member of a team', now()),
+	('anon', 'a request without an authentication token', now()),
+	('service', 'a sql-manager server acting for its team', now()),
+	('org-admin', 'inherited by the admins of an organization', now())
+on conflict do nothing;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/roles', 'read'),
+	('p', 'admin', '/roles', 'write'),
+	('p', 'admin', '/roles', 'assign')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/roles', 'read'), ('admin', '/roles', 'write'), ('admin', '/roles', 'assign'));
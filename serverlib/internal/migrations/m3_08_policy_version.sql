@@ -0,0 +1,39 @@
+-- +migrate Up
+create table policy_version (
+	id int PRIMARY KEY default 1 check (id = 1)
+	, version bigint not null default 1
+	, updated_at timestamp
+	);
+
+-- +migrate Down
+drop table if exists policy_version;
+
+-- +migrate Up
+insert into policy_version(id, version, updated_at) values (1, 1, now()) on conflict do nothing;
+
+-- +migrate Up
+-- +migrate StatementBegin
+create or replace function bump_policy_version() returns trigger as $$
+begin
+	update policy_version set version = version + 1, updated_at = now() where id = 1;
+	return null;
+end;
+$$ language plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate Down
+drop function if exists bump_policy_version() cascade;
+
+-- +migrate Up
+create trigger casbin_rule_policy_version after insert or update or delete on casbin_rule
+	for each statement execute procedure bump_policy_version();
+create trigger role_policy_version after insert or update or delete on role
+	for each statement execute procedure bump_policy_version();
+create trigger user_account_policy_version after insert or delete or update of role on user_account
+	for each statement execute procedure bump_policy_version();
+create trigger users_teams_policy_version after insert or update or delete on users_teams
+	for each statement execute procedure bump_policy_version();
+create trigger team_policy_version after delete or update of organization_id, deleted_at on team
+	for each statement execute procedure bump_policy_version();
+create trigger organization_admin_policy_version after insert or update or delete on organization_admin
+	for each statement execute procedure bump_policy_version();
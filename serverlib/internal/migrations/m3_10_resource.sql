@@ -0,0 +1,31 @@
+-- +migrate Up
+create table resource (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, kind varchar(20) not null
+	, name varchar(255) not null
+	, path varchar(255) not null unique
+	, team_id int not null
+	, description text not null default ''
+	, created_at timestamp
+	, version bigint not null default 1
+	);
+
+-- +migrate Down
+drop table if exists resource;
+
+-- +migrate Up
+alter table resource add constraint fk_team foreign key(team_id) references team(id) on delete cascade;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/resources', 'read'),
+	('p', 'admin', '/resources', 'write'),
+	('p', 'user', '/resources', 'read'),
+	('p', 'user', '/resources', 'write')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/resources', 'read'), ('admin', '/resources', 'write'), ('user', '/resources', 'read'), ('user', '/resources', 'write'));
@@ -0,0 +1,5 @@
+-- +migrate Up
+alter table token add column mfa boolean not null default false;
+
+-- +migrate Down
+alter table if exists token drop column if exists mfa;
@@ -0,0 +1,10 @@
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/authz', 'explain')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/authz', 'explain'));
@@ -0,0 +1,11 @@
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/policy', 'read'),
+	('p', 'admin', '/policy', 'write')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/policy', 'read'), ('admin', '/policy', 'write'));
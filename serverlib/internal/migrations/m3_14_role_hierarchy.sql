@@ -0,0 +1,11 @@
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1)
+values
+	('g', 'admin', 'user'),
+	('g', 'user', 'anon')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'g'
+and 		(v0, v1) in (('admin', 'user'), ('user', 'anon'));
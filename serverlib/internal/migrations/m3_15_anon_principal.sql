@@ -0,0 +1,22 @@
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'anon', '/signing-key', 'read'),
+	('p', 'anon', '/tokens', 'authenticate')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('anon', '/signing-key', 'read'), ('anon', '/tokens', 'authenticate'));
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1)
+values
+	('g', 'service', 'anon')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'g'
+and 		(v0, v1) in (('service', 'anon'));
@@ -0,0 +1,34 @@
+-- +migrate Up
+create extension if not exists pg_trgm;
+
+-- +migrate Up
+create index if not exists user_account_email_trgm_idx on user_account using gin (lower(email::text) gin_trgm_ops);
+
+-- +migrate Up
+create index if not exists user_account_name_trgm_idx on user_account using gin (lower(coalesce(name, '')) gin_trgm_ops);
+
+-- +migrate Up
+update user_account set created_at = 'epoch' where created_at is null;
+alter table user_account alter column created_at set default now(), alter column created_at set not null;
+
+-- +migrate Down
+alter table user_account alter column created_at drop not null, alter column created_at drop default;
+
+-- +migrate Up
+create index if not exists user_account_created_at_idx on user_account (created_at, id);
+
+-- +migrate Down
+drop index if exists user_account_created_at_idx;
+drop index if exists user_account_name_trgm_idx;
+drop index if exists user_account_email_trgm_idx;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/users', 'list')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/users', 'list'));
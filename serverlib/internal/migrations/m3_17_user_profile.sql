@@ -0,0 +1,17 @@
+-- +migrate Up
+alter table user_account add column pending_email citext;
+
+-- +migrate Down
+alter table if exists user_account drop column if exists pending_email;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'user', '/profile', 'read'),
+	('p', 'user', '/profile', 'write')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('user', '/profile', 'read'), ('user', '/profile', 'write'));
@@ -0,0 +1,42 @@
+-- +migrate Up
+alter table user_account
+	add column suspended_at timestamp with time zone
+	, add column suspended_reason varchar(500)
+	, add column suspended_by int
+	, add column reactivate_at timestamp with time zone;
+
+-- +migrate Down
+alter table if exists user_account
+	drop column if exists suspended_at
+	, drop column if exists suspended_reason
+	, drop column if exists suspended_by
+	, drop column if exists reactivate_at;
+
+-- +migrate Up
+create table user_account_suspension (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, user_account_id int
+	, action varchar(20) not null
+	, reason varchar(500)
+	, actor_id int
+	, reactivate_at timestamp with time zone
+	, created_at timestamp with time zone
+	);
+
+-- +migrate Up
+alter table user_account_suspension add constraint fk_user foreign key(user_account_id) references user_account(id) on delete set null;
+
+-- +migrate Down
+alter table if exists user_account_suspension drop constraint if exists fk_user;
+drop table if exists user_account_suspension;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/users', 'suspend')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/users', 'suspend'));
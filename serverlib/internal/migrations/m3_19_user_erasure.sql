@@ -0,0 +1,22 @@
+-- +migrate Up
+alter table user_account
+	add column erasure_requested_at timestamp with time zone
+	, add column erased_at timestamp with time zone;
+
+-- +migrate Down
+alter table if exists user_account
+	drop column if exists erasure_requested_at
+	, drop column if exists erased_at;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'user', '/profile', 'export'),
+	('p', 'user', '/profile', 'erase'),
+	('p', 'admin', '/users', 'erase')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('user', '/profile', 'export'), ('user', '/profile', 'erase'), ('admin', '/users', 'erase'));
@@ -0,0 +1,32 @@
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/users', 'import'),
+	('p', 'admin', '/users', 'export'),
+	('p', 'anon', '/invites', 'accept')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/users', 'import'), ('admin', '/users', 'export'), ('anon', '/invites', 'accept'));
+
+-- +migrate Up
+create table user_import_job (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, created_by int
+	, status varchar(20) not null
+	, mode varchar(20) not null
+	, created int not null default 0
+	, failed int not null default 0
+	, results jsonb not null default '[]'
+	, error varchar(500)
+	, created_at timestamp with time zone
+	, finished_at timestamp with time zone
+	);
+
+-- +migrate Up
+alter table user_import_job add constraint fk_user foreign key(created_by) references user_account(id) on delete set null;
+
+-- +migrate Down
+drop table if exists user_import_job;
@@ -0,0 +1,49 @@
+-- +migrate Up
+alter table user_account add column scim_external_id varchar(255);
+alter table team add column scim_external_id varchar(255);
+
+-- +migrate Down
+alter table if exists user_account drop column if exists scim_external_id;
+alter table if exists team drop column if exists scim_external_id;
+
+-- +migrate Up
+create table scim_client (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, name varchar(100) unique not null
+	, service_account_id int not null
+	, default_team_id int not null
+	, created_at timestamp with time zone
+	);
+
+-- +migrate Up
+alter table scim_client add constraint fk_service_account foreign key(service_account_id) references user_account(id) on delete cascade;
+alter table scim_client add constraint fk_default_team foreign key(default_team_id) references team(id) on delete restrict;
+alter table user_account add column scim_client_id int;
+alter table user_account add constraint fk_scim_client foreign key(scim_client_id) references scim_client(id) on delete set null;
+alter table team add column scim_client_id int;
+alter table team add constraint fk_scim_client foreign key(scim_client_id) references scim_client(id) on delete set null;
+
+-- +migrate Down
+alter table if exists user_account drop column if exists scim_client_id;
+alter table if exists team drop column if exists scim_client_id;
+alter table if exists scim_client drop constraint if exists fk_service_account;
+alter table if exists scim_client drop constraint if exists fk_default_team;
+drop table if exists scim_client;
+
+-- +migrate Up
+insert into role(name, description, created_at)
+values ('scim', 'an identity provider provisioning users and teams over scim', now())
+on conflict do nothing;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'scim', '/scim', 'read'),
+	('p', 'scim', '/scim', 'write'),
+	('p', 'admin', '/scim-clients', 'write')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('scim', '/scim', 'read'), ('scim', '/scim', 'write'), ('admin', '/scim-clients', 'write'));
@@ -0,0 +1,35 @@
+-- +migrate Up
+create table attribute_definition (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, kind varchar(10) not null
+	, name varchar(100) not null
+	, type varchar(20) not null
+	, required boolean not null default false
+	, enum_values text[]
+	, description varchar(500)
+	, created_at timestamp with time zone
+	, unique (kind, name)
+	);
+
+-- +migrate Down
+drop table if exists attribute_definition;
+
+-- +migrate Up
+alter table user_account add column attributes jsonb not null default '{}';
+alter table team_meta add column attributes jsonb not null default '{}';
+
+-- +migrate Down
+alter table if exists user_account drop column if exists attributes;
+alter table if exists team_meta drop column if exists attributes;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'user', '/attributes', 'read'),
+	('p', 'admin', '/attributes', 'write')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('user', '/attributes', 'read'), ('admin', '/attributes', 'write'));
@@ -0,0 +1,42 @@
+-- +migrate Up
+alter table token add column actor_id int;
+
+-- +migrate Up
+alter table token add constraint fk_actor foreign key(actor_id) references user_account(id) on delete cascade;
+
+-- +migrate Down
+alter table if exists token drop constraint if exists fk_actor;
+alter table if exists token drop column if exists actor_id;
+
+-- +migrate Up
+create table impersonation_log (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, actor_id int
+	, user_account_id int
+	, method varchar(10) not null
+	, path varchar(500) not null
+	, status int not null
+	, ip varchar(100)
+	, reason varchar(500)
+	, created_at timestamp with time zone
+	);
+
+-- +migrate Up
+alter table impersonation_log add constraint fk_user foreign key(user_account_id) references user_account(id) on delete set null;
+alter table impersonation_log add constraint fk_actor foreign key(actor_id) references user_account(id) on delete set null;
+
+-- +migrate Down
+alter table if exists impersonation_log drop constraint if exists fk_user;
+alter table if exists impersonation_log drop constraint if exists fk_actor;
+drop table if exists impersonation_log;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'admin', '/users', 'impersonate')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('admin', '/users', 'impersonate'));
@@ -0,0 +1,50 @@
+-- +migrate Up
+create table login_event (
+	id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY
+	, user_account_id int
+	, email varchar(500) not null
+	, method varchar(50) not null
+	, outcome varchar(50) not null
+	, ip varchar(100)
+	, user_agent varchar(500)
+	, created_at timestamp with time zone
+	);
+
+-- +migrate Up
+alter table login_event add constraint fk_user foreign key(user_account_id) references user_account(id) on delete set null;
+
+-- +migrate Up
+create index login_event_user_idx on login_event(user_account_id, created_at);
+create index login_event_created_idx on login_event(created_at);
+
+-- +migrate Up
+alter table token add column id int GENERATED BY DEFAULT AS IDENTITY unique;
+
+-- +migrate Up
+alter table token add column login_event_id int;
+
+-- +migrate Up
+alter table token add constraint fk_login_event foreign key(login_event_id) references login_event(id) on delete set null;
+
+-- +migrate Down
+alter table if exists token drop constraint if exists fk_login_event;
+alter table if exists token drop column if exists login_event_id;
+alter table if exists token drop column if exists id;
+
+-- +migrate Down
+drop index if exists login_event_user_idx;
+drop index if exists login_event_created_idx;
+alter table if exists login_event drop constraint if exists fk_user;
+drop table if exists login_event;
+
+-- +migrate Up
+insert into casbin_rule(ptype, v0, v1, v2)
+values
+	('p', 'user', '/sessions', 'read'),
+	('p', 'user', '/sessions', 'write')
+on conflict do nothing;
+
+-- +migrate Down
+delete from casbin_rule
+where 		ptype = 'p'
+and 		(v0, v1, v2) in (('user', '/sessions', 'read'), ('user', '/sessions', 'write'));
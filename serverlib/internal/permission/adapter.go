@@ -0,0 +1,198 @@
+package permission
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// Adapter is a casbin adapter that stores policy rules in the casbin_rule table
+type Adapter struct {
+	DB *sql.DB
+}
+
+// NewAdapter creates an Adapter for the connection pool
+func NewAdapter(db *sql.DB) *Adapter {
+	return &Adapter{DB: db}
+}
+
+// ruleArgs pads a rule out to the v0 - v5 columns
+func ruleArgs(ptype string, rule []string) []interface{} {
+	args := []interface{}{ptype}
+	for i := 0; i < 6; i++ {
+		if i < len(rule) {
+			args = append(args, rule[i])
+		} else {
+			args = append(args, "")
+		}
+	}
+	return args
+}
+
+// LoadPolicy loads all policy rules from the casbin_rule table
+func (a *Adapter) LoadPolicy(m model.Model) error {
+	query := `
+		select 		ptype, v0, v1, v2, v3, v4, v5
+		from 		casbin_rule
+		order by 	id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := a.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ptype string
+		v := make([]string, 6)
+		if err := rows.Scan(&ptype, &v[0], &v[1], &v[2], &v[3], &v[4], &v[5]); err != nil {
+			return err
+		}
+		// a rule without a policy type can not belong to the model
+		if ptype == "" {
+			continue
+		}
+		sec, ok := m[ptype[:1]]
+		if !ok || sec[ptype] == nil {
+			continue
+		}
+		// the rule has as many values as the model defines, unused columns are empty
+		n := len(sec[ptype].Tokens)
+		if ptype[:1] == "g" {
+			n = strings.Count(sec[ptype].Value, "_")
+		}
+		if n > len(v) {
+			n = len(v)
+		}
+		persist.LoadPolicyArray(append([]string{ptype}, v[:n]...), m)
+	}
+	return rows.Err()
+}
+
+// SavePolicy replaces every rule in the casbin_rule table with the rules in the model
+func (a *Adapter) SavePolicy(m model.Model) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from casbin_rule`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				err = a.insert(ctx, tx, ptype, rule)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (a *Adapter) insert(ctx context.Context, tx *sql.Tx, ptype string, rule []string) error {
+	query := `
+		insert into casbin_rule(ptype, v0, v1, v2, v3, v4, v5)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		on conflict do nothing
+	`
+	_, err := tx.ExecContext(ctx, query, ruleArgs(ptype, rule)...)
+	return err
+}
+
+// AddPolicy adds a policy rule to the casbin_rule table
+func (a *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return a.AddPolicies(sec, ptype, [][]string{rule})
+}
+
+// AddPolicies adds policy rules to the casbin_rule table in a single transaction
+func (a *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		err = a.insert(ctx, tx, ptype, rule)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RemovePolicy removes a policy rule from the casbin_rule table
+func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return a.RemovePolicies(sec, ptype, [][]string{rule})
+}
+
+// RemovePolicies removes policy rules from the casbin_rule table in a single transaction
+func (a *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	query := `
+		delete from casbin_rule
+		where 		ptype = $1
+		and 		v0 = $2 and v1 = $3 and v2 = $4 and v3 = $5 and v4 = $6 and v5 = $7
+	`
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		_, err = tx.ExecContext(ctx, query, ruleArgs(ptype, rule)...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RemoveFilteredPolicy removes the policy rules that match the filter from the casbin_rule table
+func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	where := []string{"ptype = $1"}
+	args := []interface{}{ptype}
+	for i, value := range fieldValues {
+		column := fieldIndex + i
+		if value == "" || column > 5 {
+			continue
+		}
+		args = append(args, value)
+		where = append(where, fmt.Sprintf("v%d = $%d", column, len(args)))
+	}
+
+	query := `delete from casbin_rule where ` + strings.Join(where, " and ")
+
+	ctx, cancle := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancle()
+
+	_, err := a.DB.ExecContext(ctx, query, args...)
+	return err
+}
@@ -0,0 +1,257 @@
+package permission
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Env holds the attributes of a request that policy conditions are evaluated against
+type Env struct {
+	// Time is when the request was made, windows are compared in UTC
+	Time time.Time
+	// IP is the client address of the request
+	IP string
+	// Scope is the scope of the token the request was authenticated with
+	Scope string
+	// MFA is true when the token was issued after a second factor was checked
+	MFA bool
+	// OwnerTeamID is the team owning the object, 0 when the object has no owner
+	OwnerTeamID int64
+	// Attributes are the attributes of the subject, user.<name> for its own and team.<name>
+	// for those of its teams with one value per team
+	Attributes map[string][]string
+	// LoadAttributes reads Attributes the first time a condition needs them when they are
+	// not set, so requests matching no attribute clause never read them
+	LoadAttributes func() (map[string][]string, error)
+
+	// roles are the subjects the request's subject inherits from, set by the PermissionManager
+	roles []string
+	// attributesErr is the error loading Attributes, reported by condMatch
+	attributesErr error
+}
+
+// attributes returns the attributes of the subject, loading them on first use
+func (env *Env) attributes() map[string][]string {
+	if env.Attributes == nil && env.LoadAttributes != nil && env.attributesErr == nil {
+		env.Attributes, env.attributesErr = env.LoadAttributes()
+	}
+	return env.Attributes
+}
+
+// Condition restricts a policy to requests whose Env matches every clause. It is written in
+// the cond field of a policy as clauses separated by ; such as
+//
+//	time=09:00-17:00;ip=10.0.0.0/8|192.168.0.0/16;mfa;scope=login;team=owner;user.dept=eng|ops
+//
+// A user.<name> or team.<name> clause holds when the subject's attribute has one of the
+// values, for team attributes in any of its teams. An mfa clause holds for tokens whose mfa
+// flag is set, which no login sets yet, so until one checks a second factor it denies every
+// request.
+type Condition struct {
+	From       *int
+	To         *int
+	Networks   []*net.IPNet
+	MFA        bool
+	Scopes     []string
+	OwnerTeam  bool
+	Attributes map[string][]string
+}
+
+var conditions sync.Map
+
+// ParseCondition parses the cond field of a policy, an empty cond has no clauses
+func ParseCondition(cond string) (*Condition, error) {
+	if c, ok := conditions.Load(cond); ok {
+		return c.(*Condition), nil
+	}
+
+	c := &Condition{}
+	for _, clause := range strings.Split(cond, ";") {
+		if clause == "" {
+			continue
+		}
+		key, value := clause, ""
+		if i := strings.Index(clause, "="); i >= 0 {
+			key, value = clause[:i], clause[i+1:]
+		}
+
+		switch key {
+		case "time":
+			window := strings.Split(value, "-")
+			if len(window) != 2 {
+				return nil, fmt.Errorf("time must be a window such as 09:00-17:00")
+			}
+			from, err := minuteOfDay(window[0])
+			if err != nil {
+				return nil, err
+			}
+			to, err := minuteOfDay(window[1])
+			if err != nil {
+				return nil, err
+			}
+			if from == to {
+				return nil, fmt.Errorf("time window %s is empty", value)
+			}
+			c.From, c.To = &from, &to
+		case "ip":
+			for _, cidr := range strings.Split(value, "|") {
+				_, network, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("ip must be CIDR ranges separated by |: %w", err)
+				}
+				c.Networks = append(c.Networks, network)
+			}
+		case "mfa":
+			if value != "" {
+				return nil, fmt.Errorf("mfa does not take a value")
+			}
+			c.MFA = true
+		case "scope":
+			if value == "" {
+				return nil, fmt.Errorf("scope must list token scopes separated by |")
+			}
+			c.Scopes = strings.Split(value, "|")
+		case "team":
+			if value != "owner" {
+				return nil, fmt.Errorf("team only supports team=owner")
+			}
+			c.OwnerTeam = true
+		default:
+			if !strings.HasPrefix(key, "user.") && !strings.HasPrefix(key, "team.") {
+				return nil, fmt.Errorf("unknown condition %s", key)
+			}
+			if value == "" {
+				return nil, fmt.Errorf("%s must list values separated by |", key)
+			}
+			if c.Attributes == nil {
+				c.Attributes = map[string][]string{}
+			}
+			c.Attributes[key] = strings.Split(value, "|")
+		}
+	}
+
+	conditions.Store(cond, c)
+	return c, nil
+}
+
+func minuteOfDay(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("time must be in HH:MM: %w", err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Allows checks every clause of the Condition against the Env
+func (c *Condition) Allows(env *Env) bool {
+	if c.From != nil {
+		now := env.Time.UTC()
+		minute := now.Hour()*60 + now.Minute()
+		if *c.From <= *c.To {
+			if minute < *c.From || minute >= *c.To {
+				return false
+			}
+		} else if minute < *c.From && minute >= *c.To {
+			// the window wraps around midnight
+			return false
+		}
+	}
+
+	if len(c.Networks) > 0 {
+		ip := net.ParseIP(env.IP)
+		if ip == nil {
+			return false
+		}
+		inRange := false
+		for _, network := range c.Networks {
+			if network.Contains(ip) {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	if c.MFA && !env.MFA {
+		return false
+	}
+
+	if len(c.Scopes) > 0 {
+		found := false
+		for _, scope := range c.Scopes {
+			if scope == env.Scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if c.OwnerTeam {
+		if env.OwnerTeamID == 0 {
+			return false
+		}
+		owner := TeamSubject(env.OwnerTeamID)
+		found := false
+		for _, role := range env.roles {
+			if role == owner {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for key, values := range c.Attributes {
+		found := false
+		for _, have := range env.attributes()[key] {
+			for _, value := range values {
+				if have == value {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// condMatch is the casbin function behind condMatch(r.env, p.cond) in the model's matcher
+func condMatch(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return false, fmt.Errorf("condMatch expects 2 arguments, got %d", len(args))
+	}
+	cond, ok := args[1].(string)
+	if !ok {
+		return false, fmt.Errorf("condMatch expects a string condition")
+	}
+	if cond == "" {
+		return true, nil
+	}
+
+	env, ok := args[0].(*Env)
+	if !ok {
+		return false, nil
+	}
+	c, err := ParseCondition(cond)
+	if err != nil {
+		// a condition that does not parse never allows a request
+		return false, nil
+	}
+	allow := c.Allows(env)
+	if env.attributesErr != nil {
+		return false, env.attributesErr
+	}
+	return allow, nil
+}
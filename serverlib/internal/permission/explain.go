@@ -0,0 +1,168 @@
+package permission
+
+import (
+	"fmt"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+)
+
+// EvaluatedRule is a policy that applies to one of the subject's roles, with the reason it
+// did or did not match the request
+type EvaluatedRule struct {
+	Rule    []string `json:"rule"`
+	Matched bool     `json:"matched"`
+	Reason  string   `json:"reason"`
+}
+
+// Trace shows how a decision was reached: the inheritance chain from the subject, each
+// policy the matcher evaluated and the policy that allowed the request
+type Trace struct {
+	Subject string           `json:"subject"`
+	Object  string           `json:"object"`
+	Action  string           `json:"action"`
+	Chain   [][]string       `json:"chain"`
+	Roles   []string         `json:"roles"`
+	Rules   []*EvaluatedRule `json:"rules"`
+	Allow   bool             `json:"allow"`
+	Matched []string         `json:"matched"`
+}
+
+// Change is a proposed addition or removal of a rule, used to dry run a policy change
+type Change struct {
+	Op    string   `json:"op"`
+	PType string   `json:"ptype"`
+	Rule  []string `json:"rule"`
+}
+
+// ValidateChange checks a Change is an add or remove of a rule that fits the model
+func (pm *PermissionManager) ValidateChange(change Change) error {
+	if change.Op != "add" && change.Op != "remove" {
+		return fmt.Errorf("invalid rule: op must be one of add or remove")
+	}
+	return pm.ValidateRule(change.PType, change.Rule)
+}
+
+// Trace explains the decision Explain makes for sub taking act on obj
+func (pm *PermissionManager) Trace(sub, obj, act string, env *Env, rules Rules) (*Trace, error) {
+	enforcer, err := pm.forSubject(sub, rules)
+	if err != nil {
+		return nil, err
+	}
+	return trace(enforcer, sub, obj, act, env)
+}
+
+// DryRun evaluates each check, a (obj, act) pair, for sub before and after the changes are
+// applied to a copy of the policy. Nothing is written to casbin_rule.
+func (pm *PermissionManager) DryRun(sub string, checks [][]string, env *Env, changes []Change, rules Rules) ([]bool, []bool, error) {
+	enforcer, err := pm.forSubject(sub, rules)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := enforcer.GetModel().Copy()
+	for _, change := range changes {
+		if change.PType == "" {
+			return nil, nil, fmt.Errorf("invalid rule: missing policy type")
+		}
+		sec := change.PType[:1]
+		switch change.Op {
+		case "add":
+			if !m.HasPolicy(sec, change.PType, change.Rule) {
+				m.AddPolicy(sec, change.PType, change.Rule)
+			}
+		case "remove":
+			m.RemovePolicy(sec, change.PType, change.Rule)
+		}
+	}
+
+	proposed, err := casbin.NewSyncedEnforcer(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	proposed.AddFunction("condMatch", condMatch)
+	if err = proposed.BuildRoleLinks(); err != nil {
+		return nil, nil, err
+	}
+
+	before := make([]bool, len(checks))
+	after := make([]bool, len(checks))
+	for i, check := range checks {
+		if before[i], err = decide(enforcer, sub, check[0], check[1], env); err != nil {
+			return nil, nil, err
+		}
+		if after[i], err = decide(proposed, sub, check[0], check[1], env); err != nil {
+			return nil, nil, err
+		}
+	}
+	return before, after, nil
+}
+
+func decide(enforcer *casbin.SyncedEnforcer, sub, obj, act string, env *Env) (bool, error) {
+	roles, err := enforcer.GetImplicitRolesForUser(sub)
+	if err != nil {
+		return false, err
+	}
+	env.roles = roles
+	return enforcer.Enforce(sub, obj, act, env)
+}
+
+func trace(enforcer *casbin.SyncedEnforcer, sub, obj, act string, env *Env) (*Trace, error) {
+	t := &Trace{Subject: sub, Object: obj, Action: act, Chain: [][]string{}, Roles: []string{}, Rules: []*EvaluatedRule{}, Matched: []string{}}
+
+	// walk the grouping rules breadth first to build the inheritance chain
+	seen := map[string]bool{sub: true}
+	queue := []string{sub}
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		parents, err := enforcer.GetRolesForUser(child)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range parents {
+			t.Chain = append(t.Chain, []string{child, parent})
+			if !seen[parent] {
+				seen[parent] = true
+				t.Roles = append(t.Roles, parent)
+				queue = append(queue, parent)
+			}
+		}
+	}
+	env.roles = t.Roles
+
+	for _, p := range enforcer.GetPolicy() {
+		if !seen[p[0]] {
+			continue
+		}
+		rule := &EvaluatedRule{Rule: p}
+		switch {
+		case !util.KeyMatch(obj, p[1]):
+			rule.Reason = "object does not match"
+		case act != p[2]:
+			rule.Reason = "action does not match"
+		default:
+			c, err := ParseCondition(p[3])
+			switch {
+			case err != nil:
+				rule.Reason = "condition is invalid: " + err.Error()
+			case !c.Allows(env):
+				rule.Reason = "condition is not met"
+			default:
+				rule.Matched = true
+				rule.Reason = "matched"
+			}
+		}
+		t.Rules = append(t.Rules, rule)
+	}
+
+	allow, matched, err := enforcer.EnforceEx(sub, obj, act, env)
+	if err != nil {
+		return nil, err
+	}
+	t.Allow = allow
+	if matched != nil {
+		t.Matched = matched
+	}
+	return t, nil
+}
@@ -1,52 +1,522 @@
 package permission
 
 import (
+	"context"
+	"database/sql"
 	"embed"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
-	casbin_fs_adapter "github.com/naucon/casbin-fs-adapter"
+	"github.com/casbin/casbin/v2/util"
 )
 
 const (
 	Read  = "read"
 	Write = "write"
+	Admin = "admin"
 	SQLM  = "sqlm"
 )
 
+// ResourceObject returns the casbin object for a sql-manager resource such as a repo or a
+// schema, policies may match many resources with a trailing * such as sqlm/repo/*
+func ResourceObject(kind string, name string) string {
+	return SQLM + "/" + kind + "/" + name
+}
+
+// OrgAdminRole is the role inherited by the admins of an organization
+const OrgAdminRole = "org-admin"
+
+// AnonRole is the subject of requests made without a token, and is inherited by the other
+// roles so public routes are declared by granting it a permission
+const AnonRole = "anon"
+
 //go:embed *.txt
 var casbinModel embed.FS
-//go:embed *.csv
-var casbinPolicy embed.FS
 
+// maxCachedSubjects bounds the per-subject cache, it is emptied when full
+const maxCachedSubjects = 10000
+
+// PermissionManager evaluates the casbin policy stored in the casbin_rule table. The stored
+// policy is loaded once into a long lived enforcer, and the enforcer built for each subject
+// from it is cached until the policy or the org -> team -> user hierarchy changes.
 type PermissionManager struct {
+	DB *sql.DB
+
+	loadMu   sync.Mutex
+	loaded   uint32
+	mu       sync.RWMutex
+	enforcer *casbin.Enforcer
+	subjects map[string]*casbin.SyncedEnforcer
+	gen      uint64
+	version  int64
 }
 
-func (pm *PermissionManager) GetForRole(role string) ([]string, error) {
+var managers = struct {
+	sync.Mutex
+	pool map[*sql.DB]*PermissionManager
+}{pool: map[*sql.DB]*PermissionManager{}}
+
+// New returns the PermissionManager shared by everything using the connection pool
+func New(db *sql.DB) *PermissionManager {
+	managers.Lock()
+	defer managers.Unlock()
 
+	pm, ok := managers.pool[db]
+	if !ok {
+		pm = &PermissionManager{DB: db}
+		managers.pool[db] = pm
+	}
+	return pm
+}
+
+func (pm *PermissionManager) model() (model.Model, error) {
 	mf, err := casbinModel.ReadFile("casbin.txt")
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := model.NewModelFromString(string(mf))
+	return model.NewModelFromString(string(mf))
+}
+
+// load builds the shared enforcer the first time it is needed. A failed load is retried by
+// the next caller rather than remembered.
+func (pm *PermissionManager) load() error {
+	if atomic.LoadUint32(&pm.loaded) == 1 {
+		return nil
+	}
+
+	pm.loadMu.Lock()
+	defer pm.loadMu.Unlock()
+	if atomic.LoadUint32(&pm.loaded) == 1 {
+		return nil
+	}
+
+	m, err := pm.model()
+	if err != nil {
+		return err
+	}
+
+	version, err := pm.currentVersion()
 	if err != nil {
+		return err
+	}
+
+	enforcer, err := casbin.NewEnforcer(m, NewAdapter(pm.DB))
+	if err != nil {
+		return err
+	}
+	enforcer.AddFunction("condMatch", condMatch)
+
+	pm.mu.Lock()
+	pm.enforcer = enforcer
+	pm.reset()
+	pm.version = version
+	pm.mu.Unlock()
+
+	atomic.StoreUint32(&pm.loaded, 1)
+	return nil
+}
+
+// currentVersion reads the policy version, bumped by triggers on every table the policy and
+// the hierarchy are built from
+func (pm *PermissionManager) currentVersion() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var version int64
+	err := pm.DB.QueryRowContext(ctx, `select version from policy_version where id = 1`).Scan(&version)
+	return version, err
+}
+
+// Refresh reloads the stored policy and empties the cache when the policy version has moved
+// on, which happens whenever this or another replica changes the policy or the hierarchy
+func (pm *PermissionManager) Refresh() error {
+	if err := pm.load(); err != nil {
+		return err
+	}
+
+	version, err := pm.currentVersion()
+	if err != nil {
+		return err
+	}
+
+	pm.mu.RLock()
+	current := pm.version
+	pm.mu.RUnlock()
+	if version == current {
+		return nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if err := pm.enforcer.LoadPolicy(); err != nil {
+		return err
+	}
+	pm.reset()
+	pm.version = version
+	return nil
+}
+
+// Invalidate empties the per-subject cache, it is called after a change to the hierarchy
+func (pm *PermissionManager) Invalidate() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.reset()
+}
+
+// reset empties the per-subject cache, the caller must hold the write lock
+func (pm *PermissionManager) reset() {
+	pm.subjects = map[string]*casbin.SyncedEnforcer{}
+	pm.gen++
+}
+
+// GetForRole returns the effective permission codes of a role, including those inherited
+// from the roles it inherits through g rules
+func (pm *PermissionManager) GetForRole(role string) ([]string, error) {
+	if err := pm.load(); err != nil {
 		return nil, err
 	}
 
-	policies := casbin_fs_adapter.NewAdapter(casbinPolicy, "policy.csv")
-	enforcer, err := casbin.NewEnforcer(m, policies)
+	pm.mu.RLock()
+	perm, err := pm.enforcer.GetImplicitPermissionsForUser(role)
+	pm.mu.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-	perm := enforcer.GetFilteredPolicy(0, role)
 
+	return codes(perm), nil
+}
+
+// GetGrantsForRole returns the permission codes granted to the role itself
+func (pm *PermissionManager) GetGrantsForRole(role string) ([]string, error) {
+	if err := pm.load(); err != nil {
+		return nil, err
+	}
+
+	pm.mu.RLock()
+	perm := pm.enforcer.GetFilteredPolicy(0, role)
+	pm.mu.RUnlock()
+
+	return codes(perm), nil
+}
+
+// GetInheritedRoles returns every role a role inherits, directly or through another role
+func (pm *PermissionManager) GetInheritedRoles(role string) ([]string, error) {
+	if err := pm.load(); err != nil {
+		return nil, err
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.enforcer.GetImplicitRolesForUser(role)
+}
+
+// codes returns the distinct permission codes of policies, in order. The code of a policy
+// with a condition carries its clauses, such as /reports-read;ip=10.0.0.0/8, so it is not
+// mistaken for an unconditional grant.
+func codes(perm [][]string) []string {
+	seen := map[string]bool{}
 	var permissions []string
-	for _, p  := range perm {
-		permissions = append(permissions, p[1] + "-" + p[2])
+	for _, p := range perm {
+		code := p[1] + "-" + p[2]
+		if len(p) > 3 && p[3] != "" {
+			code += ";" + p[3]
+		}
+		if !seen[code] {
+			seen[code] = true
+			permissions = append(permissions, code)
+		}
+	}
+	return permissions
+}
+
+// Rules returns the policies and grouping rules for a subject that are not stored in
+// casbin_rule, such as those derived from the hierarchy. Each link is a (child, parent) pair.
+type Rules func() (policies [][]string, links [][]string, err error)
+
+// forSubject returns the cached enforcer for sub, building it from the stored policy and the
+// rules on a cache miss
+func (pm *PermissionManager) forSubject(sub string, rules Rules) (*casbin.SyncedEnforcer, error) {
+	if err := pm.load(); err != nil {
+		return nil, err
+	}
+
+	pm.mu.RLock()
+	enforcer, ok := pm.subjects[sub]
+	gen := pm.gen
+	pm.mu.RUnlock()
+	if ok {
+		return enforcer, nil
+	}
+
+	policies, links, err := rules()
+	if err != nil {
+		return nil, err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	m := pm.enforcer.GetModel().Copy()
+	for _, p := range policies {
+		if !m.HasPolicy("p", "p", p) {
+			m.AddPolicy("p", "p", p)
+		}
+	}
+	for _, g := range links {
+		if !m.HasPolicy("g", "g", g) {
+			m.AddPolicy("g", "g", g)
+		}
 	}
 
+	enforcer, err = casbin.NewSyncedEnforcer(m)
 	if err != nil {
 		return nil, err
 	}
-	return permissions, nil
+	enforcer.AddFunction("condMatch", condMatch)
+	if err = enforcer.BuildRoleLinks(); err != nil {
+		return nil, err
+	}
+
+	// the rules were read before an invalidation, use them for this request only
+	if gen != pm.gen {
+		return enforcer, nil
+	}
+	if len(pm.subjects) >= maxCachedSubjects {
+		pm.reset()
+	}
+	pm.subjects[sub] = enforcer
+	return enforcer, nil
+}
+
+// GetForSubject returns the permission codes for a subject, including those inherited
+// through the stored grouping rules and the rules for the subject
+func (pm *PermissionManager) GetForSubject(sub string, rules Rules) ([]string, error) {
+	enforcer, err := pm.forSubject(sub, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	perm, err := enforcer.GetImplicitPermissionsForUser(sub)
+	if err != nil {
+		return nil, err
+	}
+	return codes(perm), nil
+}
+
+// Enforce checks whether sub may take act on obj given the stored policy, the rules for the
+// subject and the conditions on the policies evaluated against env
+func (pm *PermissionManager) Enforce(sub, obj, act string, env *Env, rules Rules) (bool, error) {
+	allow, _, err := pm.Explain(sub, obj, act, env, rules)
+	return allow, err
+}
+
+// Explain checks whether sub may take act on obj like Enforce, also returning the policy
+// that allowed it
+func (pm *PermissionManager) Explain(sub, obj, act string, env *Env, rules Rules) (bool, []string, error) {
+	enforcer, err := pm.forSubject(sub, rules)
+	if err != nil {
+		return false, nil, err
+	}
+
+	roles, err := enforcer.GetImplicitRolesForUser(sub)
+	if err != nil {
+		return false, nil, err
+	}
+	env.roles = roles
+
+	return enforcer.EnforceEx(sub, obj, act, env)
+}
+
+// SplitCode splits a permission code such as /users-write into its object and action
+func SplitCode(code string) (string, string) {
+	i := strings.LastIndex(code, "-")
+	if i < 0 {
+		return code, ""
+	}
+	return code[:i], code[i+1:]
+}
+
+// ValidateRule checks a rule has the shape the casbin model defines for ptype, and that the
+// model's matcher can evaluate it
+func (pm *PermissionManager) ValidateRule(ptype string, rule []string) error {
+	m, err := pm.model()
+	if err != nil {
+		return err
+	}
+
+	if ptype == "" {
+		return fmt.Errorf("invalid rule: missing policy type")
+	}
+	ast, ok := m[ptype[:1]][ptype]
+	if !ok {
+		return fmt.Errorf("invalid rule: unknown policy type %s", ptype)
+	}
+
+	n := len(ast.Tokens)
+	if ptype[:1] == "g" {
+		n = strings.Count(ast.Value, "_")
+	}
+	if len(rule) != n {
+		return fmt.Errorf("invalid rule: %s expects %d values, got %d", ptype, n, len(rule))
+	}
+
+	for i, v := range rule {
+		// the condition of a policy is the only value that may be empty
+		optional := ptype[:1] == "p" && ast.Tokens[i] == ptype+"_cond"
+		if (v == "" && !optional) || strings.TrimSpace(v) != v || strings.ContainsAny(v, ",\"\r\n") {
+			return fmt.Errorf("invalid rule: value %q is empty or contains illegal characters", v)
+		}
+		if optional {
+			if _, err := ParseCondition(v); err != nil {
+				return fmt.Errorf("invalid rule: condition %q: %w", v, err)
+			}
+		}
+	}
+
+	if ptype[:1] == "p" {
+		enforcer, err := casbin.NewEnforcer(m)
+		if err != nil {
+			return err
+		}
+		enforcer.AddFunction("condMatch", condMatch)
+		if _, err := enforcer.AddNamedPolicy(ptype, rule); err != nil {
+			return fmt.Errorf("invalid rule: %w", err)
+		}
+		if _, err := enforcer.Enforce(rule[0], rule[1], rule[2], &Env{}); err != nil {
+			return fmt.Errorf("invalid rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// AddRule validates a rule and stores it in casbin_rule, returning false if it already existed
+func (pm *PermissionManager) AddRule(ptype string, rule []string) (bool, error) {
+	if err := pm.ValidateRule(ptype, rule); err != nil {
+		return false, err
+	}
+	if err := pm.load(); err != nil {
+		return false, err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.reset()
+
+	if ptype[:1] == "g" {
+		return pm.enforcer.AddNamedGroupingPolicy(ptype, rule)
+	}
+	return pm.enforcer.AddNamedPolicy(ptype, rule)
+}
+
+// RemoveRule removes a rule from casbin_rule, returning false if it did not exist
+func (pm *PermissionManager) RemoveRule(ptype string, rule []string) (bool, error) {
+	if err := pm.ValidateRule(ptype, rule); err != nil {
+		return false, err
+	}
+	if err := pm.load(); err != nil {
+		return false, err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.reset()
+
+	if ptype[:1] == "g" {
+		return pm.enforcer.RemoveNamedGroupingPolicy(ptype, rule)
+	}
+	return pm.enforcer.RemoveNamedPolicy(ptype, rule)
+}
+
+// RemoveFilteredRule removes the rules in casbin_rule that start with values, whatever their
+// remaining values, returning false if there were none
+func (pm *PermissionManager) RemoveFilteredRule(ptype string, values ...string) (bool, error) {
+	if ptype == "" {
+		return false, fmt.Errorf("invalid rule: missing policy type")
+	}
+	for _, v := range values {
+		if v == "" {
+			return false, fmt.Errorf("invalid rule: filter values must not be empty")
+		}
+	}
+	if err := pm.load(); err != nil {
+		return false, err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.reset()
+
+	if ptype[:1] == "g" {
+		return pm.enforcer.RemoveFilteredNamedGroupingPolicy(ptype, 0, values...)
+	}
+	return pm.enforcer.RemoveFilteredNamedPolicy(ptype, 0, values...)
+}
+
+// GetPoliciesForObject returns the stored policies whose object matches obj, including
+// patterns such as sqlm/repo/*
+func (pm *PermissionManager) GetPoliciesForObject(obj string) ([][]string, error) {
+	if err := pm.load(); err != nil {
+		return nil, err
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	policies := [][]string{}
+	for _, p := range pm.enforcer.GetPolicy() {
+		if p[1] != "*" && util.KeyMatch(obj, p[1]) {
+			policies = append(policies, p)
+		}
+	}
+	return policies, nil
+}
+
+// GetRolesForSubject returns the roles directly assigned to a subject through g rules
+func (pm *PermissionManager) GetRolesForSubject(sub string) ([]string, error) {
+	if err := pm.load(); err != nil {
+		return nil, err
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var roles []string
+	for _, g := range pm.enforcer.GetFilteredGroupingPolicy(0, sub) {
+		roles = append(roles, g[1])
+	}
+	return roles, nil
+}
+
+// UserSubject returns the casbin subject for a UserAccount ID
+func UserSubject(id int64) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+// TeamSubject returns the casbin subject for a Team ID
+func TeamSubject(id int64) string {
+	return fmt.Sprintf("team:%d", id)
+}
+
+// TeamAdminSubject returns the casbin subject held by the admins of a Team
+func TeamAdminSubject(id int64) string {
+	return fmt.Sprintf("team:%d:admin", id)
+}
+
+// OrgSubject returns the casbin subject for an Organization ID
+func OrgSubject(id int64) string {
+	return fmt.Sprintf("org:%d", id)
+}
+
+// OrgAdminSubject returns the casbin subject held by the admins of an Organization
+func OrgAdminSubject(id int64) string {
+	return fmt.Sprintf("org:%d:admin", id)
 }
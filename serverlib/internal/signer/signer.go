@@ -0,0 +1,53 @@
+package signer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// Signer signs credentials issued by auth-manager so that sql-manager servers can verify
+// them offline with the public key
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+// New creates a Signer from a base64 encoded ed25519 seed, an empty seed generates a new key
+func New(seed string) (*Signer, error) {
+	if seed == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Signer{key: key}, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing seed: %w", err)
+	}
+	if len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing seed: must be %d bytes", ed25519.SeedSize)
+	}
+	return &Signer{key: ed25519.NewKeyFromSeed(b)}, nil
+}
+
+// Sign returns the base64 encoded signature for msg
+func (s *Signer) Sign(msg []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, msg))
+}
+
+// Verify checks a base64 encoded signature for msg
+func (s *Signer) Verify(msg []byte, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(s.key.Public().(ed25519.PublicKey), msg, sig)
+}
+
+// PublicKey returns the base64 encoded public key
+func (s *Signer) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
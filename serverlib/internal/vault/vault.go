@@ -0,0 +1,54 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Vault encrypts team secrets at rest with AES-256-GCM
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// New creates a Vault from a base64 encoded 32 byte key
+func New(key string) (*Vault, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault key: %w", err)
+	}
+	if len(b) != 32 {
+		return nil, errors.New("invalid vault key: must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{aead: aead}, nil
+}
+
+// Seal encrypts plaintext, binding it to additional so it cannot be moved to another secret
+func (v *Vault) Seal(plaintext []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Open decrypts a ciphertext produced by Seal
+func (v *Vault) Open(ciphertext []byte, additional []byte) ([]byte, error) {
+	n := v.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return v.aead.Open(nil, ciphertext[:n], ciphertext[n:], additional)
+}